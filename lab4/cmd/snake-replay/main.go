@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"snake_game/game"
+	"snake_game/protobuf"
+	"snake_game/replay"
+	"strconv"
+	"strings"
+)
+
+const usage = `commands:
+  n [count]   step forward (default 1)
+  b [count]   step back (default 1)
+  s <frame>   seek to a frame number
+  p           pause / resume
+  x <speed>   playback speed, e.g. 0.5 or 4
+  r           redraw the current frame
+  q           quit
+`
+
+func main() {
+	file := flag.String("file", "", "replay file written with -record")
+	speed := flag.Float64("speed", 1, "playback speed")
+	from := flag.Int("from", 0, "frame to start from")
+	render := flag.Bool("render", false, "draw the field as text")
+	info := flag.Bool("info", false, "print a summary and exit")
+	dump := flag.Bool("dump", false, "print every frame without delay and exit")
+	flag.Parse()
+
+	if *file == "" && flag.NArg() > 0 {
+		*file = flag.Arg(0)
+	}
+	if *file == "" {
+		log.Fatalf("[snake-replay] usage: snake-replay [flags] file")
+	}
+
+	rep, err := replay.Load(*file)
+	if err != nil {
+		log.Fatalf("[snake-replay] failed to load %s: %v", *file, err)
+	}
+
+	if *info {
+		printInfo(rep)
+		return
+	}
+
+	if *dump {
+		for i := *from; i < len(rep.Frames); i++ {
+			printFrame(rep, i, rep.Frames[i], *render)
+		}
+		return
+	}
+
+	player := replay.NewPlayer(rep)
+	player.Seek(*from)
+	player.SetSpeed(*speed)
+
+	fmt.Printf("%q: %d frames, %d ms per state\n%s", rep.GameName, len(rep.Frames), rep.DelayMS(), usage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go player.Run(ctx, func(position int, frame *replay.Frame) {
+		printFrame(rep, position, frame, *render)
+	})
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			player.SetPaused(true)
+			player.Step(1)
+			continue
+		}
+
+		arg := 1.0
+		if len(fields) > 1 {
+			arg, err = strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				fmt.Printf("bad argument %q\n", fields[1])
+				continue
+			}
+		}
+
+		switch fields[0] {
+		case "n":
+			player.SetPaused(true)
+			player.Step(int(arg))
+		case "b":
+			player.SetPaused(true)
+			player.Step(-int(arg))
+		case "s":
+			player.Seek(int(arg))
+		case "p":
+			player.TogglePause()
+		case "x":
+			player.SetSpeed(arg)
+			fmt.Printf("speed %.3gx\n", player.Speed())
+		case "r":
+			player.Step(0)
+		case "q":
+			return
+		default:
+			fmt.Print(usage)
+		}
+	}
+}
+
+func printInfo(rep *replay.Replay) {
+	first := rep.Frames[0].State
+	last := rep.Frames[len(rep.Frames)-1].State
+	seconds := float64(len(rep.Frames)*rep.DelayMS()) / 1000
+
+	fmt.Printf("game:   %s\n", rep.GameName)
+	fmt.Printf("field:  %d x %d, food %d, %d ms per state\n",
+		rep.Config.GetWidth(), rep.Config.GetHeight(), rep.Config.GetFoodStatic(), rep.DelayMS())
+	if rep.HasSeed {
+		fmt.Printf("seed:   %d\n", rep.Seed)
+	}
+	fmt.Printf("states: %d (order %d..%d), %.1f s\n", len(rep.Frames), first.GetStateOrder(), last.GetStateOrder(), seconds)
+
+	events := 0
+	for i, frame := range rep.Frames {
+		for _, event := range frame.Events {
+			fmt.Printf("  frame %d: %s\n", i, replay.Describe(event))
+			events++
+		}
+	}
+	fmt.Printf("events: %d\n", events)
+
+	fmt.Println("final scores:")
+	for _, player := range last.GetPlayers().GetPlayers() {
+		fmt.Printf("  %d %s (%s): %d\n", player.GetId(), player.GetName(), player.GetType(), player.GetScore())
+	}
+}
+
+func printFrame(rep *replay.Replay, position int, frame *replay.Frame, render bool) {
+	state := frame.State
+	for _, event := range frame.Events {
+		fmt.Printf("  %s\n", replay.Describe(event))
+	}
+
+	var scores []string
+	for _, player := range state.GetPlayers().GetPlayers() {
+		scores = append(scores, fmt.Sprintf("%d:%s=%d", player.GetId(), player.GetName(), player.GetScore()))
+	}
+	fmt.Printf("[%d/%d] state %d snakes=%d food=%d | %s\n",
+		position, len(rep.Frames)-1, state.GetStateOrder(), len(state.GetSnakes()), len(state.GetFoods()), strings.Join(scores, " "))
+
+	if render {
+		fmt.Print(renderField(rep.Config, state))
+	}
+}
+
+func renderField(config *protobuf.GameConfig, state *protobuf.GameState) string {
+	width, height := int(config.GetWidth()), int(config.GetHeight())
+	cells := make([][]byte, height)
+	for y := range cells {
+		cells[y] = []byte(strings.Repeat(".", width))
+	}
+
+	for _, food := range state.GetFoods() {
+		cells[food.GetY()][food.GetX()] = '*'
+	}
+
+	field := game.NewField(config)
+	field.EditFieldFromState(state)
+	for _, snake := range field.Snakes() {
+		mark := byte('a' + snake.PlayerID()%26)
+		if snake.IsZombie() {
+			mark = 'z'
+		}
+		for i, part := range snake.Body() {
+			if i == 0 {
+				cells[part.GetY()][part.GetX()] = mark - 'a' + 'A'
+			} else {
+				cells[part.GetY()][part.GetX()] = mark
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, row := range cells {
+		b.Write(row)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"snake_game/game"
+	"snake_game/network"
+	"snake_game/replay"
+	"syscall"
+	"time"
+)
+
+func main() {
+	gameName := flag.String("name", "snake server", "game name shown in announcements")
+	width := flag.Int("width", 40, "field width in cells")
+	height := flag.Int("height", 30, "field height in cells")
+	foodStatic := flag.Int("food", 1, "amount of food independent of the number of players")
+	delayMS := flag.Int("delay", 1000, "delay between game states in milliseconds")
+	bind := flag.String("bind", "", "IP, host:port or interface name to bind the game socket to (default: all IPv4 interfaces)")
+	port := flag.Int("port", 0, "UDP port for the game socket, 0 picks a free one")
+	announce := flag.Duration("announce", network.AnnouncementDelay*time.Millisecond, "interval between multicast announcements")
+	robots := flag.Int("robots", 0, "number of robot players to add")
+	robotLevel := flag.String("robot-level", "normal", "robot difficulty: easy, normal or hard")
+	record := flag.String("record", "", "file to record the match to, see snake-replay")
+	delta := flag.Bool("delta", false, "send clients that support it only the changes between states")
+	seed := flag.Int64("seed", 0, "seed of the game random generator, 0 picks a random one")
+	flag.Parse()
+
+	// the ranges of GameConfig in snakes.proto
+	if *width < 10 || *width > 100 || *height < 10 || *height > 100 {
+		log.Fatalf("[snake-server] width and height must be in 10-100, got %dx%d", *width, *height)
+	}
+	if *foodStatic < 0 || *foodStatic > 100 {
+		log.Fatalf("[snake-server] food must be in 0-100, got %d", *foodStatic)
+	}
+	if *delayMS < 100 || *delayMS > 3000 {
+		log.Fatalf("[snake-server] delay must be in 100-3000 ms, got %d", *delayMS)
+	}
+	if *announce <= 0 || *robots < 0 || *port < 0 || *port > 65535 {
+		log.Fatalf("[snake-server] announce must be positive, robots must not be negative, port must fit in 0-65535")
+	}
+
+	difficulty, err := game.ParseDifficulty(*robotLevel)
+	if err != nil {
+		log.Fatalf("[snake-server] %v", err)
+	}
+
+	server := network.NewServer(*gameName, *width, *height, *foodStatic, *delayMS)
+	server.SetHeadless()
+	server.SetAnnounceDelay(*announce)
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	server.SetSeed(*seed)
+	server.SetDeltaStates(*delta)
+
+	addr, err := network.ParseBindAddress(*bind, *port)
+	if err != nil {
+		log.Fatalf("[snake-server] bad bind address %s: %v", *bind, err)
+	}
+	server.SetBindAddr(addr)
+
+	if *record != "" {
+		recorder, err := replay.NewSeededRecorder(*record, *gameName, server.GameConfig(), server.Seed())
+		if err != nil {
+			log.Fatalf("[snake-server] %v", err)
+		}
+		server.SetRecorder(recorder)
+	}
+
+	for i := 0; i < *robots; i++ {
+		_, err = server.AddRobot(difficulty)
+		if err != nil {
+			log.Printf("[snake-server] added only %d of %d robots: %v", i, *robots, err)
+			break
+		}
+	}
+
+	err = server.Start()
+	if err != nil {
+		log.Fatalf("[snake-server] failed to start: %v", err)
+	}
+
+	log.Printf("[snake-server] hosting %q (%d x %d, food %d, delay %d ms, seed %d) on %s",
+		*gameName, *width, *height, *foodStatic, *delayMS, *seed, server.ServerAddr().String())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	err = server.Stop()
+	if err != nil {
+		log.Printf("[snake-server] failed to stop: %v", err)
+	}
+}
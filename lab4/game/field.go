@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"snake_game/protobuf"
 	"sync"
+	"time"
 )
 
 const (
@@ -18,6 +19,7 @@ type Field struct {
 	config *protobuf.GameConfig
 	snakes []*Snake
 	foods  []*protobuf.GameState_Coord
+	rng    *rand.Rand
 	lock   *sync.Mutex
 }
 
@@ -26,6 +28,7 @@ func NewField(config *protobuf.GameConfig) *Field {
 		config: config,
 		snakes: []*Snake{},
 		foods:  []*protobuf.GameState_Coord{},
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
 		lock:   new(sync.Mutex),
 	}
 }
@@ -68,8 +71,8 @@ func (f *Field) EditFieldFromState(state *protobuf.GameState) {
 func (f *Field) findValidSnakePosition(initialPosition *[]*protobuf.GameState_Coord) (protobuf.Direction, error) {
 
 	for attempt := 0; attempt < maxAttemptsToFind; attempt++ {
-		centerX := rand.Intn(f.Width())
-		centerY := rand.Intn(f.Height())
+		centerX := f.rng.Intn(f.Width())
+		centerY := f.rng.Intn(f.Height())
 		squareIsFree := true
 
 		for dx := -squareSize / 2; dx <= squareSize/2; dx++ {
@@ -90,14 +93,14 @@ func (f *Field) findValidSnakePosition(initialPosition *[]*protobuf.GameState_Co
 		}
 
 		head := &protobuf.GameState_Coord{X: proto.Int32(int32(centerX)), Y: proto.Int32(int32(centerY))}
-		direction := rand.Intn(4)
+		direction := f.rng.Intn(4)
 
 		tailX, tailY := centerX, centerY
 		var headDirection protobuf.Direction
 
 		switch direction {
 		case 0:
-			tailY = (centerY - 1 + f.Width()) % f.Height()
+			tailY = (centerY - 1 + f.Height()) % f.Height()
 			headDirection = protobuf.Direction_DOWN
 		case 1:
 			tailX = (centerX + 1) % f.Width()
@@ -125,18 +128,7 @@ func (f *Field) findValidSnakePosition(initialPosition *[]*protobuf.GameState_Co
 func (f *Field) IsCellOccupied(cell *protobuf.GameState_Coord) bool {
 	f.lock.Lock()
 	defer f.lock.Unlock()
-
-	for _, snake := range f.snakes {
-		if snake.BodyContains(cell) {
-			return true
-		}
-	}
-	for _, food := range f.foods {
-		if food.GetX() == cell.GetX() && food.GetY() == cell.GetY() {
-			return true
-		}
-	}
-	return false
+	return f.cellTaken(cell)
 }
 
 func (f *Field) ContainsFood(cell *protobuf.GameState_Coord) bool {
@@ -156,6 +148,7 @@ func (f *Field) UpdateSnake(snake *Snake) {
 		if snk.PlayerID() == snake.PlayerID() {
 			snk.SetBody(snake.Body())
 			snk.SetHeadDirection(snake.HeadDirection())
+			snk.SetState(snake.State())
 			snk.SetUpdated()
 			return
 		}
@@ -218,21 +211,37 @@ func (f *Field) RemoveSnake(playerId int) {
 		return
 	}
 
-	for _, body := range snake.Body() {
-		if body.GetX() == snake.Head().GetX() && body.GetY() == snake.Head().GetY() {
+	for i, snk := range f.snakes {
+		if snk == snake {
+			f.snakes = append(f.snakes[:i], f.snakes[i+1:]...)
+			break
+		}
+	}
+
+	// every free cell of the dead snake turns into food with probability 0.5
+	for _, cell := range snake.Body() {
+		if f.cellTaken(cell) {
 			continue
 		}
-		if rand.Intn(100) < 50 {
-			f.foods = append(f.foods, body)
+		if f.rng.Intn(100) < 50 {
+			f.foods = append(f.foods, cell)
 		}
 	}
+}
 
-	for i, snk := range f.snakes {
-		if snk == snake {
-			f.snakes = append(f.snakes[:i], f.snakes[i+1:]...)
-			break
+// cellTaken is IsCellOccupied for callers that hold f.lock.
+func (f *Field) cellTaken(cell *protobuf.GameState_Coord) bool {
+	for _, snake := range f.snakes {
+		if snake.BodyContains(cell) {
+			return true
+		}
+	}
+	for _, food := range f.foods {
+		if sameCell(food, cell) {
+			return true
 		}
 	}
+	return false
 }
 
 func (f *Field) RemoveFood(coord *protobuf.GameState_Coord) {
@@ -257,6 +266,18 @@ func (f *Field) SetSnakes(snakes []*Snake) {
 	f.snakes = snakes
 }
 
+// AliveSnakes counts the snakes that still have a player, zombies are left
+// out.
+func (f *Field) AliveSnakes() int {
+	count := 0
+	for _, snake := range f.Snakes() {
+		if !snake.IsZombie() {
+			count++
+		}
+	}
+	return count
+}
+
 func (f *Field) AmountOfFoodNeeded(playerCount int) int {
 	return playerCount + f.FoodStatic()
 }
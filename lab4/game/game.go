@@ -6,82 +6,212 @@ import (
 	"log"
 	"math/rand"
 	"snake_game/protobuf"
+	"sort"
 	"sync"
+	"time"
 )
 
+// Game owns the field and advances it tick by tick. All randomness comes
+// from a generator derived from the seed and the tick number, so two games
+// with the same seed, state and inputs produce the same next state.
 type Game struct {
-	field *Field
-	lock  *sync.Mutex
+	field  *Field
+	robots map[int]Difficulty
+	seed   int64
+	tick   int
+	lock   *sync.Mutex
 }
 
 func NewGame(config *protobuf.GameConfig) *Game {
-	return &Game{
-		field: NewField(config),
-		lock:  new(sync.Mutex),
+	return NewGameWithSeed(config, time.Now().UnixNano())
+}
+
+func NewGameWithSeed(config *protobuf.GameConfig, seed int64) *Game {
+	g := &Game{
+		field:  NewField(config),
+		robots: make(map[int]Difficulty),
+		seed:   seed,
+		lock:   new(sync.Mutex),
 	}
+	g.field.rng = tickRand(seed, 0)
+	return g
 }
 
-func (g *Game) Update() {
-	g.lock.Lock()
-	defer g.lock.Unlock()
+// tickRand mixes the seed with the tick number (splitmix64), neighbouring
+// ticks get unrelated sequences.
+func tickRand(seed int64, tick int) *rand.Rand {
+	z := uint64(seed) + uint64(tick+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return rand.New(rand.NewSource(int64(z)))
+}
 
-	foodNeeded := g.field.AmountOfFoodNeeded(len(g.field.Snakes())) - len(g.field.Foods())
-	for i := 0; i < foodNeeded; i++ {
-		if g.field.HasPlace() {
-			g.PlaceFood()
-		} else {
-			fmt.Println("[game] place for food not found")
-			break
+// Step is the pure form of Update: it builds a game from state, applies the
+// inputs of the players and returns the following state. The robots play at
+// the difficulties the state carries, normal if it has none for them. The
+// argument state is not modified.
+func Step(config *protobuf.GameConfig, state *protobuf.GameState, inputs map[int32]protobuf.Direction, seed int64) *protobuf.GameState {
+	g := NewGameWithSeed(config, seed)
+	g.field.EditFieldFromState(state)
+	g.SetTick(int(state.GetStateOrder()))
+
+	levels := RobotLevels(state)
+	robots := make(map[int]Difficulty)
+	for _, player := range state.GetPlayers().GetPlayers() {
+		if player.GetType() == protobuf.PlayerType_ROBOT && player.GetIpAddress() == "" {
+			difficulty, ok := levels[int(player.GetId())]
+			if !ok {
+				difficulty = RobotNormal
+			}
+			g.SetRobot(int(player.GetId()), difficulty)
+			robots[int(player.GetId())] = difficulty
 		}
 	}
 
-	var snakesToRemove []*Snake
+	ids := make([]int, 0, len(inputs))
+	for id := range inputs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if snake := g.field.SnakeById(id); snake != nil {
+			snake.SetNextDirection(inputs[int32(id)])
+		}
+	}
+
+	g.Update()
+
+	players := proto.Clone(state.GetPlayers()).(*protobuf.GamePlayers)
+	if players == nil {
+		players = &protobuf.GamePlayers{}
+	}
+	for _, player := range players.GetPlayers() {
+		if snake := g.field.SnakeById(int(player.GetId())); snake != nil {
+			player.Score = proto.Int32(int32(snake.Score()))
+		}
+	}
+
+	next := g.State(state.GetStateOrder()+1, players)
+	SetRobotLevels(next, robots)
+	return next
+}
+
+// State describes the current field as a protobuf state with the given
+// order and players.
+func (g *Game) State(order int32, players *protobuf.GamePlayers) *protobuf.GameState {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	state := &protobuf.GameState{
+		StateOrder: proto.Int32(order),
+		Players:    players,
+	}
+	width, height := g.field.Width(), g.field.Height()
 	for _, snake := range g.field.Snakes() {
-		if !snake.Move(g.field) {
-			snakesToRemove = append(snakesToRemove, snake)
-			continue
+		if snakeProto := GenerateSnakeProto(snake, width, height); snakeProto != nil {
+			state.Snakes = append(state.Snakes, snakeProto)
 		}
+	}
+	state.Foods = append(state.Foods, g.field.Foods()...)
+	return state
+}
 
-		if g.field.ContainsFood(snake.Head()) {
+func (g *Game) Update() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.tick++
+	g.field.rng = tickRand(g.seed, g.tick)
+
+	g.steerRobots()
+
+	// all snakes move at once: heads advance, a snake that ate keeps its
+	// tail, the others free their tail cell before any collision is checked
+	snakes := g.field.Snakes()
+	var eaten []*protobuf.GameState_Coord
+	for _, snake := range snakes {
+		snake.Move(g.field)
+		head := snake.Head()
+		if g.field.ContainsFood(head) {
 			snake.AddScore(1)
-			g.field.RemoveFood(snake.Head())
+			eaten = append(eaten, head)
 		} else {
 			snake.Shrink()
 		}
 	}
-
-	for _, snakeToRemove := range snakesToRemove {
-		g.field.RemoveSnake(snakeToRemove.playerID)
+	for _, food := range eaten {
+		g.field.RemoveFood(food)
 	}
 
-	snakesToRemove = nil
-	for _, snake := range g.field.Snakes() {
-		for _, otherSnake := range g.field.Snakes() {
-			if otherSnake == snake {
-				continue
-			}
-			if otherSnake.Head().GetX() == snake.Head().GetX() && otherSnake.Head().GetY() == snake.Head().GetY() {
-				snakesToRemove = append(snakesToRemove, snake, otherSnake)
-				continue
-			}
-			for _, part := range otherSnake.Body() {
-				if part.GetX() == snake.Head().GetX() && part.GetY() == snake.Head().GetY() {
-					otherSnake.AddScore(1)
-					snakesToRemove = append(snakesToRemove, snake)
-					break
+	// a head on any cell of a snake kills it, its own body included; two
+	// heads on the same cell kill both, and the owner of a body that was hit
+	// gets a point for every other snake that crashed into it
+	var dead []*Snake
+	for _, snake := range snakes {
+		head := snake.Head()
+		crashed := false
+		for _, other := range snakes {
+			for i, part := range other.Body() {
+				if (other == snake && i == 0) || !sameCell(part, head) {
+					continue
 				}
+				crashed = true
+				if other != snake && i > 0 {
+					other.AddScore(1)
+				}
+				break
 			}
 		}
+		if crashed {
+			dead = append(dead, snake)
+		}
+	}
+
+	for _, snake := range dead {
+		g.field.RemoveSnake(snake.PlayerID())
+	}
+
+	foodNeeded := g.field.AmountOfFoodNeeded(g.field.AliveSnakes()) - len(g.field.Foods())
+	for i := 0; i < foodNeeded; i++ {
+		if g.field.HasPlace() {
+			g.PlaceFood()
+		} else {
+			fmt.Println("[game] place for food not found")
+			break
+		}
+	}
+}
+
+func sameCell(a, b *protobuf.GameState_Coord) bool {
+	return a.GetX() == b.GetX() && a.GetY() == b.GetY()
+}
+
+func (g *Game) steerRobots() {
+	ids := make([]int, 0, len(g.robots))
+	for playerId := range g.robots {
+		ids = append(ids, playerId)
 	}
+	// map order is random, the easy robots share the generator
+	sort.Ints(ids)
 
-	for _, snakeToRemove := range snakesToRemove {
-		g.field.RemoveSnake(snakeToRemove.playerID)
+	for _, playerId := range ids {
+		snake := g.field.SnakeById(playerId)
+		if snake == nil {
+			delete(g.robots, playerId)
+			continue
+		}
+		snake.SetNextDirection(g.field.RobotDirection(snake, g.robots[playerId]))
 	}
 }
 
 func (g *Game) UpdateSnakeDirection(playerID int, newDirection protobuf.Direction) {
 	for _, snake := range g.field.Snakes() {
 		if snake.PlayerID() == playerID {
+			if snake.IsZombie() {
+				log.Printf("[game] direction update: snake %d is a zombie", playerID)
+				return
+			}
 			snake.SetNextDirection(newDirection)
 			return
 		}
@@ -92,8 +222,8 @@ func (g *Game) UpdateSnakeDirection(playerID int, newDirection protobuf.Directio
 func (g *Game) PlaceFood() {
 	maxAttempts := g.field.Width() * g.field.Height()
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		x := rand.Intn(g.field.Width())
-		y := rand.Intn(g.field.Height())
+		x := g.field.rng.Intn(g.field.Width())
+		y := g.field.rng.Intn(g.field.Height())
 		food := &protobuf.GameState_Coord{
 			X: proto.Int32(int32(x)),
 			Y: proto.Int32(int32(y)),
@@ -107,7 +237,15 @@ func (g *Game) PlaceFood() {
 	}
 }
 
+// AddSnake places a new snake for the player. A player coming back to the
+// game while its old snake still crawls as a zombie takes it over instead.
 func (g *Game) AddSnake(playerId int) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if snake := g.field.SnakeById(playerId); snake != nil && snake.IsZombie() {
+		snake.SetState(protobuf.GameState_Snake_ALIVE)
+		return nil
+	}
 	err := g.field.AddNewSnake(playerId)
 	if err != nil {
 		return err
@@ -115,10 +253,83 @@ func (g *Game) AddSnake(playerId int) error {
 	return nil
 }
 
+// AddRobot places a new snake steered by the game itself.
+func (g *Game) AddRobot(playerId int, difficulty Difficulty) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	err := g.field.AddNewSnake(playerId)
+	if err != nil {
+		return err
+	}
+	g.robots[playerId] = difficulty
+	return nil
+}
+
+// SetRobot hands an existing snake to the robot AI, a new master uses it
+// for the robots it took over from the state.
+func (g *Game) SetRobot(playerId int, difficulty Difficulty) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.robots[playerId] = difficulty
+}
+
+// RobotDifficulty returns how the robot with the given id plays, false if
+// the player is not a robot.
+func (g *Game) RobotDifficulty(playerId int) (Difficulty, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	difficulty, ok := g.robots[playerId]
+	return difficulty, ok
+}
+
 func (g *Game) RemoveSnake(playerId int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.robots, playerId)
 	g.field.RemoveSnake(playerId)
 }
 
+// MakeZombie leaves the snake of a departed player on the field, it moves
+// on in its last direction and disappears only when it dies.
+func (g *Game) MakeZombie(playerId int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.robots, playerId)
+	if snake := g.field.SnakeById(playerId); snake != nil {
+		snake.SetState(protobuf.GameState_Snake_ZOMBIE)
+	}
+}
+
+func (g *Game) Seed() int64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.seed
+}
+
+// SetSeed restarts the random sequence, the next ticks depend only on the
+// seed and the tick number.
+func (g *Game) SetSeed(seed int64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.seed = seed
+	g.field.rng = tickRand(seed, g.tick)
+}
+
+func (g *Game) Tick() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.tick
+}
+
+// SetTick continues the numbering of a game taken over from a state, the
+// tick is the state order of that state.
+func (g *Game) SetTick(tick int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.tick = tick
+	g.field.rng = tickRand(g.seed, tick)
+}
+
 func (g *Game) Field() *Field {
 	g.lock.Lock()
 	defer g.lock.Unlock()
@@ -0,0 +1,436 @@
+package game
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"snake_game/protobuf"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	up    = protobuf.Direction_UP
+	down  = protobuf.Direction_DOWN
+	left  = protobuf.Direction_LEFT
+	right = protobuf.Direction_RIGHT
+)
+
+// stepSnake is a snake of the state before the tick. Cells are written as
+// "x,y" separated by spaces, bodies start with the head.
+type stepSnake struct {
+	id     int32
+	body   string
+	dir    protobuf.Direction
+	zombie bool
+}
+
+// stepTest is one tick on a small field.
+type stepTest struct {
+	name   string
+	width  int
+	height int
+	food   int
+	snakes []stepSnake
+	foods  string
+	steers map[int32]protobuf.Direction
+
+	// bodies of the snakes alive after the tick, the other ones must be dead
+	bodies map[int32]string
+	// scores of the players after the tick, players not listed have none
+	scores map[int32]int32
+	// cells that must hold food after the tick
+	foodAt string
+	// if set, food after the tick may lie only on these cells
+	foodOnly string
+	// exact amount of food after the tick, -1 skips the check
+	foodCount int
+}
+
+var stepTests = []stepTest{
+	{
+		name: "snake moves one cell and keeps its length", width: 5, height: 5, foodCount: 1,
+		snakes: []stepSnake{{id: 1, body: "2,2 1,2", dir: right}},
+		bodies: map[int32]string{1: "3,2 2,2"},
+	},
+	{
+		name: "head wraps around the field edge", width: 5, height: 5, foodCount: -1,
+		snakes: []stepSnake{{id: 1, body: "4,0 3,0", dir: right}, {id: 2, body: "1,0 1,1", dir: up}},
+		bodies: map[int32]string{1: "0,0 4,0", 2: "1,4 1,0"},
+	},
+	{
+		name: "eating food grows the snake and scores a point", width: 5, height: 5, foodCount: 1,
+		snakes: []stepSnake{{id: 1, body: "2,2 1,2", dir: right}},
+		foods:  "3,2",
+		bodies: map[int32]string{1: "3,2 2,2 1,2"},
+		scores: map[int32]int32{1: 1},
+	},
+	{
+		name: "food is refilled to food_static plus alive snakes", width: 6, height: 6, food: 2, foodCount: 4,
+		snakes: []stepSnake{{id: 1, body: "1,1 0,1", dir: right}, {id: 2, body: "1,4 0,4", dir: right}},
+		bodies: map[int32]string{1: "2,1 1,1", 2: "2,4 1,4"},
+	},
+	{
+		name: "food is placed after the move, not under the new head", width: 3, height: 3, foodCount: 1,
+		snakes:   []stepSnake{{id: 1, body: "0,1 0,0 1,0 2,0 2,1 1,1 1,2", dir: down}},
+		bodies:   map[int32]string{1: "0,2 0,1 0,0 1,0 2,0 2,1 1,1"},
+		foodOnly: "1,2 2,2",
+	},
+	{
+		name: "steer opposite to the head is ignored", width: 5, height: 5, foodCount: -1,
+		snakes: []stepSnake{{id: 1, body: "2,2 1,2", dir: right}},
+		steers: map[int32]protobuf.Direction{1: left},
+		bodies: map[int32]string{1: "3,2 2,2"},
+	},
+	{
+		name: "snake may follow its own tail", width: 5, height: 5, foodCount: -1,
+		snakes: []stepSnake{{id: 1, body: "1,1 2,1 2,2 1,2", dir: left}},
+		steers: map[int32]protobuf.Direction{1: down},
+		bodies: map[int32]string{1: "1,2 1,1 2,1 2,2"},
+	},
+	{
+		name: "tail stays when eating, so its own tail kills", width: 5, height: 5, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "1,1 2,1 2,2 1,2", dir: left},
+			{id: 2, body: "4,4 3,4", dir: right},
+		},
+		steers: map[int32]protobuf.Direction{1: down},
+		foods:  "1,2",
+		bodies: map[int32]string{2: "0,4 4,4"},
+	},
+	{
+		name: "crash into own body kills without points", width: 6, height: 6, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "1,1 2,1 2,2 1,2 0,2", dir: left},
+			{id: 2, body: "4,4 3,4", dir: right},
+		},
+		steers: map[int32]protobuf.Direction{1: down},
+		bodies: map[int32]string{2: "5,4 4,4"},
+	},
+	{
+		name: "head into body kills and scores for the other snake", width: 6, height: 6, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "2,0 1,0", dir: down},
+			{id: 2, body: "3,1 2,1 1,1 0,1", dir: right},
+		},
+		bodies: map[int32]string{2: "4,1 3,1 2,1 1,1"},
+		scores: map[int32]int32{2: 1},
+	},
+	{
+		name: "two snakes into one body score two points", width: 7, height: 7, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "2,1 2,0", dir: down},
+			{id: 2, body: "3,3 3,4", dir: up},
+			{id: 3, body: "4,2 3,2 2,2 1,2 0,2", dir: right},
+		},
+		bodies: map[int32]string{3: "5,2 4,2 3,2 2,2 1,2"},
+		scores: map[int32]int32{3: 2},
+	},
+	{
+		name: "head to head kills both without points", width: 7, height: 5, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "2,2 1,2 0,2", dir: right},
+			{id: 2, body: "4,2 5,2 6,2", dir: left},
+		},
+		bodies:   map[int32]string{},
+		foodOnly: "1,2 2,2 3,2 4,2 5,2",
+	},
+	{
+		name: "head to head on food kills both", width: 7, height: 5, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "2,2 1,2", dir: right},
+			{id: 2, body: "4,2 5,2", dir: left},
+		},
+		foods:  "3,2",
+		bodies: map[int32]string{},
+	},
+	{
+		name: "moving into a tail that moves away is safe", width: 6, height: 6, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "1,1 0,1", dir: right},
+			{id: 2, body: "3,2 3,1 2,1", dir: down},
+		},
+		bodies: map[int32]string{1: "2,1 1,1", 2: "3,3 3,2 3,1"},
+	},
+	{
+		name: "moving into a tail of a snake that eats kills", width: 6, height: 6, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "1,1 0,1", dir: right},
+			{id: 2, body: "3,2 3,1 2,1", dir: down},
+		},
+		foods:  "3,3",
+		bodies: map[int32]string{2: "3,3 3,2 3,1 2,1"},
+		scores: map[int32]int32{2: 2},
+	},
+	{
+		name: "zombie keeps moving and gets no food of its own", width: 6, height: 6, food: 1, foodCount: 2,
+		snakes: []stepSnake{
+			{id: 1, body: "1,1 0,1", dir: right},
+			{id: 2, body: "1,4 1,5", dir: up, zombie: true},
+		},
+		bodies: map[int32]string{1: "2,1 1,1", 2: "1,3 1,4"},
+	},
+	{
+		name: "zombie dies like any snake", width: 6, height: 6, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "2,0 2,5", dir: down, zombie: true},
+			{id: 2, body: "3,1 2,1 1,1 0,1", dir: right},
+		},
+		bodies: map[int32]string{2: "4,1 3,1 2,1 1,1"},
+		scores: map[int32]int32{2: 1},
+	},
+	{
+		name: "food nobody ate stays in place", width: 7, height: 7, foodCount: -1,
+		snakes: []stepSnake{
+			{id: 1, body: "2,1 2,0", dir: down},
+			{id: 2, body: "3,2 2,2 1,2 0,2", dir: right},
+		},
+		foods:  "6,6",
+		foodAt: "6,6",
+		bodies: map[int32]string{2: "4,2 3,2 2,2 1,2"},
+		scores: map[int32]int32{2: 1},
+	},
+}
+
+func TestStep(t *testing.T) {
+	for _, test := range stepTests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &protobuf.GameConfig{
+				Width:        proto.Int32(int32(test.width)),
+				Height:       proto.Int32(int32(test.height)),
+				FoodStatic:   proto.Int32(int32(test.food)),
+				StateDelayMs: proto.Int32(100),
+			}
+
+			state := &protobuf.GameState{StateOrder: proto.Int32(1), Players: &protobuf.GamePlayers{}}
+			for _, setup := range test.snakes {
+				snake := NewSnake(parseCells(t, setup.body), int(setup.id))
+				snake.SetHeadDirection(setup.dir)
+				if setup.zombie {
+					snake.SetState(protobuf.GameState_Snake_ZOMBIE)
+				} else {
+					state.Players.Players = append(state.Players.Players, &protobuf.GamePlayer{
+						Name:  proto.String(fmt.Sprintf("player %d", setup.id)),
+						Id:    proto.Int32(setup.id),
+						Role:  protobuf.NodeRole_NORMAL.Enum(),
+						Score: proto.Int32(0),
+					})
+				}
+				state.Snakes = append(state.Snakes, GenerateSnakeProto(snake, test.width, test.height))
+			}
+			state.Foods = parseCells(t, test.foods)
+
+			next := Step(config, state, test.steers, 1)
+
+			if next.GetStateOrder() != 2 {
+				t.Errorf("state order %d after the tick, want 2", next.GetStateOrder())
+			}
+
+			alive := make(map[int32]*Snake)
+			for _, snakeProto := range next.GetSnakes() {
+				alive[snakeProto.GetPlayerId()] = ParseSnake(snakeProto, test.width, test.height)
+			}
+			for _, setup := range test.snakes {
+				snake := alive[setup.id]
+				want, ok := test.bodies[setup.id]
+				if !ok {
+					if snake != nil {
+						t.Errorf("snake %d should be dead, body %s", setup.id, cellNames(snake.Body()))
+					}
+					continue
+				}
+				if snake == nil {
+					t.Errorf("snake %d should be alive", setup.id)
+					continue
+				}
+				if got := cellNames(snake.Body()); got != want {
+					t.Errorf("snake %d body %s, want %s", setup.id, got, want)
+				}
+				if snake.IsZombie() != setup.zombie {
+					t.Errorf("snake %d is %s after the tick", setup.id, snake.State())
+				}
+			}
+
+			for _, player := range next.GetPlayers().GetPlayers() {
+				if want := test.scores[player.GetId()]; player.GetScore() != want {
+					t.Errorf("player %d score %d, want %d", player.GetId(), player.GetScore(), want)
+				}
+			}
+
+			allowed := make(map[string]bool)
+			for _, cell := range parseCells(t, test.foodOnly) {
+				allowed[cellName(cell)] = true
+			}
+			foods := make(map[string]bool)
+			for _, food := range next.GetFoods() {
+				name := cellName(food)
+				if foods[name] {
+					t.Errorf("food placed twice at %s", name)
+				}
+				foods[name] = true
+				for id, snake := range alive {
+					if snake.BodyContains(food) {
+						t.Errorf("food at %s lies under snake %d", name, id)
+					}
+				}
+				if test.foodOnly != "" && !allowed[name] {
+					t.Errorf("food at %s, want it only on %s", name, test.foodOnly)
+				}
+			}
+			for _, cell := range parseCells(t, test.foodAt) {
+				if !foods[cellName(cell)] {
+					t.Errorf("no food at %s", cellName(cell))
+				}
+			}
+			if test.foodCount >= 0 && len(foods) != test.foodCount {
+				t.Errorf("%d food on the field, want %d", len(foods), test.foodCount)
+			}
+		})
+	}
+}
+
+func TestStepKeepsState(t *testing.T) {
+	config := &protobuf.GameConfig{
+		Width:        proto.Int32(5),
+		Height:       proto.Int32(5),
+		FoodStatic:   proto.Int32(1),
+		StateDelayMs: proto.Int32(100),
+	}
+	snake := NewSnake(parseCells(t, "2,2 1,2"), 1)
+	snake.SetHeadDirection(right)
+	state := &protobuf.GameState{
+		StateOrder: proto.Int32(7),
+		Snakes:     []*protobuf.GameState_Snake{GenerateSnakeProto(snake, 5, 5)},
+		Foods:      parseCells(t, "3,2"),
+		Players: &protobuf.GamePlayers{Players: []*protobuf.GamePlayer{
+			{Name: proto.String("player"), Id: proto.Int32(1), Role: protobuf.NodeRole_MASTER.Enum(), Score: proto.Int32(3)},
+		}},
+	}
+	before := proto.Clone(state)
+
+	first := Step(config, state, map[int32]protobuf.Direction{1: down}, 42)
+	second := Step(config, state, map[int32]protobuf.Direction{1: down}, 42)
+
+	if !proto.Equal(state, before) {
+		t.Error("Step changed the state it was given")
+	}
+	if !proto.Equal(first, second) {
+		t.Error("Step with the same state, inputs and seed gave different states")
+	}
+}
+
+// TestStepMatchesUpdate chains Step from the state of a game with robots of
+// every difficulty and checks that it follows the game itself.
+func TestStepMatchesUpdate(t *testing.T) {
+	config := &protobuf.GameConfig{
+		Width:        proto.Int32(20),
+		Height:       proto.Int32(15),
+		FoodStatic:   proto.Int32(3),
+		StateDelayMs: proto.Int32(100),
+	}
+	const seed = 7
+	robots := map[int]Difficulty{1: RobotEasy, 2: RobotHard, 3: RobotEasy, 4: RobotNormal}
+
+	g := NewGameWithSeed(config, seed)
+	players := &protobuf.GamePlayers{}
+	for id := 1; id <= len(robots); id++ {
+		if err := g.AddRobot(id, robots[id]); err != nil {
+			t.Fatal(err)
+		}
+		players.Players = append(players.Players, &protobuf.GamePlayer{
+			Name: proto.String(fmt.Sprintf("robot %d", id)),
+			Id:   proto.Int32(int32(id)),
+			Role: protobuf.NodeRole_NORMAL.Enum(),
+			Type: protobuf.PlayerType_ROBOT.Enum(),
+		})
+	}
+	state := g.State(int32(g.Tick()), players)
+	SetRobotLevels(state, robots)
+
+	for tick := 1; tick <= 50; tick++ {
+		state = Step(config, state, nil, seed)
+		g.Update()
+		want := g.State(int32(g.Tick()), players)
+
+		if len(state.GetSnakes()) != len(want.GetSnakes()) {
+			t.Fatalf("tick %d: Step has %d snakes, Update %d", tick, len(state.GetSnakes()), len(want.GetSnakes()))
+		}
+		for i, snake := range want.GetSnakes() {
+			if !proto.Equal(state.GetSnakes()[i], snake) {
+				t.Fatalf("tick %d: snake %d is %v after Step, %v after Update", tick, snake.GetPlayerId(), state.GetSnakes()[i], snake)
+			}
+		}
+		if cellNames(state.GetFoods()) != cellNames(want.GetFoods()) {
+			t.Fatalf("tick %d: food %s after Step, %s after Update", tick, cellNames(state.GetFoods()), cellNames(want.GetFoods()))
+		}
+	}
+}
+
+func TestSteers(t *testing.T) {
+	tests := []struct {
+		name   string
+		steers []protobuf.Direction
+		head   string
+	}{
+		{"opposite direction is ignored", []protobuf.Direction{left}, "3,2"},
+		{"last of several steers wins", []protobuf.Direction{up, down}, "2,3"},
+		{"turn then reverse does not fold the snake", []protobuf.Direction{up, left}, "2,1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &protobuf.GameConfig{
+				Width:        proto.Int32(5),
+				Height:       proto.Int32(5),
+				FoodStatic:   proto.Int32(0),
+				StateDelayMs: proto.Int32(100),
+			}
+			g := NewGameWithSeed(config, 1)
+			snake := NewSnake(parseCells(t, "2,2 1,2"), 1)
+			snake.SetHeadDirection(right)
+			g.Field().AddSnake(snake)
+
+			for _, dir := range test.steers {
+				g.UpdateSnakeDirection(1, dir)
+			}
+			g.Update()
+
+			if got := cellName(g.Field().SnakeById(1).Head()); got != test.head {
+				t.Errorf("head at %s, want %s", got, test.head)
+			}
+		})
+	}
+}
+
+func parseCells(t *testing.T, text string) []*protobuf.GameState_Coord {
+	t.Helper()
+	var cells []*protobuf.GameState_Coord
+	for _, field := range strings.Fields(text) {
+		parts := strings.Split(field, ",")
+		if len(parts) != 2 {
+			t.Fatalf("bad cell %q", field)
+		}
+		x, err := strconv.Atoi(parts[0])
+		if err != nil {
+			t.Fatalf("bad cell %q: %v", field, err)
+		}
+		y, err := strconv.Atoi(parts[1])
+		if err != nil {
+			t.Fatalf("bad cell %q: %v", field, err)
+		}
+		cells = append(cells, &protobuf.GameState_Coord{X: proto.Int32(int32(x)), Y: proto.Int32(int32(y))})
+	}
+	return cells
+}
+
+func cellName(cell *protobuf.GameState_Coord) string {
+	return fmt.Sprintf("%d,%d", cell.GetX(), cell.GetY())
+}
+
+func cellNames(cells []*protobuf.GameState_Coord) string {
+	names := make([]string, len(cells))
+	for i, cell := range cells {
+		names[i] = cellName(cell)
+	}
+	return strings.Join(names, " ")
+}
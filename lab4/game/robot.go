@@ -0,0 +1,363 @@
+package game
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"snake_game/protobuf"
+	"sort"
+)
+
+type Difficulty int
+
+const (
+	RobotEasy Difficulty = iota
+	RobotNormal
+	RobotHard
+)
+
+const easyRandomMovePercent = 30
+
+var directions = []protobuf.Direction{
+	protobuf.Direction_UP,
+	protobuf.Direction_DOWN,
+	protobuf.Direction_LEFT,
+	protobuf.Direction_RIGHT,
+}
+
+func ParseDifficulty(name string) (Difficulty, error) {
+	switch name {
+	case "easy":
+		return RobotEasy, nil
+	case "normal", "":
+		return RobotNormal, nil
+	case "hard":
+		return RobotHard, nil
+	}
+	return RobotNormal, fmt.Errorf("unknown difficulty %q, want easy, normal or hard", name)
+}
+
+func (d Difficulty) String() string {
+	switch d {
+	case RobotEasy:
+		return "easy"
+	case RobotHard:
+		return "hard"
+	}
+	return "normal"
+}
+
+// RobotLevelField is the extra GameState field the master keeps the robot
+// difficulties in, it is not part of snakes.proto. Every entry holds the
+// player id and the difficulty as two varints.
+const RobotLevelField protowire.Number = 104
+
+// SetRobotLevels adds the difficulties to the unknown fields of the state.
+func SetRobotLevels(state *protobuf.GameState, levels map[int]Difficulty) {
+	state.ProtoReflect().SetUnknown(AppendRobotLevels(state.ProtoReflect().GetUnknown(), levels))
+}
+
+// AppendRobotLevels encodes the difficulties sorted by player id.
+func AppendRobotLevels(b []byte, levels map[int]Difficulty) []byte {
+	ids := make([]int, 0, len(levels))
+	for playerId := range levels {
+		ids = append(ids, playerId)
+	}
+	sort.Ints(ids)
+
+	for _, playerId := range ids {
+		var value []byte
+		value = protowire.AppendVarint(value, uint64(playerId))
+		value = protowire.AppendVarint(value, uint64(levels[playerId]))
+		b = protowire.AppendTag(b, RobotLevelField, protowire.BytesType)
+		b = protowire.AppendBytes(b, value)
+	}
+	return b
+}
+
+// RobotLevels returns the difficulty of every robot the state carries one
+// for.
+func RobotLevels(state *protobuf.GameState) map[int]Difficulty {
+	levels := make(map[int]Difficulty)
+	b := state.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			break
+		}
+		value := b[n : n+m]
+		b = b[n+m:]
+		if num != RobotLevelField || typ != protowire.BytesType {
+			continue
+		}
+		data, _ := protowire.ConsumeBytes(value)
+		playerId, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			continue
+		}
+		difficulty, m := protowire.ConsumeVarint(data[n:])
+		if m < 0 {
+			continue
+		}
+		levels[int(playerId)] = Difficulty(difficulty)
+	}
+	return levels
+}
+
+// occupancy is a snapshot of the field used by the robots, cells are
+// indexed as y*width+x.
+type occupancy struct {
+	width   int
+	height  int
+	blocked []bool
+	danger  []bool
+	food    []bool
+}
+
+func (f *Field) occupancy(self *Snake) *occupancy {
+	width, height := f.Width(), f.Height()
+	o := &occupancy{
+		width:   width,
+		height:  height,
+		blocked: make([]bool, width*height),
+		danger:  make([]bool, width*height),
+		food:    make([]bool, width*height),
+	}
+
+	for _, snake := range f.Snakes() {
+		body := snake.Body()
+		for _, part := range body {
+			o.blocked[o.index(int(part.GetX()), int(part.GetY()))] = true
+		}
+		if snake == self || len(body) == 0 {
+			continue
+		}
+		// another head can step into any of its neighbours this tick
+		head := body[0]
+		for _, dir := range directions {
+			x, y := o.step(int(head.GetX()), int(head.GetY()), dir)
+			o.danger[o.index(x, y)] = true
+		}
+	}
+
+	for _, food := range f.Foods() {
+		o.food[o.index(int(food.GetX()), int(food.GetY()))] = true
+	}
+
+	return o
+}
+
+func (o *occupancy) index(x, y int) int {
+	return y*o.width + x
+}
+
+func (o *occupancy) step(x, y int, dir protobuf.Direction) (int, int) {
+	switch dir {
+	case protobuf.Direction_UP:
+		y--
+	case protobuf.Direction_DOWN:
+		y++
+	case protobuf.Direction_LEFT:
+		x--
+	case protobuf.Direction_RIGHT:
+		x++
+	}
+	return (x + o.width) % o.width, (y + o.height) % o.height
+}
+
+// reachable counts free cells reachable from start, stopping at limit.
+func (o *occupancy) reachable(start int, limit int) int {
+	visited := make([]bool, len(o.blocked))
+	visited[start] = true
+	queue := []int{start}
+	count := 0
+
+	for len(queue) > 0 && count < limit {
+		cell := queue[0]
+		queue = queue[1:]
+		count++
+
+		for _, dir := range directions {
+			x, y := o.step(cell%o.width, cell/o.width, dir)
+			next := o.index(x, y)
+			if visited[next] || o.blocked[next] {
+				continue
+			}
+			visited[next] = true
+			queue = append(queue, next)
+		}
+	}
+
+	return count
+}
+
+// towardsFood runs a BFS from the candidate first moves and returns the move
+// that starts a shortest path to any food.
+func (o *occupancy) towardsFood(x, y int, moves []protobuf.Direction) (protobuf.Direction, bool) {
+	visited := make([]bool, len(o.blocked))
+	first := make([]protobuf.Direction, len(o.blocked))
+	var queue []int
+
+	for _, dir := range moves {
+		nx, ny := o.step(x, y, dir)
+		cell := o.index(nx, ny)
+		if visited[cell] {
+			continue
+		}
+		visited[cell] = true
+		first[cell] = dir
+		queue = append(queue, cell)
+	}
+
+	for len(queue) > 0 {
+		cell := queue[0]
+		queue = queue[1:]
+		if o.food[cell] {
+			return first[cell], true
+		}
+
+		for _, dir := range directions {
+			nx, ny := o.step(cell%o.width, cell/o.width, dir)
+			next := o.index(nx, ny)
+			if visited[next] || o.blocked[next] {
+				continue
+			}
+			visited[next] = true
+			first[next] = first[cell]
+			queue = append(queue, next)
+		}
+	}
+
+	return 0, false
+}
+
+func (o *occupancy) nearestFoodDistance(x, y int) int {
+	best := -1
+	for cell, isFood := range o.food {
+		if !isFood {
+			continue
+		}
+		dx := abs(cell%o.width - x)
+		if o.width-dx < dx {
+			dx = o.width - dx
+		}
+		dy := abs(cell/o.width - y)
+		if o.height-dy < dy {
+			dy = o.height - dy
+		}
+		if best == -1 || dx+dy < best {
+			best = dx + dy
+		}
+	}
+	return best
+}
+
+func opposite(dir protobuf.Direction) protobuf.Direction {
+	switch dir {
+	case protobuf.Direction_UP:
+		return protobuf.Direction_DOWN
+	case protobuf.Direction_DOWN:
+		return protobuf.Direction_UP
+	case protobuf.Direction_LEFT:
+		return protobuf.Direction_RIGHT
+	}
+	return protobuf.Direction_LEFT
+}
+
+// RobotDirection picks the next direction of a server side robot snake.
+// Easy robots walk greedily to the closest food and sometimes wander, normal
+// ones follow a BFS path to the food unless the move leads into an area too
+// small for their body, hard ones also keep away from cells other heads can
+// reach this tick.
+func (f *Field) RobotDirection(snake *Snake, difficulty Difficulty) protobuf.Direction {
+	body := snake.Body()
+	current := snake.HeadDirection()
+	if len(body) == 0 {
+		return current
+	}
+
+	o := f.occupancy(snake)
+	x, y := int(body[0].GetX()), int(body[0].GetY())
+
+	var moves []protobuf.Direction
+	for _, dir := range directions {
+		if dir == opposite(current) {
+			continue
+		}
+		nx, ny := o.step(x, y, dir)
+		if !o.blocked[o.index(nx, ny)] {
+			moves = append(moves, dir)
+		}
+	}
+	if len(moves) == 0 {
+		return current
+	}
+
+	if difficulty == RobotHard {
+		var calm []protobuf.Direction
+		for _, dir := range moves {
+			nx, ny := o.step(x, y, dir)
+			if !o.danger[o.index(nx, ny)] {
+				calm = append(calm, dir)
+			}
+		}
+		if len(calm) > 0 {
+			moves = calm
+		}
+	}
+
+	if difficulty == RobotEasy {
+		if f.rng.Intn(100) < easyRandomMovePercent {
+			return moves[f.rng.Intn(len(moves))]
+		}
+		best, bestDistance := moves[0], -1
+		for _, dir := range moves {
+			nx, ny := o.step(x, y, dir)
+			distance := o.nearestFoodDistance(nx, ny)
+			if bestDistance == -1 || (distance != -1 && distance < bestDistance) {
+				best, bestDistance = dir, distance
+			}
+		}
+		return best
+	}
+
+	need := len(body) + 1
+	if difficulty == RobotHard {
+		need = 2 * len(body)
+	}
+
+	space := func(dir protobuf.Direction) int {
+		nx, ny := o.step(x, y, dir)
+		cell := o.index(nx, ny)
+		o.blocked[cell] = true
+		defer func() { o.blocked[cell] = false }()
+
+		area := 0
+		for _, next := range directions {
+			fx, fy := o.step(nx, ny, next)
+			start := o.index(fx, fy)
+			if o.blocked[start] {
+				continue
+			}
+			if reached := o.reachable(start, need); reached > area {
+				area = reached
+			}
+		}
+		return area
+	}
+
+	if dir, ok := o.towardsFood(x, y, moves); ok && space(dir) >= need {
+		return dir
+	}
+
+	best, bestSpace := moves[0], -1
+	for _, dir := range moves {
+		if area := space(dir); area > bestSpace {
+			best, bestSpace = dir, area
+		}
+	}
+	return best
+}
@@ -0,0 +1,175 @@
+package game
+
+import (
+	"google.golang.org/protobuf/proto"
+	"snake_game/protobuf"
+	"testing"
+)
+
+// robotTest is one decision of the robot snake with id 1 on a small field.
+// Cells are written like in stepTest, the other snakes are only obstacles.
+type robotTest struct {
+	name   string
+	width  int
+	height int
+	robot  string
+	dir    protobuf.Direction
+	others []string
+	foods  string
+
+	// moves the robot may pick, by difficulty, difficulties not listed are
+	// not checked
+	want map[Difficulty][]protobuf.Direction
+}
+
+var robotTests = []robotTest{
+	{
+		name: "normal and hard follow the path around a wall", width: 13, height: 5,
+		robot: "1,2 0,2", dir: right, foods: "5,2",
+		others: []string{"3,0 3,1 3,2 3,3"},
+		want: map[Difficulty][]protobuf.Direction{
+			RobotNormal: {down},
+			RobotHard:   {down},
+		},
+	},
+	{
+		name: "food straight ahead", width: 7, height: 7,
+		robot: "1,3 0,3", dir: right, foods: "4,3",
+		want: map[Difficulty][]protobuf.Direction{
+			RobotNormal: {right},
+			RobotHard:   {right},
+		},
+	},
+	{
+		name: "food in a pocket shorter than the body is refused", width: 7, height: 7,
+		robot: "3,3 2,3 1,3 0,3", dir: right, foods: "5,3",
+		others: []string{"4,4 5,4 6,4 6,3 6,2 5,2 4,2"},
+		want: map[Difficulty][]protobuf.Direction{
+			RobotNormal: {up, down},
+			RobotHard:   {up},
+		},
+	},
+	{
+		name: "hard keeps away from the cells another head can reach", width: 7, height: 7,
+		robot: "1,3 0,3", dir: right, foods: "3,3",
+		others: []string{"2,4 2,5"},
+		want: map[Difficulty][]protobuf.Direction{
+			RobotNormal: {right},
+			RobotHard:   {up},
+		},
+	},
+	{
+		name: "food behind does not turn the robot into its neck", width: 7, height: 7,
+		robot: "3,3 2,3", dir: right, foods: "1,3",
+		want: map[Difficulty][]protobuf.Direction{
+			RobotEasy:   {up, down, right},
+			RobotNormal: {up, down},
+			RobotHard:   {up, down},
+		},
+	},
+	{
+		name: "robot without a neck does not reverse either", width: 7, height: 7,
+		robot: "3,3", dir: right, foods: "2,3",
+		want: map[Difficulty][]protobuf.Direction{
+			RobotEasy:   {up, down, right},
+			RobotNormal: {up, down},
+			RobotHard:   {up, down},
+		},
+	},
+	{
+		name: "trapped robot keeps its direction instead of reversing", width: 7, height: 7,
+		robot: "2,2 1,2", dir: right,
+		others: []string{"2,1 3,1 3,2 3,3 2,3"},
+		want: map[Difficulty][]protobuf.Direction{
+			RobotEasy:   {right},
+			RobotNormal: {right},
+			RobotHard:   {right},
+		},
+	},
+	{
+		name: "only free cell is taken", width: 7, height: 7,
+		robot: "2,2 1,2", dir: right, foods: "5,5",
+		others: []string{"2,1 3,1 3,2"},
+		want: map[Difficulty][]protobuf.Direction{
+			RobotEasy:   {down},
+			RobotNormal: {down},
+			RobotHard:   {down},
+		},
+	},
+	{
+		name: "moves wrap around the field edge", width: 5, height: 5,
+		robot: "4,2 3,2", dir: right, foods: "1,2",
+		want: map[Difficulty][]protobuf.Direction{
+			RobotNormal: {right},
+			RobotHard:   {right},
+		},
+	},
+}
+
+// robotField builds the field of the test and returns the robot snake.
+func robotField(t *testing.T, test robotTest, seed int64) (*Field, *Snake) {
+	t.Helper()
+	config := &protobuf.GameConfig{
+		Width:        proto.Int32(int32(test.width)),
+		Height:       proto.Int32(int32(test.height)),
+		FoodStatic:   proto.Int32(0),
+		StateDelayMs: proto.Int32(100),
+	}
+	g := NewGameWithSeed(config, seed)
+
+	robot := NewSnake(parseCells(t, test.robot), 1)
+	robot.SetHeadDirection(test.dir)
+	g.Field().AddSnake(robot)
+	for i, body := range test.others {
+		g.Field().AddSnake(NewSnake(parseCells(t, body), i+2))
+	}
+	g.Field().SetFoods(parseCells(t, test.foods))
+	return g.Field(), robot
+}
+
+func TestRobotDirection(t *testing.T) {
+	for _, test := range robotTests {
+		t.Run(test.name, func(t *testing.T) {
+			for difficulty, allowed := range test.want {
+				// easy robots wander at random, try them with many seeds
+				for seed := int64(1); seed <= 50; seed++ {
+					field, robot := robotField(t, test, seed)
+					got := field.RobotDirection(robot, difficulty)
+					if !containsDirection(allowed, got) {
+						t.Fatalf("%s robot with seed %d goes %s, want one of %v", difficulty, seed, got, allowed)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestEasyRobotWanders checks that an easy robot mostly walks greedily to
+// the nearest food, even into a dead end, and sometimes picks another move.
+func TestEasyRobotWanders(t *testing.T) {
+	test := robotTests[0] // the wall, greedy moves right into it
+	greedy, other := 0, 0
+	for seed := int64(1); seed <= 200; seed++ {
+		field, robot := robotField(t, test, seed)
+		switch dir := field.RobotDirection(robot, RobotEasy); dir {
+		case right:
+			greedy++
+		case up, down:
+			other++
+		default:
+			t.Fatalf("easy robot with seed %d goes %s", seed, dir)
+		}
+	}
+	if greedy < 120 || other == 0 {
+		t.Errorf("easy robot went to the food %d times and elsewhere %d times out of 200", greedy, other)
+	}
+}
+
+func containsDirection(dirs []protobuf.Direction, dir protobuf.Direction) bool {
+	for _, d := range dirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
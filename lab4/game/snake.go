@@ -3,7 +3,6 @@ package game
 import (
 	"fmt"
 	"google.golang.org/protobuf/proto"
-	"math/rand"
 	"snake_game/protobuf"
 	"sync"
 )
@@ -21,13 +20,12 @@ type Snake struct {
 }
 
 func NewSnake(initialPosition []*protobuf.GameState_Coord, playerID int) *Snake {
-	randomColor := fmt.Sprintf("#%02x%02x%02x", rand.Intn(256), rand.Intn(256), rand.Intn(256))
 	return &Snake{
 		body:          initialPosition,
 		headDirection: protobuf.Direction_RIGHT,
 		nextDirection: []protobuf.Direction{},
 		state:         protobuf.GameState_Snake_ALIVE,
-		color:         randomColor,
+		color:         colorById(playerID),
 		playerID:      playerID,
 		score:         0,
 		lock:          new(sync.Mutex),
@@ -61,6 +59,7 @@ func ParseSnake(snake *protobuf.GameState_Snake, width, height int) *Snake {
 	newSnake := NewSnake(bodySnake, int(*snake.PlayerId))
 	newSnake.SetHeadDirection(snake.GetHeadDirection())
 	newSnake.SetNextDirection(snake.GetHeadDirection())
+	newSnake.SetState(snake.GetState())
 	return newSnake
 }
 
@@ -73,7 +72,7 @@ func GenerateSnakeProto(snake *Snake, width, height int) *protobuf.GameState_Sna
 	protoSnake := &protobuf.GameState_Snake{
 		PlayerId:      proto.Int32(int32(snake.PlayerID())),
 		Points:        []*protobuf.GameState_Coord{{X: proto.Int32(head.GetX()), Y: proto.Int32(head.GetY())}},
-		State:         protobuf.GameState_Snake_ALIVE.Enum(),
+		State:         snake.State().Enum(),
 		HeadDirection: snake.HeadDirection().Enum(),
 	}
 
@@ -96,53 +95,42 @@ func GenerateSnakeProto(snake *Snake, width, height int) *protobuf.GameState_Sna
 			dy = -1
 		}
 
+		// key points only: a straight run of cells is a single offset
+		last := protoSnake.Points[len(protoSnake.Points)-1]
+		if len(protoSnake.Points) > 1 && sameRun(last, dx, dy) {
+			last.X = proto.Int32(last.GetX() + dx)
+			last.Y = proto.Int32(last.GetY() + dy)
+			continue
+		}
+
 		protoSnake.Points = append(protoSnake.Points, &protobuf.GameState_Coord{X: proto.Int32(dx), Y: proto.Int32(dy)})
 	}
 
 	return protoSnake
 }
 
-func (s *Snake) Move(gameField *Field) bool {
+// Move advances the head one cell, the caller decides whether the tail
+// follows. Of the directions received since the last tick the last one
+// that does not turn the snake back onto itself wins.
+func (s *Snake) Move(gameField *Field) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	if len(s.body) == 0 {
-		return false
+		return
 	}
 
 	head := s.body[0]
 	var dx, dy int
 
-	lastDirection := s.headDirection
-	for len(s.nextDirection) > 0 {
-		dir := s.nextDirection[0]
-		s.nextDirection = s.nextDirection[1:]
-
-		if dir == lastDirection {
-			continue
-		}
-
-		switch dir {
-		case protobuf.Direction_LEFT:
-			if lastDirection != protobuf.Direction_RIGHT {
-				lastDirection = protobuf.Direction_LEFT
-			}
-		case protobuf.Direction_RIGHT:
-			if lastDirection != protobuf.Direction_LEFT {
-				lastDirection = protobuf.Direction_RIGHT
-			}
-		case protobuf.Direction_UP:
-			if lastDirection != protobuf.Direction_DOWN {
-				lastDirection = protobuf.Direction_UP
-			}
-		case protobuf.Direction_DOWN:
-			if lastDirection != protobuf.Direction_UP {
-				lastDirection = protobuf.Direction_DOWN
-			}
+	current := s.headDirection
+	for i := len(s.nextDirection) - 1; i >= 0; i-- {
+		if s.nextDirection[i] != opposite(current) {
+			s.headDirection = s.nextDirection[i]
+			break
 		}
 	}
-
-	s.headDirection = lastDirection
+	s.nextDirection = s.nextDirection[:0]
 
 	switch s.headDirection {
 	case protobuf.Direction_UP:
@@ -160,15 +148,7 @@ func (s *Snake) Move(gameField *Field) bool {
 		Y: proto.Int32((int32(gameField.Height()) + head.GetY() + int32(dy)) % int32(gameField.Height())),
 	}
 
-	for _, segment := range s.body {
-		if segment.GetX() == newHead.GetX() && segment.GetY() == newHead.GetY() {
-			return false
-		}
-	}
-
 	s.body = append([]*protobuf.GameState_Coord{newHead}, s.body...)
-
-	return true
 }
 
 func (s *Snake) AddScore(val int) {
@@ -177,6 +157,20 @@ func (s *Snake) AddScore(val int) {
 	s.score += val
 }
 
+// colorById gives every player the same color on every node, without
+// spending random numbers the game needs to stay reproducible.
+func colorById(playerID int) string {
+	hash := uint32(playerID)*2654435761 + 0x9e3779b9
+	return fmt.Sprintf("#%02x%02x%02x", uint8(hash>>24), uint8(hash>>16), uint8(hash>>8))
+}
+
+// sameRun reports whether the step dx, dy continues the offset in the same
+// direction.
+func sameRun(offset *protobuf.GameState_Coord, dx, dy int32) bool {
+	return (dx != 0 && offset.GetY() == 0 && dy == 0 && sign(int(offset.GetX())) == sign(int(dx))) ||
+		(dy != 0 && offset.GetX() == 0 && dx == 0 && sign(int(offset.GetY())) == sign(int(dy)))
+}
+
 func sign(value int) int {
 	if value < 0 {
 		return -1
@@ -220,6 +214,12 @@ func (s *Snake) SetNextDirection(newDirection protobuf.Direction) {
 	s.nextDirection = append(s.nextDirection, newDirection)
 }
 
+func (s *Snake) SetState(state protobuf.GameState_Snake_SnakeState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+}
+
 func (s *Snake) SetUpdated() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -293,6 +293,12 @@ func (s *Snake) State() protobuf.GameState_Snake_SnakeState {
 	return s.state
 }
 
+// IsZombie reports whether the player of the snake left the game, such a
+// snake keeps its last direction until it dies.
+func (s *Snake) IsZombie() bool {
+	return s.State() == protobuf.GameState_Snake_ZOMBIE
+}
+
 func (s *Snake) Lock() *sync.Mutex {
 	return s.lock
 }
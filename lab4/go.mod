@@ -4,6 +4,7 @@ go 1.23.3
 
 require (
 	fyne.io/fyne/v2 v2.5.3
+	golang.org/x/net v0.25.0
 	google.golang.org/protobuf v1.36.2
 )
 
@@ -33,7 +34,6 @@ require (
 	github.com/yuin/goldmark v1.7.1 // indirect
 	golang.org/x/image v0.18.0 // indirect
 	golang.org/x/mobile v0.0.0-20231127183840-76ac6878050a // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.16.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/ipv4"
+)
+
+// ParseBindAddress turns the user supplied bind setting into an address:
+// an empty string means all IPv4 interfaces, an IP literal (v4 or v6) binds
+// to that address and anything else is treated as an interface name.
+func ParseBindAddress(bind string, port int) (*net.UDPAddr, error) {
+	if bind == "" {
+		return &net.UDPAddr{IP: net.IPv4zero, Port: port}, nil
+	}
+
+	if host, portStr, err := net.SplitHostPort(bind); err == nil {
+		p, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("bad port in %s", bind)
+		}
+		return ParseBindAddress(host, p)
+	}
+
+	if ip := net.ParseIP(bind); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+
+	addr, err := interfaceAddress(bind)
+	if err != nil {
+		return nil, err
+	}
+	addr.Port = port
+	return addr, nil
+}
+
+func interfaceAddress(interfaceName string) (*net.UDPAddr, error) {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("interface not found: %s", interfaceName)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("error getting addresses for interface %s: %v", interfaceName, err)
+	}
+
+	var v6 *net.UDPAddr
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipNet.IP}, nil
+		}
+		if v6 == nil {
+			v6 = &net.UDPAddr{IP: ipNet.IP}
+			if ipNet.IP.IsLinkLocalUnicast() {
+				v6.Zone = iface.Name
+			}
+		}
+	}
+
+	if v6 != nil {
+		return v6, nil
+	}
+	return nil, fmt.Errorf("interface %s has no addresses", interfaceName)
+}
+
+func udpNetwork(addr *net.UDPAddr) string {
+	if addr.IP == nil || addr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// reachableAddr returns an address a client on this host can send to, so a
+// server bound to 0.0.0.0 or :: is reached over loopback.
+func reachableAddr(addr *net.UDPAddr) *net.UDPAddr {
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		return addr
+	}
+	if addr.IP != nil && addr.IP.To4() == nil {
+		return &net.UDPAddr{IP: net.IPv6loopback, Port: addr.Port}
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.Port}
+}
+
+// anyAddrFor returns the address to bind a socket that talks to remote,
+// nil lets the transport pick its default.
+func anyAddrFor(remote *net.UDPAddr) *net.UDPAddr {
+	if udpNetwork(remote) == "udp6" {
+		return &net.UDPAddr{IP: net.IPv6unspecified}
+	}
+	return nil
+}
+
+// multicastInterfaces lists the interfaces an unbound server announces on.
+func multicastInterfaces() []net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("[server] error getting interfaces: %v", err)
+		return nil
+	}
+
+	var result []net.Interface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				result = append(result, iface)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// sendAnnouncement multicasts data from the game socket. A server bound to
+// every interface sends one copy per multicast capable interface, so the
+// source address each listener sees, and joins, is the one of the interface
+// it shares with the server.
+func (s *Server) sendAnnouncement(data []byte) error {
+	group := &net.UDPAddr{IP: net.ParseIP(MulticastAddress), Port: MulticastPort}
+
+	if !s.serverAddr.IP.IsUnspecified() {
+		_, err := s.announceConn.WriteTo(data, nil, group)
+		return err
+	}
+
+	interfaces := multicastInterfaces()
+	if len(interfaces) == 0 {
+		_, err := s.announceConn.WriteTo(data, nil, group)
+		return err
+	}
+
+	var lastErr error
+	sent := 0
+	for _, iface := range interfaces {
+		_, err := s.announceConn.WriteTo(data, &ipv4.ControlMessage{IfIndex: iface.Index}, group)
+		if err != nil {
+			lastErr = fmt.Errorf("interface %s: %v", iface.Name, err)
+			continue
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return lastErr
+	}
+	return nil
+}
@@ -9,7 +9,9 @@ import (
 	"net"
 	"snake_game/game"
 	"snake_game/protobuf"
+	"snake_game/replay"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,45 +26,71 @@ type Client struct {
 	gameLock           *sync.Mutex
 	game               *game.Game
 	addr               *net.UDPAddr
-	conn               *net.UDPConn
+	masterAddr         *net.UDPAddr
+	conn               Conn
+	transport          Transport
 	msgSeq             int64
 	lock               *sync.Mutex
 	cancel             context.CancelFunc
 	stateId            int
 	lastState          *protobuf.GameState
+	lastStateTime      time.Time
+	recentStates       map[int32]*protobuf.GameState
 	lastMasterActivity time.Time
+	lastError          string
+	gameOver           bool
 	server             *Server
+	reliable           *reliable
+	recorder           *replay.Recorder
 	pingDelay          time.Duration
 	waitDelay          time.Duration
 }
 
 func NewClient(serverAddr *net.UDPAddr, playerName string, requestedRole protobuf.NodeRole) (*Client, error) {
-	conn, err := net.DialUDP("udp", nil, serverAddr)
+	return NewClientWithTransport(UDP, serverAddr, playerName, requestedRole)
+}
+
+// NewClientWithTransport is NewClient over another transport, a server the
+// client may take over from the master gets the same transport.
+//
+// The socket is not connected to the master: a new master announces itself
+// from its own address.
+func NewClientWithTransport(transport Transport, serverAddr *net.UDPAddr, playerName string, requestedRole protobuf.NodeRole) (*Client, error) {
+	conn, err := transport.Listen(anyAddrFor(serverAddr))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to server: %w", err)
 	}
+	conn.SetReadBuffer(socketBufferSize)
 
 	return &Client{
-		playerName: playerName,
-		playerType: protobuf.PlayerType_HUMAN,
-		role:       requestedRole,
-		addr:       conn.LocalAddr().(*net.UDPAddr),
-		conn:       conn,
-		msgSeq:     0,
-		lock:       new(sync.Mutex),
-		stateId:    0,
-		server:     nil,
+		playerName:   playerName,
+		playerType:   protobuf.PlayerType_HUMAN,
+		role:         requestedRole,
+		addr:         conn.LocalAddr(),
+		masterAddr:   serverAddr,
+		conn:         conn,
+		transport:    transport,
+		msgSeq:       0,
+		lock:         new(sync.Mutex),
+		stateId:      0,
+		recentStates: make(map[int32]*protobuf.GameState),
+		server:       nil,
 	}, nil
 }
 
 func (c *Client) Start(gameName string, g *game.Game) error {
-	err := c.sendJoinRequest(gameName)
+	c.pingDelay = time.Duration(float64(g.Field().DelayMS()) * 0.1)
+	c.waitDelay = time.Duration(float64(g.Field().DelayMS()) * 0.8)
+	c.reliable = newReliable("client", c.pingDelay*time.Millisecond, c.waitDelay*time.Millisecond, c.sendData)
+	c.gameName = gameName
+
+	seq, err := c.sendJoinRequest(gameName)
 	if err != nil {
 		log.Printf("failed to send join request: %s", err.Error())
 		return fmt.Errorf("failed to send join request: %w", err)
 	}
 
-	err = c.handleAcknowledge()
+	err = c.handleAcknowledge(seq)
 	if err != nil {
 		log.Printf("[client] failed to handle acknowledge: %s", err.Error())
 		return fmt.Errorf("failed to handle acknowledge: %w", err)
@@ -72,95 +100,82 @@ func (c *Client) Start(gameName string, g *game.Game) error {
 
 	c.gameLock = g.Lock()
 	c.game = g
-
-	c.pingDelay = time.Duration(float64(g.Field().DelayMS()) * 0.1)
-	c.waitDelay = time.Duration(float64(g.Field().DelayMS()) * 0.8)
+	c.lastMasterActivity = time.Now()
 
 	ctx, canc := context.WithCancel(context.Background())
 	c.cancel = canc
 
+	c.reliable.startResendThread(ctx)
 	c.startPingThread(ctx)
 	c.startListenThread(ctx)
 	c.startMasterActivityCheckerThread(ctx)
 	return nil
 }
 
-func (c *Client) StartServerFromState() {
+// becomeMaster makes the deputy the master, see failover.go. The server
+// takes the address of the client socket, the one the other players know
+// this node by, and the client talks to it from a new socket.
+func (c *Client) becomeMaster() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	state := c.lastState
 
-	g := game.NewGame(c.game.Field().GameConfig())
-	g.Field().EditFieldFromState(c.lastState)
-
-	delay := time.Duration(g.Field().DelayMS())
-
-	server := &Server{
-		gameName:   c.gameName,
-		masterId:   c.playerId,
-		deputyId:   -1,
-		serverAddr: c.addr,
-		lockServer: new(sync.Mutex),
-		players:    state.Players.Players,
-		lockGame:   new(sync.Mutex),
-		game:       g,
-		msgSeq:     0,
-		uniqueId:   -1,
-		stateId:    int(*state.StateOrder),
-		gameDelay:  delay,
-		pingDelay:  time.Duration(float64(delay) * 0.1),
-		waitDelay:  time.Duration(float64(delay) * 0.8),
+	state := c.lastState
+	if state == nil {
+		log.Printf("[client] no state to take over the game from")
+		return
 	}
+	oldMasterId := c.masterId
 
 	c.conn.Close()
-
-	serverConn, err := net.ListenUDP("udp", server.serverAddr)
+	server, err := newServerFromState(c.gameName, c.transport, c.addr, c.game.Field().GameConfig(), state, c.playerId, atomic.LoadInt64(&c.msgSeq))
 	if err != nil {
-		log.Printf("[server] failed to start server: %s", err.Error())
+		log.Printf("[client] failed to take over the game: %v", err)
+		return
 	}
 
-	log.Printf("[server] new server addr: %s:%d", server.serverAddr.IP.String(), server.serverAddr.Port)
-
-	server.serverConn = serverConn
-
-	conn, err := net.DialUDP("udp", nil, server.serverAddr)
+	conn, err := c.transport.Listen(anyAddrFor(server.ServerAddr()))
 	if err != nil {
-		log.Printf("failed to connect to server: %s", err.Error())
+		log.Printf("[client] failed to connect to the new server: %v", err)
 		return
 	}
+	conn.SetReadBuffer(socketBufferSize)
+
 	c.conn = conn
-	c.addr = conn.LocalAddr().(*net.UDPAddr)
+	c.addr = conn.LocalAddr()
+	c.masterAddr = server.ServerAddr()
+	c.masterId = c.playerId
+	c.deputyId = -1
+	c.role = protobuf.NodeRole_MASTER
+	c.lastMasterActivity = time.Now()
+	c.server = server
 
-	for _, player := range server.players {
-		if c.playerId == int(player.GetId()) {
-			player.IpAddress = proto.String(c.addr.IP.String())
-			player.Port = proto.Int32(int32(c.addr.Port))
-			player.Role = protobuf.NodeRole_MASTER.Enum()
-		}
-		if player.GetRole() == protobuf.NodeRole_NORMAL {
-			server.deputyId = int(player.GetId())
-		}
-		if server.uniqueId < int(player.GetId()) {
-			server.uniqueId = int(player.GetId() + 1)
-		}
+	server.takeOver(reachableAddr(c.addr), oldMasterId)
+}
 
-	}
+// followMaster switches to a new master, messages still waiting for an ack
+// go to it from now on.
+func (c *Client) followMaster(masterId int, masterAddr *net.UDPAddr) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	server.lastPing = make(map[int]time.Time, len(server.players))
-	for _, player := range server.players {
-		now := time.Now()
-		server.lastPing[int(player.GetId())] = now.Add(server.waitDelay * time.Millisecond)
+	log.Printf("[client] following new master %d at %s", masterId, masterAddr.String())
+	c.masterId = masterId
+	c.masterAddr = masterAddr
+	if c.deputyId == masterId {
+		c.deputyId = -1
 	}
-
-	c.server = server
-	server.startThreads()
+	c.lastMasterActivity = time.Now()
 }
 
-func (c *Client) sendJoinRequest(gameName string) error {
+// fromMaster reports whether a datagram came from the current master.
+func (c *Client) fromMaster(src *net.UDPAddr) bool {
 	c.lock.Lock()
-	c.msgSeq++
-	seq := c.msgSeq
-	c.lock.Unlock()
+	defer c.lock.Unlock()
+	return src.IP.Equal(c.masterAddr.IP) && src.Port == c.masterAddr.Port
+}
+
+func (c *Client) sendJoinRequest(gameName string) (int64, error) {
+	seq := c.incrementMsgSeq()
 
 	joinMsg := &protobuf.GameMessage_JoinMsg{
 		PlayerType:    &c.playerType,
@@ -168,6 +183,7 @@ func (c *Client) sendJoinRequest(gameName string) error {
 		GameName:      &gameName,
 		RequestedRole: &c.role,
 	}
+	markDeltaSupport(joinMsg)
 
 	gameMessage := &protobuf.GameMessage{
 		MsgSeq: &seq,
@@ -176,68 +192,99 @@ func (c *Client) sendJoinRequest(gameName string) error {
 
 	data, err := proto.Marshal(gameMessage)
 	if err != nil {
-		return fmt.Errorf("failed to marshal join message: %w", err)
+		return 0, fmt.Errorf("failed to marshal join message: %w", err)
 	}
 
-	n, err := c.conn.Write(data)
+	n, err := c.conn.WriteTo(data, c.masterAddr)
 	if err != nil {
-		return fmt.Errorf("failed to send join message: %w", err)
+		return 0, fmt.Errorf("failed to send join message: %w", err)
 	}
 
 	if n != len(data) {
-		return errors.New("incomplete message sent")
+		return 0, errors.New("incomplete message sent")
 	}
 
+	c.reliable.track(nil, seq, data)
+
 	log.Println("[client] join request sent.")
-	return nil
+	return seq, nil
 }
 
-func (c *Client) handleAcknowledge() error {
-	buffer := make([]byte, 1024)
-	n, _, err := c.conn.ReadFromUDP(buffer)
-	if err != nil {
-		log.Printf("[cleint] error receiving ack message: %v\n", err)
-		return err
-	}
+// handleAcknowledge waits for the ack of the join request, the reliable
+// layer resends the request meanwhile. States and pings that overtake a
+// lost ack are skipped: the server acks the retransmitted join again.
+func (c *Client) handleAcknowledge(joinSeq int64) error {
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, MaxDatagramSize)
+	deadline := time.Now().Add(JoinTimeout * time.Millisecond)
+	for {
+		if time.Now().After(deadline) {
+			c.reliable.ack(nil, joinSeq)
+			return errors.New("join request was not acknowledged")
+		}
 
-	var msg protobuf.GameMessage
-	if err := proto.Unmarshal(buffer[:n], &msg); err != nil {
-		log.Printf("Failed to unmarshal message: %v\n", err)
-		return err
-	}
+		c.conn.SetReadDeadline(time.Now().Add(c.reliable.resendDelay))
+		n, src, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.reliable.resend()
+				continue
+			}
+			log.Printf("[cleint] error receiving ack message: %v\n", err)
+			return err
+		}
+		if !c.fromMaster(src) {
+			continue
+		}
+
+		var msg protobuf.GameMessage
+		if err := proto.Unmarshal(buffer[:n], &msg); err != nil {
+			log.Printf("Failed to unmarshal message: %v\n", err)
+			continue
+		}
 
-	switch msg.Type.(type) {
-	case *protobuf.GameMessage_Ack:
-		break
-	case *protobuf.GameMessage_Error:
-		{
+		switch msg.Type.(type) {
+		case *protobuf.GameMessage_Ack:
+			if msg.GetMsgSeq() != joinSeq {
+				continue
+			}
+		case *protobuf.GameMessage_Error:
+			c.reliable.ack(nil, joinSeq)
 			log.Printf("[client] got error message: %s\n", *msg.GetError().ErrorMessage)
 			return fmt.Errorf("got error message: %s", *msg.GetError().ErrorMessage)
+		default:
+			continue
 		}
-	}
 
-	c.playerId = int(*msg.ReceiverId)
-	c.masterId = int(*msg.SenderId)
+		c.reliable.ack(nil, joinSeq)
+		c.playerId = int(*msg.ReceiverId)
+		c.masterId = int(*msg.SenderId)
 
-	return nil
+		return nil
+	}
 }
 
 func (c *Client) startListenThread(ctx context.Context) {
 	go func() {
-		buffer := make([]byte, 1024)
+		buffer := make([]byte, MaxDatagramSize)
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				//c.lock.Lock()
-				n, _, err := c.conn.ReadFromUDP(buffer)
+				// becomeMaster replaces the socket, the read on the old
+				// one fails and the next one goes to the new socket
+				c.lock.Lock()
+				conn := c.conn
+				c.lock.Unlock()
+				n, src, err := conn.ReadFrom(buffer)
 				if err != nil {
 					log.Printf("[client] error receiving message: %v\n", err)
 					time.Sleep(c.pingDelay * time.Millisecond)
 					continue
 				}
-				//c.lock.Unlock()
 
 				var msg protobuf.GameMessage
 				if err := proto.Unmarshal(buffer[:n], &msg); err != nil {
@@ -245,16 +292,37 @@ func (c *Client) startListenThread(ctx context.Context) {
 					continue
 				}
 
+				if !c.fromMaster(src) {
+					// only a new master announcing itself is heard from others
+					if msg.GetRoleChange().GetSenderRole() != protobuf.NodeRole_MASTER {
+						log.Printf("[client] ignoring message from %s, not the master", src.String())
+						continue
+					}
+				} else {
+					c.lock.Lock()
+					c.lastMasterActivity = time.Now()
+					c.lock.Unlock()
+				}
+
+				if _, ok := msg.GetType().(*protobuf.GameMessage_Ack); ok {
+					c.reliable.ack(nil, msg.GetMsgSeq())
+					continue
+				}
+
+				if c.reliable.received(src, msg.GetMsgSeq()) {
+					c.sendAcknowledgeMessage(int32(c.currentMasterId()), msg.GetMsgSeq())
+					continue
+				}
+
 				switch t := msg.GetType().(type) {
 				case *protobuf.GameMessage_State:
 					c.handleGameState(&msg)
 				case *protobuf.GameMessage_Error:
 					c.handleError(&msg)
 				case *protobuf.GameMessage_Ping:
-					c.lastMasterActivity = time.Now()
-				case *protobuf.GameMessage_Ack:
+					c.sendAcknowledgeMessage(int32(c.currentMasterId()), msg.GetMsgSeq())
 				case *protobuf.GameMessage_RoleChange:
-					c.handleRoleChange(&msg)
+					c.handleRoleChange(&msg, src)
 				default:
 					log.Printf("[client] unhandled message type: %T\n", t)
 				}
@@ -271,9 +339,10 @@ func (c *Client) startMasterActivityCheckerThread(ctx context.Context) {
 				return
 			default:
 				time.Sleep(c.waitDelay * time.Millisecond)
-				now := time.Now()
-				if now.Sub(c.lastMasterActivity) > c.waitDelay*time.Millisecond {
-
+				c.lock.Lock()
+				silent := time.Since(c.lastMasterActivity)
+				c.lock.Unlock()
+				if silent > c.waitDelay*time.Millisecond {
 					c.updateMaster()
 				}
 			}
@@ -282,50 +351,181 @@ func (c *Client) startMasterActivityCheckerThread(ctx context.Context) {
 }
 
 func (c *Client) handleGameState(msg *protobuf.GameMessage) {
-	stateMsg := msg.GetState()
-	log.Printf("[client] received state: %d", *stateMsg.State.StateOrder)
-	c.game.Field().EditFieldFromState(stateMsg.State)
-	c.updateDeputy(stateMsg.State)
-	c.sendAcknowledgeMessage(int32(c.masterId), *msg.MsgSeq)
-	c.lastState = msg.GetState().State
-	c.lastMasterActivity = time.Now()
+	order := msg.GetState().GetState().GetStateOrder()
+	c.lock.Lock()
+	last := c.lastState
+	c.lock.Unlock()
+	if last != nil && order <= last.GetStateOrder() {
+		// a late or repeated datagram, the field and the motion between
+		// states must not go back
+		log.Printf("[client] dropping state %d, already at %d", order, last.GetStateOrder())
+		c.sendAcknowledgeMessage(int32(c.currentMasterId()), msg.GetMsgSeq())
+		return
+	}
+
+	state, err := c.fullState(msg.GetState().GetState())
+	if err != nil {
+		// no ack, the master encodes the next delta against an older state
+		// or sends a full one
+		log.Printf("[client] cannot use state %d: %v", msg.GetState().GetState().GetStateOrder(), err)
+		return
+	}
+
+	log.Printf("[client] received state: %d", state.GetStateOrder())
+	c.game.Field().EditFieldFromState(state)
+	c.updateDeputy(state)
+	c.updateOwnRole(state)
+	c.updateGameOver(c.lastState, state)
+	c.sendAcknowledgeMessage(int32(c.currentMasterId()), *msg.MsgSeq)
+	c.lock.Lock()
+	c.lastState = state
+	c.lastStateTime = time.Now()
+	c.lock.Unlock()
+	if c.recorder != nil {
+		c.recorder.State(state)
+	}
+}
+
+// fullState turns a delta from the master into the full state and keeps the
+// recent states deltas may refer to.
+func (c *Client) fullState(state *protobuf.GameState) (*protobuf.GameState, error) {
+	if baseOrder, isDelta := deltaBase(state); isDelta {
+		base := c.recentStates[baseOrder]
+		if base == nil || base.GetStateOrder() != baseOrder || state.GetStateOrder() <= baseOrder {
+			return nil, errNoDeltaBase
+		}
+		var err error
+		state, err = applyDelta(base, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order := state.GetStateOrder()
+	c.recentStates[order] = state
+	for oldOrder := range c.recentStates {
+		if oldOrder <= order-deltaHistorySize {
+			delete(c.recentStates, oldOrder)
+		}
+	}
+	return state, nil
 }
 
 func (c *Client) handleError(msg *protobuf.GameMessage) {
 	errorMsg := msg.GetError()
 	log.Printf("[client] received error message: %s\n", *errorMsg.ErrorMessage)
-	c.sendAcknowledgeMessage(int32(c.masterId), *msg.MsgSeq)
+	c.lock.Lock()
+	c.lastError = errorMsg.GetErrorMessage()
+	c.lock.Unlock()
+	c.sendAcknowledgeMessage(int32(c.currentMasterId()), *msg.MsgSeq)
 }
 
-func (c *Client) handleRoleChange(msg *protobuf.GameMessage) {
+// handleRoleChange applies a RoleChange from the master. A node that
+// announces itself as the new master is followed only if it is the deputy
+// of the last state, at the address the state lists for it.
+func (c *Client) handleRoleChange(msg *protobuf.GameMessage, src *net.UDPAddr) {
 	roleChangeMsg := msg.GetRoleChange()
 
-	//senderRole := roleChangeMsg.GetSenderRole()
+	senderRole := roleChangeMsg.GetSenderRole()
 	receiverRole := roleChangeMsg.GetReceiverRole()
+	senderId := int(msg.GetSenderId())
+
+	if senderRole == protobuf.NodeRole_MASTER && senderId != c.currentMasterId() {
+		if !c.isDeputy(senderId, src) {
+			log.Printf("[client] ignoring master %d at %s, it is not the deputy", senderId, src.String())
+			return
+		}
+		c.followMaster(senderId, src)
+	}
+	if !c.fromMaster(src) {
+		log.Printf("[client] ignoring role change from %s, not the master", src.String())
+		return
+	}
+
+	c.sendAcknowledgeMessage(int32(c.currentMasterId()), msg.GetMsgSeq())
 
 	if receiverRole == protobuf.NodeRole_MASTER {
 		log.Printf("[cleint] received role change to master")
-		c.role = protobuf.NodeRole_MASTER
-		c.masterId = c.playerId
-		c.StartServerFromState()
+		c.becomeMaster()
 	}
 
 	if receiverRole == protobuf.NodeRole_DEPUTY {
 		log.Printf("[cleint] received role change to deputy")
+		c.lock.Lock()
 		c.role = protobuf.NodeRole_DEPUTY
-		c.deputyId = c.PlayerId()
+		c.deputyId = c.playerId
+		c.lock.Unlock()
 	}
 
 	if receiverRole == protobuf.NodeRole_VIEWER {
 		log.Printf("[cleint] received role change to viewer")
+		c.lock.Lock()
+		if c.role != protobuf.NodeRole_VIEWER {
+			// the master demotes players whose snake died
+			c.gameOver = true
+		}
 		c.role = protobuf.NodeRole_VIEWER
+		c.lock.Unlock()
 	}
 
 }
 
+// isDeputy reports whether the player is the deputy of the last state and
+// the datagram came from its address.
+func (c *Client) isDeputy(playerId int, src *net.UDPAddr) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if playerId != c.deputyId {
+		return false
+	}
+	for _, player := range c.lastState.GetPlayers().GetPlayers() {
+		if int(player.GetId()) == playerId {
+			return src.IP.Equal(net.ParseIP(player.GetIpAddress())) && src.Port == int(player.GetPort())
+		}
+	}
+	return false
+}
+
+func (c *Client) currentMasterId() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.masterId
+}
+
+// RequestPlay asks the master to turn this viewer into a player, or to give
+// a new snake to a player whose snake died. The master answers with an error
+// if there is no room for a snake, otherwise the next state lists the player
+// as NORMAL.
+func (c *Client) RequestPlay() {
+	if c.Role() != protobuf.NodeRole_VIEWER && !c.GameOver() {
+		return
+	}
+
+	c.lock.Lock()
+	c.lastError = ""
+	c.lock.Unlock()
+
+	seq := c.incrementMsgSeq()
+	joinMsg := &protobuf.GameMessage{
+		MsgSeq: &seq,
+		Type: &protobuf.GameMessage_Join{
+			Join: &protobuf.GameMessage_JoinMsg{
+				PlayerType:    c.playerType.Enum(),
+				PlayerName:    proto.String(c.playerName),
+				GameName:      proto.String(c.gameName),
+				RequestedRole: protobuf.NodeRole_NORMAL.Enum(),
+			},
+		},
+	}
+
+	c.sendTrackedMessage(joinMsg)
+	log.Println("[client] asked to become a player")
+}
+
 func (c *Client) SendSteer(direction protobuf.Direction) {
 
-	if c.role == protobuf.NodeRole_VIEWER {
+	if c.Role() == protobuf.NodeRole_VIEWER {
 		return
 	}
 
@@ -340,7 +540,7 @@ func (c *Client) SendSteer(direction protobuf.Direction) {
 		},
 	}
 
-	c.sendGameMessage(steerMsg)
+	c.sendTrackedMessage(steerMsg)
 
 	log.Println("[client] steer sent")
 }
@@ -348,7 +548,7 @@ func (c *Client) SendSteer(direction protobuf.Direction) {
 func (c *Client) sendAcknowledgeMessage(playerId int32, msgSeq int64) {
 	ackMsg := &protobuf.GameMessage{
 		MsgSeq:     proto.Int64(msgSeq),
-		SenderId:   proto.Int32(int32(c.masterId)),
+		SenderId:   proto.Int32(int32(c.playerId)),
 		ReceiverId: proto.Int32(playerId),
 		Type: &protobuf.GameMessage_Ack{
 			Ack: &protobuf.GameMessage_AckMsg{},
@@ -370,7 +570,7 @@ func (c *Client) sendRoleChange(receiverRole protobuf.NodeRole, senderRole proto
 			},
 		},
 	}
-	c.sendGameMessage(roleChangeMsg)
+	c.sendTrackedMessage(roleChangeMsg)
 }
 
 func (c *Client) sendPing() error {
@@ -381,7 +581,7 @@ func (c *Client) sendPing() error {
 		Type:   &protobuf.GameMessage_Ping{Ping: &protobuf.GameMessage_PingMsg{}},
 	}
 
-	c.sendGameMessage(pingMsg)
+	c.sendTrackedMessage(pingMsg)
 	return nil
 }
 
@@ -407,14 +607,40 @@ func (c *Client) sendGameMessage(msg *protobuf.GameMessage) {
 	}
 
 	c.lock.Lock()
-	_, err = c.conn.Write(data)
+	_, err = c.conn.WriteTo(data, c.masterAddr)
 	c.lock.Unlock()
 	if err != nil {
 		log.Printf("[client] failed to send message: %s", err.Error())
 	}
 }
 
+// sendTrackedMessage sends a message to the master and keeps resending it
+// until the master acknowledges it, also across a change of master.
+func (c *Client) sendTrackedMessage(msg *protobuf.GameMessage) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		log.Printf("failed to marshal message: %s", err.Error())
+		return
+	}
+
+	c.reliable.track(nil, msg.GetMsgSeq(), data)
+
+	err = c.sendData(data, nil)
+	if err != nil {
+		log.Printf("[client] failed to send message: %s", err.Error())
+	}
+}
+
+func (c *Client) sendData(data []byte, addr *net.UDPAddr) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := c.conn.WriteTo(data, c.masterAddr)
+	return err
+}
+
 func (c *Client) updateDeputy(state *protobuf.GameState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for _, player := range state.Players.GetPlayers() {
 		if player.GetRole() == protobuf.NodeRole_DEPUTY {
 			if c.deputyId != int(player.GetId()) {
@@ -425,22 +651,63 @@ func (c *Client) updateDeputy(state *protobuf.GameState) {
 	}
 }
 
-func (c *Client) updateMaster() {
-	log.Printf("[client] start updating master")
+func (c *Client) updateOwnRole(state *protobuf.GameState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, player := range state.GetPlayers().GetPlayers() {
+		if int(player.GetId()) == c.playerId && c.role == protobuf.NodeRole_VIEWER && player.GetRole() == protobuf.NodeRole_NORMAL {
+			log.Printf("[client] became a player")
+			c.role = protobuf.NodeRole_NORMAL
+		}
+	}
+}
 
-	if c.role == protobuf.NodeRole_DEPUTY {
-		c.role = protobuf.NodeRole_MASTER
-		c.masterId = c.playerId
-		c.StartServerFromState()
-		return
+// updateGameOver follows the own snake between two states. Players learn
+// about their death from a RoleChange, but the master keeps its role and
+// only sees its snake disappear.
+func (c *Client) updateGameOver(previous *protobuf.GameState, state *protobuf.GameState) {
+	hadSnake := hasSnake(previous, c.playerId)
+	hasSnakeNow := hasSnake(state, c.playerId)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if hasSnakeNow {
+		c.gameOver = false
+	} else if hadSnake && c.role == protobuf.NodeRole_MASTER && !c.gameOver {
+		log.Printf("[client] snake of the master died")
+		c.gameOver = true
 	}
+}
 
+func hasSnake(state *protobuf.GameState, playerId int) bool {
+	for _, snake := range state.GetSnakes() {
+		if int(snake.GetPlayerId()) == playerId {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMaster runs when the master has been silent for too long: the
+// deputy takes over, the others switch to the deputy.
+func (c *Client) updateMaster() {
+	log.Printf("[client] start updating master")
+
+	c.lock.Lock()
+	role := c.role
+	deputyId := c.deputyId
 	var newMasterAddr *net.UDPAddr
-	for _, player := range c.lastState.Players.GetPlayers() {
-		if int(player.GetId()) == c.deputyId {
+	for _, player := range c.lastState.GetPlayers().GetPlayers() {
+		if int(player.GetId()) == deputyId && deputyId != c.masterId {
 			newMasterAddr = &net.UDPAddr{IP: net.ParseIP(player.GetIpAddress()), Port: int(player.GetPort())}
 		}
 	}
+	c.lock.Unlock()
+
+	if role == protobuf.NodeRole_DEPUTY {
+		c.becomeMaster()
+		return
+	}
 
 	if newMasterAddr == nil {
 		log.Printf("[client] no deputy found")
@@ -448,39 +715,46 @@ func (c *Client) updateMaster() {
 		return
 	}
 
-	c.lock.Lock()
-	c.conn.Close()
-
-	log.Printf("[client] trying connect to new server: %s:%d", newMasterAddr.IP.String(), newMasterAddr.Port)
-	conn, err := net.DialUDP("udp", c.addr, newMasterAddr)
-	if err != nil {
-		log.Printf("failed to connect to server: %s", err.Error())
-	}
-	c.lock.Unlock()
-
-	log.Printf("[client] connected to new server: %s:%d", newMasterAddr.IP.String(), newMasterAddr.Port)
+	c.followMaster(deputyId, newMasterAddr)
 	c.sendPing()
-	c.masterId = c.deputyId
-	c.deputyId = -1
-	c.conn = conn
 }
 
 func (c *Client) Stop() error {
 	log.Println("[client] stopping")
-	c.sendRoleChange(protobuf.NodeRole_MASTER, protobuf.NodeRole_VIEWER, c.playerId, c.masterId)
+	c.sendRoleChange(protobuf.NodeRole_MASTER, protobuf.NodeRole_VIEWER, c.playerId, c.currentMasterId())
+	c.reliable.flush(c.waitDelay * time.Millisecond)
 	c.cancel()
-	if c.server != nil {
-		c.server.Stop()
+	c.lock.Lock()
+	server, conn := c.server, c.conn
+	c.lock.Unlock()
+	if server != nil {
+		server.Stop()
 	}
-	return c.conn.Close()
+	if c.recorder != nil {
+		err := c.recorder.Close()
+		if err != nil {
+			log.Printf("[client] failed to close replay: %v", err)
+		}
+	}
+	return conn.Close()
 }
 
+// incrementMsgSeq hands out the next sequence number, the UI, the ping and
+// the listen goroutines take them concurrently and the master drops a
+// message whose number it has already seen.
 func (c *Client) incrementMsgSeq() int64 {
-	c.msgSeq++
-	return c.msgSeq
+	return atomic.AddInt64(&c.msgSeq, 1)
+}
+
+// SetRecorder makes the client record every state it receives, the
+// recorder is closed when the client stops.
+func (c *Client) SetRecorder(recorder *replay.Recorder) {
+	c.recorder = recorder
 }
 
 func (c *Client) SetServer(s *Server) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.server = s
 }
 
@@ -491,9 +765,47 @@ func (c *Client) Game() *game.Game {
 }
 
 func (c *Client) Role() protobuf.NodeRole {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.role
 }
 
+// LastError returns the last error message received from the master.
+func (c *Client) LastError() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastError
+}
+
+// GameOver reports whether the snake of this player died and it has not
+// started playing again yet.
+func (c *Client) GameOver() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gameOver
+}
+
+// LastState returns the newest state from the master and when it arrived,
+// the UI moves snakes between states by that time.
+func (c *Client) LastState() (*protobuf.GameState, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastState, c.lastStateTime
+}
+
+// FinalScore is the score of the player as the master last reported it, it
+// stays after the snake is gone.
+func (c *Client) FinalScore() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, player := range c.lastState.GetPlayers().GetPlayers() {
+		if int(player.GetId()) == c.playerId {
+			return int(player.GetScore())
+		}
+	}
+	return 0
+}
+
 func (c *Client) PlayerId() int {
 	return c.playerId
 }
@@ -0,0 +1,40 @@
+package network
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestMsgSeqUnique takes sequence numbers from several goroutines like the
+// UI, the ping and the listen goroutines do, every number must be new.
+func TestMsgSeqUnique(t *testing.T) {
+	client := &Client{}
+	server := &Server{}
+
+	for name, next := range map[string]func() int64{"client": client.incrementMsgSeq, "server": server.incrementMsgSeq} {
+		t.Run(name, func(t *testing.T) {
+			const goroutines, perGoroutine = 8, 1000
+			seqs := make(chan int64, goroutines*perGoroutine)
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < perGoroutine; j++ {
+						seqs <- next()
+					}
+				}()
+			}
+			wg.Wait()
+			close(seqs)
+
+			seen := make(map[int64]bool)
+			for seq := range seqs {
+				if seen[seq] {
+					t.Fatalf("sequence number %d was handed out twice", seq)
+				}
+				seen[seq] = true
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package network
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"google.golang.org/protobuf/proto"
 	"log"
 	"net"
@@ -17,6 +19,16 @@ const (
 
 	AnnouncementDelay    = 1000
 	AnnouncementWaitTime = 5000
+
+	DiscoverTimeout    = 2000
+	discoverRetryDelay = 300
+
+	// MaxDatagramSize is the largest UDP payload over IPv4, a message that
+	// does not fit is never sent and every read buffer holds this much.
+	MaxDatagramSize = 65507
+	// socketBufferSize lets the kernel queue a few large states while the
+	// reader is busy.
+	socketBufferSize = 1 << 20
 )
 
 type Announcement struct {
@@ -49,8 +61,8 @@ func ListenForAnnouncements(ctx context.Context, announcements *[]*Announcement,
 	}
 	defer conn.Close()
 
-	conn.SetReadBuffer(4 * 1024)
-	buf := make([]byte, 4096)
+	conn.SetReadBuffer(socketBufferSize)
+	buf := make([]byte, MaxDatagramSize)
 
 	for {
 		select {
@@ -99,6 +111,75 @@ func ListenForAnnouncements(ctx context.Context, announcements *[]*Announcement,
 	}
 }
 
+// Discover asks a server for its game directly with a unicast DiscoverMsg,
+// for networks where multicast announcements do not get through.
+func Discover(addr *net.UDPAddr, timeout time.Duration) (*Announcement, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr.String(), err)
+	}
+	defer conn.Close()
+
+	discoverMsg := &protobuf.GameMessage{
+		MsgSeq: proto.Int64(1),
+		Type:   &protobuf.GameMessage_Discover{Discover: &protobuf.GameMessage_DiscoverMsg{}},
+	}
+
+	data, err := proto.Marshal(discoverMsg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal discover message: %w", err)
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		_, err = conn.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send discover message: %w", err)
+		}
+
+		readDeadline := time.Now().Add(discoverRetryDelay * time.Millisecond)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, fmt.Errorf("no game at %s: %w", addr.String(), err)
+		}
+
+		message := &protobuf.GameMessage{}
+		if err := proto.Unmarshal(buf[:n], message); err != nil {
+			log.Printf("[client] failed to unmarshal discover answer: %v", err)
+			continue
+		}
+
+		games := message.GetAnnouncement().GetGames()
+		if len(games) == 0 {
+			continue
+		}
+
+		return &Announcement{
+			announcement: games[0],
+			serverAddr:   *addr,
+			lastReceived: time.Now(),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no answer from %s", addr.String())
+}
+
+// AddAnnouncement puts a game found with Discover into the list filled by
+// ListenForAnnouncements. It expires the same way unless discovered again.
+func AddAnnouncement(announcements *[]*Announcement, lock *sync.Mutex, announcement *Announcement) {
+	updateAnnouncements(announcements, lock, announcement)
+}
+
 func updateAnnouncements(announcements *[]*Announcement, lock *sync.Mutex, newAnnouncement *Announcement) {
 	lock.Lock()
 	defer lock.Unlock()
@@ -121,6 +202,7 @@ func updateAnnouncements(announcements *[]*Announcement, lock *sync.Mutex, newAn
 	for _, ann := range *announcements {
 		if ann.serverAddr.String() == newAnnouncement.serverAddr.String() &&
 			ann.announcement.GetGameName() == newAnnouncement.announcement.GetGameName() {
+			ann.announcement = newAnnouncement.announcement
 			ann.lastReceived = time.Now()
 			isExists = true
 			break
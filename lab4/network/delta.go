@@ -0,0 +1,289 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"snake_game/game"
+	"snake_game/protobuf"
+	"sync"
+)
+
+// Delta states are not part of snakes.proto. They travel in field numbers
+// the protocol does not use, so a stock node parses them as unknown fields
+// and ignores them. A client announces that it understands deltas in its
+// JoinMsg, and only such clients ever get a delta from the master.
+//
+// A delta is a GameState with the full player list, the snakes that changed
+// since the base state, the food that appeared, and in the extra fields the
+// order of the base state, the ids of the snakes that are gone and the food
+// that was eaten.
+const (
+	deltaSupportField       protowire.Number = 100 // JoinMsg, varint 1
+	deltaBaseField          protowire.Number = 100 // GameState, varint base state order
+	deltaRemovedSnakesField protowire.Number = 101 // GameState, varint player id, repeated
+	deltaRemovedFoodsField  protowire.Number = 102 // GameState, Coord message, repeated
+
+	// deltaHistorySize is how many recent states both sides keep, a player
+	// that has not acknowledged any of them gets a full state
+	deltaHistorySize = 32
+)
+
+func markDeltaSupport(join *protobuf.GameMessage_JoinMsg) {
+	var b []byte
+	b = protowire.AppendTag(b, deltaSupportField, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	join.ProtoReflect().SetUnknown(b)
+}
+
+func supportsDelta(join *protobuf.GameMessage_JoinMsg) bool {
+	supported := false
+	walkUnknown(join.ProtoReflect().GetUnknown(), func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num == deltaSupportField && typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(value)
+			supported = v == 1
+		}
+		return nil
+	})
+	return supported
+}
+
+// deltaBase returns the order of the state a delta is based on, false for a
+// full state.
+func deltaBase(state *protobuf.GameState) (int32, bool) {
+	base, found := int32(0), false
+	walkUnknown(state.ProtoReflect().GetUnknown(), func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num == deltaBaseField && typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(value)
+			base, found = int32(v), true
+		}
+		return nil
+	})
+	return base, found
+}
+
+func makeDelta(base *protobuf.GameState, state *protobuf.GameState) *protobuf.GameState {
+	delta := &protobuf.GameState{
+		StateOrder: proto.Int32(state.GetStateOrder()),
+		Players:    state.GetPlayers(),
+	}
+
+	var extra []byte
+	extra = protowire.AppendTag(extra, deltaBaseField, protowire.VarintType)
+	extra = protowire.AppendVarint(extra, uint64(base.GetStateOrder()))
+
+	baseSnakes := make(map[int32]*protobuf.GameState_Snake, len(base.GetSnakes()))
+	for _, snake := range base.GetSnakes() {
+		baseSnakes[snake.GetPlayerId()] = snake
+	}
+	current := make(map[int32]bool, len(state.GetSnakes()))
+	for _, snake := range state.GetSnakes() {
+		current[snake.GetPlayerId()] = true
+		if old, ok := baseSnakes[snake.GetPlayerId()]; ok && proto.Equal(old, snake) {
+			continue
+		}
+		delta.Snakes = append(delta.Snakes, snake)
+	}
+	for _, snake := range base.GetSnakes() {
+		if !current[snake.GetPlayerId()] {
+			extra = protowire.AppendTag(extra, deltaRemovedSnakesField, protowire.VarintType)
+			extra = protowire.AppendVarint(extra, uint64(uint32(snake.GetPlayerId())))
+		}
+	}
+
+	baseFoods := make(map[[2]int32]bool, len(base.GetFoods()))
+	for _, food := range base.GetFoods() {
+		baseFoods[cellKey(food)] = true
+	}
+	foods := make(map[[2]int32]bool, len(state.GetFoods()))
+	for _, food := range state.GetFoods() {
+		foods[cellKey(food)] = true
+		if !baseFoods[cellKey(food)] {
+			delta.Foods = append(delta.Foods, food)
+		}
+	}
+	for _, food := range base.GetFoods() {
+		if foods[cellKey(food)] {
+			continue
+		}
+		data, _ := proto.Marshal(food)
+		extra = protowire.AppendTag(extra, deltaRemovedFoodsField, protowire.BytesType)
+		extra = protowire.AppendBytes(extra, data)
+	}
+
+	if playerId, ok := nextPlayerId(state); ok {
+		extra = appendNextPlayerId(extra, playerId)
+	}
+	extra = game.AppendRobotLevels(extra, game.RobotLevels(state))
+
+	delta.ProtoReflect().SetUnknown(extra)
+	return delta
+}
+
+// applyDelta rebuilds the full state from its base. Snakes keep the order
+// of the base, new ones go to the end like on the master.
+func applyDelta(base *protobuf.GameState, delta *protobuf.GameState) (*protobuf.GameState, error) {
+	removedSnakes := make(map[int32]bool)
+	removedFoods := make(map[[2]int32]bool)
+	err := walkUnknown(delta.ProtoReflect().GetUnknown(), func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == deltaRemovedSnakesField && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			removedSnakes[int32(v)] = true
+		case num == deltaRemovedFoodsField && typ == protowire.BytesType:
+			data, n := protowire.ConsumeBytes(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			food := &protobuf.GameState_Coord{}
+			if err := proto.Unmarshal(data, food); err != nil {
+				return err
+			}
+			removedFoods[cellKey(food)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bad delta %d: %w", delta.GetStateOrder(), err)
+	}
+
+	state := &protobuf.GameState{
+		StateOrder: proto.Int32(delta.GetStateOrder()),
+		Players:    delta.GetPlayers(),
+	}
+
+	changed := make(map[int32]*protobuf.GameState_Snake, len(delta.GetSnakes()))
+	for _, snake := range delta.GetSnakes() {
+		changed[snake.GetPlayerId()] = snake
+	}
+	for _, snake := range base.GetSnakes() {
+		id := snake.GetPlayerId()
+		if removedSnakes[id] {
+			continue
+		}
+		if newSnake, ok := changed[id]; ok {
+			snake = newSnake
+			delete(changed, id)
+		}
+		state.Snakes = append(state.Snakes, snake)
+	}
+	for _, snake := range delta.GetSnakes() {
+		if _, ok := changed[snake.GetPlayerId()]; ok {
+			state.Snakes = append(state.Snakes, snake)
+		}
+	}
+
+	for _, food := range base.GetFoods() {
+		if !removedFoods[cellKey(food)] {
+			state.Foods = append(state.Foods, food)
+		}
+	}
+	state.Foods = append(state.Foods, delta.GetFoods()...)
+	if playerId, ok := nextPlayerId(delta); ok {
+		setNextPlayerId(state, playerId)
+	}
+	game.SetRobotLevels(state, game.RobotLevels(delta))
+
+	return state, nil
+}
+
+func walkUnknown(b []byte, visit func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		if err := visit(num, typ, b[n:n+m]); err != nil {
+			return err
+		}
+		b = b[n+m:]
+	}
+	return nil
+}
+
+func cellKey(cell *protobuf.GameState_Coord) [2]int32 {
+	return [2]int32{cell.GetX(), cell.GetY()}
+}
+
+// deltaStates is the master side of the delta mode: recent states by order
+// and the newest state every delta capable player acknowledged.
+type deltaStates struct {
+	lock    *sync.Mutex
+	history map[int32]*protobuf.GameState
+	seqs    map[int64]int32
+	acked   map[int]int32
+}
+
+func newDeltaStates() *deltaStates {
+	return &deltaStates{
+		lock:    new(sync.Mutex),
+		history: make(map[int32]*protobuf.GameState),
+		seqs:    make(map[int64]int32),
+		acked:   make(map[int]int32),
+	}
+}
+
+// enable starts sending deltas to the player once it acknowledges a state.
+func (d *deltaStates) enable(playerId int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.acked[playerId] = -1
+}
+
+func (d *deltaStates) forget(playerId int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.acked, playerId)
+}
+
+func (d *deltaStates) remember(msgSeq int64, state *protobuf.GameState) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	order := state.GetStateOrder()
+	d.history[order] = state
+	d.seqs[msgSeq] = order
+	for oldOrder := range d.history {
+		if oldOrder <= order-deltaHistorySize {
+			delete(d.history, oldOrder)
+		}
+	}
+	for seq, oldOrder := range d.seqs {
+		if oldOrder <= order-deltaHistorySize {
+			delete(d.seqs, seq)
+		}
+	}
+}
+
+// ack notes the state a player confirmed, acks of other messages are
+// ignored.
+func (d *deltaStates) ack(playerId int, msgSeq int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	acked, enabled := d.acked[playerId]
+	order, isState := d.seqs[msgSeq]
+	if enabled && isState && order > acked {
+		d.acked[playerId] = order
+	}
+}
+
+// base returns the state to encode the next delta for the player against,
+// nil means the player gets a full state.
+func (d *deltaStates) base(playerId int) *protobuf.GameState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	acked, enabled := d.acked[playerId]
+	if !enabled {
+		return nil
+	}
+	return d.history[acked]
+}
+
+var errNoDeltaBase = errors.New("base state of the delta is gone")
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"net"
+	"snake_game/game"
+	"snake_game/protobuf"
+	"sync"
+	"time"
+)
+
+// When the master is gone the deputy takes over: it starts a server from
+// the last state it got, on the address the other players know it by, and
+// sends every player a RoleChange with sender_role MASTER. A player switches
+// to the sender of such a message, or to the deputy on its own once the
+// master has been silent for too long. The new master keeps the state
+// order, the scores, the player id counter and the robot difficulties and
+// elects a new deputy.
+//
+// The id counter and the difficulties are not part of snakes.proto, the
+// master sends them in extra GameState fields like the delta fields. The
+// difficulties live in game.RobotLevelField since Step reads them too.
+const nextPlayerIdField protowire.Number = 103 // GameState, varint
+
+func setNextPlayerId(state *protobuf.GameState, playerId int) {
+	state.ProtoReflect().SetUnknown(appendNextPlayerId(state.ProtoReflect().GetUnknown(), playerId))
+}
+
+func appendNextPlayerId(b []byte, playerId int) []byte {
+	b = protowire.AppendTag(b, nextPlayerIdField, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(playerId))
+}
+
+// nextPlayerId returns the id the master would give the next player, false
+// if the state does not carry it.
+func nextPlayerId(state *protobuf.GameState) (int, bool) {
+	playerId, found := 0, false
+	walkUnknown(state.ProtoReflect().GetUnknown(), func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num == nextPlayerIdField && typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(value)
+			playerId, found = int(v), true
+		}
+		return nil
+	})
+	return playerId, found
+}
+
+// newServerFromState prepares the server of a deputy that takes over, it
+// starts with takeOver.
+func newServerFromState(gameName string, transport Transport, addr *net.UDPAddr, config *protobuf.GameConfig, state *protobuf.GameState, masterId int, msgSeq int64) (*Server, error) {
+	g := game.NewGame(config)
+	g.Field().EditFieldFromState(state)
+	g.SetTick(int(state.GetStateOrder()))
+
+	delay := time.Duration(g.Field().DelayMS())
+
+	server := &Server{
+		gameName:      gameName,
+		masterId:      masterId,
+		deputyId:      -1,
+		announceDelay: AnnouncementDelay * time.Millisecond,
+		transport:     transport,
+		lockServer:    new(sync.Mutex),
+		lastPing:      make(map[int]time.Time),
+		lockGame:      g.Lock(),
+		game:          g,
+		msgSeq:        msgSeq,
+		stateId:       int(state.GetStateOrder()),
+		gameDelay:     delay,
+		pingDelay:     time.Duration(float64(delay) * 0.1),
+		waitDelay:     time.Duration(float64(delay) * 0.8),
+	}
+
+	// the state stays with the client, the server changes its own copy
+	levels := game.RobotLevels(state)
+	for _, player := range state.GetPlayers().GetPlayers() {
+		player = proto.Clone(player).(*protobuf.GamePlayer)
+		if isRobot(player) {
+			// a master that does not send the difficulty, play them as normal
+			difficulty, ok := levels[int(player.GetId())]
+			if !ok {
+				difficulty = game.RobotNormal
+			}
+			g.SetRobot(int(player.GetId()), difficulty)
+		}
+		server.players = append(server.players, player)
+	}
+
+	if playerId, ok := nextPlayerId(state); ok {
+		server.uniqueId = playerId
+	} else {
+		// a master that does not send the counter, ids of players and
+		// zombies that are still around must not be reused at least
+		for _, player := range server.players {
+			if server.uniqueId <= int(player.GetId()) {
+				server.uniqueId = int(player.GetId()) + 1
+			}
+		}
+		for _, snake := range g.Field().Snakes() {
+			if server.uniqueId <= snake.PlayerID() {
+				server.uniqueId = snake.PlayerID() + 1
+			}
+		}
+	}
+
+	serverConn, err := transport.Listen(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr.String(), err)
+	}
+	serverConn.SetReadBuffer(socketBufferSize)
+	server.serverConn = serverConn
+	server.serverAddr = serverConn.LocalAddr()
+	server.announceConn = announcePacketConn(serverConn)
+
+	return server, nil
+}
+
+// takeOver starts the game on the new master. The old master leaves the
+// game and its snake becomes a zombie, the others get a RoleChange from the
+// new master and some time to switch to it before the ping checker counts
+// them as gone. The deputy is elected again on the first tick.
+func (s *Server) takeOver(masterAddr *net.UDPAddr, oldMasterId int) {
+	s.lockServer.Lock()
+	defer s.lockServer.Unlock()
+
+	for _, player := range s.players {
+		if int(player.GetId()) == s.masterId {
+			player.IpAddress = proto.String(masterAddr.IP.String())
+			player.Port = proto.Int32(int32(masterAddr.Port))
+			player.Role = protobuf.NodeRole_MASTER.Enum()
+		}
+	}
+	if oldMasterId != s.masterId {
+		s.removePlayerWithoutSnake(oldMasterId)
+	}
+
+	grace := time.Now().Add(s.waitDelay * time.Millisecond)
+	for _, player := range s.players {
+		s.lastPing[int(player.GetId())] = grace
+	}
+
+	s.startThreads()
+
+	for _, player := range s.players {
+		playerId := int(player.GetId())
+		if isRobot(player) || playerId == s.masterId {
+			continue
+		}
+		err := s.sendRoleChange(player.GetRole(), playerId)
+		if err != nil {
+			log.Printf("[server] failed to tell player %d about the new master: %v", playerId, err)
+		}
+	}
+
+	log.Printf("[server] took over from master %d at state %d on %s", oldMasterId, s.stateId, s.serverAddr.String())
+}
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"google.golang.org/protobuf/proto"
+	"net"
+	"snake_game/game"
+	"snake_game/protobuf"
+	"testing"
+	"time"
+)
+
+func TestTakeOverKeepsRobotDifficulty(t *testing.T) {
+	master := NewServer(simGameName, simWidth, simHeight, 1, simDelayMS)
+	difficulties := map[int]game.Difficulty{}
+	for _, difficulty := range []game.Difficulty{game.RobotEasy, game.RobotHard, game.RobotNormal, game.RobotHard} {
+		playerId, err := master.AddRobot(difficulty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		difficulties[playerId] = difficulty
+	}
+
+	base := master.createGameState().GetState().GetState()
+	full := master.createGameState().GetState().GetState()
+	// a deputy in delta mode rebuilds the state from the delta
+	applied, err := applyDelta(base, makeDelta(base, full))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, state := range map[string]*protobuf.GameState{"full state": full, "delta": applied} {
+		t.Run(name, func(t *testing.T) {
+			addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: simFirstPort}
+			server, err := newServerFromState(simGameName, NewSimNetwork(1).Host("10.0.0.2"), addr, master.GameConfig(), state, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.serverConn.Close()
+
+			for playerId, want := range difficulties {
+				got, ok := server.Game().RobotDifficulty(playerId)
+				if !ok {
+					t.Fatalf("player %d is not a robot after the takeover", playerId)
+				}
+				if got != want {
+					t.Errorf("robot %d plays %s after the takeover, want %s", playerId, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFollowOnlyTheDeputy(t *testing.T) {
+	sim := NewSimNetwork(1)
+	masterAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: simFirstPort}
+	deputyAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: simFirstPort}
+	client, err := NewClientWithTransport(sim.Host("10.0.0.3"), masterAddr, "player", protobuf.NodeRole_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+
+	client.reliable = newReliable("client", time.Millisecond, time.Millisecond, client.sendData)
+	client.playerId = 2
+	client.masterId = 0
+	client.deputyId = 1
+	client.lastState = &protobuf.GameState{
+		StateOrder: proto.Int32(1),
+		Players: &protobuf.GamePlayers{Players: []*protobuf.GamePlayer{
+			{Name: proto.String("master"), Id: proto.Int32(0), IpAddress: proto.String("10.0.0.1"), Port: proto.Int32(int32(masterAddr.Port)), Role: protobuf.NodeRole_MASTER.Enum(), Score: proto.Int32(0)},
+			{Name: proto.String("deputy"), Id: proto.Int32(1), IpAddress: proto.String("10.0.0.2"), Port: proto.Int32(int32(deputyAddr.Port)), Role: protobuf.NodeRole_DEPUTY.Enum(), Score: proto.Int32(0)},
+			{Name: proto.String("player"), Id: proto.Int32(2), Role: protobuf.NodeRole_NORMAL.Enum(), Score: proto.Int32(0)},
+		}},
+	}
+
+	roleChange := func(senderId int32, receiverRole protobuf.NodeRole) *protobuf.GameMessage {
+		return &protobuf.GameMessage{
+			MsgSeq:     proto.Int64(1),
+			SenderId:   proto.Int32(senderId),
+			ReceiverId: proto.Int32(2),
+			Type: &protobuf.GameMessage_RoleChange{
+				RoleChange: &protobuf.GameMessage_RoleChangeMsg{
+					SenderRole:   protobuf.NodeRole_MASTER.Enum(),
+					ReceiverRole: receiverRole.Enum(),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		senderId int32
+		src      *net.UDPAddr
+		masterId int
+	}{
+		{"a player that is not the deputy", 2, &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: simFirstPort}, 0},
+		{"the deputy id from another address", 1, &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: simFirstPort}, 0},
+		{"the deputy", 1, deputyAddr, 1},
+	}
+	for _, test := range tests {
+		client.handleRoleChange(roleChange(test.senderId, protobuf.NodeRole_VIEWER), test.src)
+		if got := client.currentMasterId(); got != test.masterId {
+			t.Fatalf("after a takeover from %s the master is %d, want %d", test.name, got, test.masterId)
+		}
+		if test.masterId == 0 && client.Role() != protobuf.NodeRole_NORMAL {
+			t.Fatalf("%s changed the role to %s", test.name, client.Role())
+		}
+	}
+	if client.Role() != protobuf.NodeRole_VIEWER {
+		t.Fatalf("role change from the new master was not applied, role %s", client.Role())
+	}
+}
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	JoinTimeout = 3000
+
+	seenTTL = 10 * time.Second
+)
+
+type messageKey struct {
+	peer string
+	seq  int64
+}
+
+type pendingMessage struct {
+	data      []byte
+	addr      *net.UDPAddr
+	firstSent time.Time
+	lastSent  time.Time
+}
+
+// reliable implements the acknowledgement rules of snakes.proto: every
+// message except Ack and Announcement is resent each resendDelay until the
+// peer acks its msg_seq, and received messages are remembered by
+// (sender, msg_seq) so a retransmit is acked again but handled only once.
+// A message nobody acked within lossTimeout is dropped, by then the peer
+// is considered lost by the ping checkers anyway.
+//
+// Peers are identified by address, a joining node has no id yet. A nil
+// address stands for the current master on the client side, so pending
+// messages follow the client to a new master after failover.
+type reliable struct {
+	name        string
+	lock        *sync.Mutex
+	pending     map[messageKey]*pendingMessage
+	seen        map[messageKey]time.Time
+	resendDelay time.Duration
+	lossTimeout time.Duration
+	send        func(data []byte, addr *net.UDPAddr) error
+}
+
+func newReliable(name string, resendDelay time.Duration, lossTimeout time.Duration, send func(data []byte, addr *net.UDPAddr) error) *reliable {
+	if resendDelay <= 0 {
+		resendDelay = time.Millisecond
+	}
+	if lossTimeout < resendDelay {
+		lossTimeout = resendDelay
+	}
+
+	return &reliable{
+		name:        name,
+		lock:        new(sync.Mutex),
+		pending:     make(map[messageKey]*pendingMessage),
+		seen:        make(map[messageKey]time.Time),
+		resendDelay: resendDelay,
+		lossTimeout: lossTimeout,
+		send:        send,
+	}
+}
+
+func peerKey(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// track remembers an already sent message until ack is called for it.
+func (r *reliable) track(addr *net.UDPAddr, seq int64, data []byte) {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pending[messageKey{peerKey(addr), seq}] = &pendingMessage{
+		data:      data,
+		addr:      addr,
+		firstSent: now,
+		lastSent:  now,
+	}
+}
+
+func (r *reliable) ack(addr *net.UDPAddr, seq int64) bool {
+	key := messageKey{peerKey(addr), seq}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.pending[key]
+	delete(r.pending, key)
+	return ok
+}
+
+// received reports whether the message was already seen from addr.
+func (r *reliable) received(addr *net.UDPAddr, seq int64) bool {
+	key := messageKey{peerKey(addr), seq}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.seen[key]; ok {
+		return true
+	}
+	r.seen[key] = time.Now()
+	return false
+}
+
+// forget drops everything known about a lost peer.
+func (r *reliable) forget(addr *net.UDPAddr) {
+	peer := peerKey(addr)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key := range r.pending {
+		if key.peer == peer {
+			delete(r.pending, key)
+		}
+	}
+	for key := range r.seen {
+		if key.peer == peer {
+			delete(r.seen, key)
+		}
+	}
+}
+
+func (r *reliable) pendingCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pending)
+}
+
+func (r *reliable) resend() {
+	now := time.Now()
+	var due []*pendingMessage
+
+	r.lock.Lock()
+	for key, msg := range r.pending {
+		if now.Sub(msg.firstSent) > r.lossTimeout {
+			peer := key.peer
+			if peer == "" {
+				peer = "master"
+			}
+			log.Printf("[%s] message %d to %s was not acknowledged, dropping", r.name, key.seq, peer)
+			delete(r.pending, key)
+			continue
+		}
+		if now.Sub(msg.lastSent) >= r.resendDelay {
+			msg.lastSent = now
+			due = append(due, msg)
+		}
+	}
+	for key, at := range r.seen {
+		if now.Sub(at) > seenTTL {
+			delete(r.seen, key)
+		}
+	}
+	r.lock.Unlock()
+
+	for _, msg := range due {
+		err := r.send(msg.data, msg.addr)
+		if err != nil {
+			log.Printf("[%s] failed to resend message: %v", r.name, err)
+		}
+	}
+}
+
+// flush waits until every pending message is acknowledged or timeout passes.
+func (r *reliable) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for r.pendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(r.resendDelay)
+		r.resend()
+	}
+}
+
+func (r *reliable) startResendThread(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.resendDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.resend()
+			}
+		}
+	}()
+}
@@ -3,14 +3,18 @@ package network
 import (
 	"context"
 	"fmt"
+	"golang.org/x/net/ipv4"
 	"google.golang.org/protobuf/proto"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"snake_game/game"
 	"snake_game/protobuf"
+	"snake_game/replay"
 )
 
 const (
@@ -18,23 +22,30 @@ const (
 )
 
 type Server struct {
-	gameName   string
-	masterId   int
-	deputyId   int
-	serverAddr *net.UDPAddr
-	serverConn *net.UDPConn
-	lockServer *sync.Mutex
-	players    []*protobuf.GamePlayer
-	lastPing   map[int]time.Time
-	lockGame   *sync.Mutex
-	game       *game.Game
-	msgSeq     int64
-	uniqueId   int
-	stateId    int
-	cancel     context.CancelFunc
-	gameDelay  time.Duration
-	pingDelay  time.Duration
-	waitDelay  time.Duration
+	gameName      string
+	masterId      int
+	deputyId      int
+	bindAddr      *net.UDPAddr
+	announceDelay time.Duration
+	serverAddr    *net.UDPAddr
+	announceConn  *ipv4.PacketConn
+	serverConn    Conn
+	transport     Transport
+	reliable      *reliable
+	delta         *deltaStates
+	recorder      *replay.Recorder
+	lockServer    *sync.Mutex
+	players       []*protobuf.GamePlayer
+	lastPing      map[int]time.Time
+	lockGame      *sync.Mutex
+	game          *game.Game
+	msgSeq        int64
+	uniqueId      int
+	stateId       int
+	cancel        context.CancelFunc
+	gameDelay     time.Duration
+	pingDelay     time.Duration
+	waitDelay     time.Duration
 }
 
 func NewServer(gameName string, width int, height int, foodStatic int, delayMS int) *Server {
@@ -48,74 +59,114 @@ func NewServer(gameName string, width int, height int, foodStatic int, delayMS i
 	g := game.NewGame(&gameConf)
 
 	return &Server{
-		gameName:   gameName,
-		masterId:   0,
-		deputyId:   -1,
-		lockServer: new(sync.Mutex),
-		game:       g,
-		lockGame:   g.Lock(),
-		lastPing:   make(map[int]time.Time),
-		msgSeq:     0,
-		uniqueId:   0,
-		stateId:    0,
-		gameDelay:  time.Duration(delayMS),
-		pingDelay:  time.Duration(float64(delayMS) * 0.1),
-		waitDelay:  time.Duration(float64(delayMS) * 0.8),
+		gameName:      gameName,
+		masterId:      0,
+		deputyId:      -1,
+		announceDelay: AnnouncementDelay * time.Millisecond,
+		transport:     UDP,
+		lockServer:    new(sync.Mutex),
+		game:          g,
+		lockGame:      g.Lock(),
+		lastPing:      make(map[int]time.Time),
+		msgSeq:        0,
+		uniqueId:      0,
+		stateId:       0,
+		gameDelay:     time.Duration(delayMS),
+		pingDelay:     time.Duration(float64(delayMS) * 0.1),
+		waitDelay:     time.Duration(float64(delayMS) * 0.8),
 	}
 }
 
-func (s *Server) Start() error {
-	serverAddr, err := s.getInterfaceAddress("eth0")
+func (s *Server) SetBindAddr(addr *net.UDPAddr) {
+	s.bindAddr = addr
+}
+
+// SetTransport replaces UDP, call it before Start.
+func (s *Server) SetTransport(transport Transport) {
+	s.transport = transport
+}
+
+func (s *Server) SetAnnounceDelay(delay time.Duration) {
+	s.announceDelay = delay
+}
+
+// SetRecorder makes the server record every state it sends, the recorder
+// is closed when the server stops.
+func (s *Server) SetRecorder(recorder *replay.Recorder) {
+	s.recorder = recorder
+}
+
+// SetDeltaStates makes the server send clients that support it only the
+// changes since the last state they acknowledged. Others keep getting full
+// states.
+func (s *Server) SetDeltaStates(enabled bool) {
+	if enabled {
+		s.delta = newDeltaStates()
+	} else {
+		s.delta = nil
+	}
+}
+
+// SetSeed makes the match reproducible: the same seed and the same inputs
+// give the same food and spawn positions.
+func (s *Server) SetSeed(seed int64) {
+	s.game.SetSeed(seed)
+}
+
+func (s *Server) Seed() int64 {
+	return s.game.Seed()
+}
+
+func (s *Server) SetHeadless() {
+	s.lockServer.Lock()
+	defer s.lockServer.Unlock()
+	s.masterId = s.uniqueId
+	s.uniqueId++
+}
+
+// AddRobot adds a server side bot player with its own snake. Robots have no
+// address, they are never sent messages or pinged.
+func (s *Server) AddRobot(difficulty game.Difficulty) (int, error) {
+	name := fmt.Sprintf("robot %s", difficulty.String())
+	playerId := s.addNewPlayer(name, "", 0, protobuf.NodeRole_NORMAL.Enum(), protobuf.PlayerType_ROBOT)
+
+	err := s.game.AddRobot(playerId, difficulty)
 	if err != nil {
-		log.Printf("[server] failed to get eth0 address: %v", err)
-		return err
+		s.lockServer.Lock()
+		s.removePlayer(playerId)
+		s.lockServer.Unlock()
+		log.Printf("[server] failed to add robot: %v", err)
+		return -1, err
 	}
 
-	serverConn, err := net.ListenUDP("udp", serverAddr)
+	log.Printf("[server] robot %d (%s) joined the game", playerId, difficulty.String())
+	return playerId, nil
+}
+
+func (s *Server) Start() error {
+	serverAddr := s.bindAddr
+	serverConn, err := s.transport.Listen(serverAddr)
 	if err != nil {
 		log.Printf("[server] failed to start server: %v", err)
 		return err
 	}
 
-	localAddr := serverConn.LocalAddr().(*net.UDPAddr)
+	serverConn.SetReadBuffer(socketBufferSize)
+	localAddr := serverConn.LocalAddr()
 
 	s.serverAddr = localAddr
 	s.serverConn = serverConn
-	s.players = make([]*protobuf.GamePlayer, 0)
-
-	s.startThreads()
-
-	log.Printf("[server] server started on %s:%d", s.serverAddr.IP.String(), s.serverAddr.Port)
-
-	return nil
-}
 
-func (s *Server) getInterfaceAddress(interfaceName string) (*net.UDPAddr, error) {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return nil, fmt.Errorf("error with getting interfaces: %v", err)
+	s.announceConn = announcePacketConn(serverConn)
+	if s.announceConn == nil {
+		log.Printf("[server] no multicast on %s, announcements are disabled", localAddr.String())
 	}
 
-	for _, iface := range interfaces {
-		log.Printf("found interface: %s", iface.Name)
-		if iface.Name == interfaceName {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				return nil, fmt.Errorf("error getting addresses for interface %s: %v", interfaceName, err)
-			}
+	s.startThreads()
 
-			for _, addr := range addrs {
-				switch v := addr.(type) {
-				case *net.IPNet:
-					if v.IP.To4() != nil {
-						return &net.UDPAddr{IP: v.IP}, nil
-					}
-				}
-			}
-		}
-	}
+	log.Printf("[server] server started on %s", s.serverAddr.String())
 
-	return nil, fmt.Errorf("interface not found: %s", interfaceName)
+	return nil
 }
 
 func (s *Server) startThreads() {
@@ -123,6 +174,9 @@ func (s *Server) startThreads() {
 	ctx, canc := context.WithCancel(context.Background())
 	s.cancel = canc
 
+	s.reliable = newReliable("server", s.pingDelay*time.Millisecond, s.waitDelay*time.Millisecond, s.sendData)
+	s.reliable.startResendThread(ctx)
+
 	s.startAnnouncementSendThread(ctx)
 	s.startListenerThread(ctx)
 	s.startGameLoopThread(ctx)
@@ -130,6 +184,10 @@ func (s *Server) startThreads() {
 }
 
 func (s *Server) startAnnouncementSendThread(ctx context.Context) {
+	if s.announceConn == nil {
+		return
+	}
+
 	go func() {
 		for {
 			select {
@@ -138,15 +196,19 @@ func (s *Server) startAnnouncementSendThread(ctx context.Context) {
 			default:
 				announcementMsg := s.createAnnouncementMessage()
 
-				err := s.sendGameMessage(announcementMsg, MulticastAddress, MulticastPort)
+				data, err := proto.Marshal(announcementMsg)
+				if err == nil {
+					err = s.sendAnnouncement(data)
+				}
 				if err != nil {
 					log.Printf("[server] announcement send error: %v", err)
+					time.Sleep(s.announceDelay)
 					break
 				}
 
 				log.Printf("[server] sent announcement message, players count: %d", len(s.players))
 
-				time.Sleep(AnnouncementDelay * time.Millisecond)
+				time.Sleep(s.announceDelay)
 			}
 		}
 	}()
@@ -154,13 +216,13 @@ func (s *Server) startAnnouncementSendThread(ctx context.Context) {
 
 func (s *Server) startListenerThread(ctx context.Context) {
 	go func() {
-		buffer := make([]byte, 4096)
+		buffer := make([]byte, MaxDatagramSize)
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
-				n, addr, err := s.serverConn.ReadFromUDP(buffer)
+				n, addr, err := s.serverConn.ReadFrom(buffer)
 				if err != nil {
 					log.Printf("[server] Error reading from UDP: %v", err)
 					continue
@@ -190,12 +252,13 @@ func (s *Server) startGameLoopThread(ctx context.Context) {
 
 				s.game.Update()
 
+				s.removeDeadRobots()
+				s.demoteDeadPlayers()
 				s.updateDeputyId()
 				s.updatePlayersScore()
 				err := s.sendStateForAll()
 				if err != nil {
-					log.Printf("[server] Game loop destroyed: %v", err)
-					break
+					log.Printf("[server] failed to send state: %v", err)
 				}
 			}
 		}
@@ -215,9 +278,13 @@ func (s *Server) startPingCheckerThread(ctx context.Context) {
 				now := time.Now()
 
 				for _, player := range s.players {
+					if isRobot(player) {
+						continue
+					}
 					playerId := int(*player.Id)
 					if now.Sub(s.lastPing[playerId]) > s.waitDelay*time.Millisecond {
 						log.Printf("[server] player %d doesnt active, removing (last ping %s, now %s)", playerId, s.lastPing[playerId], now)
+						s.reliable.forget(s.getAddrById(playerId))
 						s.removePlayerWithoutSnake(playerId)
 					}
 				}
@@ -229,14 +296,40 @@ func (s *Server) startPingCheckerThread(ctx context.Context) {
 }
 
 func (s *Server) handleIncomingMessage(msg *protobuf.GameMessage, addr *net.UDPAddr) {
+	s.lockServer.Lock()
+	playerId := s.getIdByAddr(addr)
+	if playerId != -1 {
+		s.lastPing[playerId] = time.Now()
+	}
+	s.lockServer.Unlock()
+
+	switch msg.Type.(type) {
+	case *protobuf.GameMessage_Ack:
+		s.reliable.ack(addr, msg.GetMsgSeq())
+		if s.delta != nil && playerId != -1 {
+			s.delta.ack(playerId, msg.GetMsgSeq())
+		}
+		return
+	case *protobuf.GameMessage_Discover:
+		s.handleDiscover(addr)
+		return
+	}
+
+	if s.reliable.received(addr, msg.GetMsgSeq()) {
+		log.Printf("[server] duplicate message %d from %s", msg.GetMsgSeq(), addr.String())
+		if playerId != -1 {
+			s.sendAcknowledgeMessage(int32(playerId), msg.GetMsgSeq(), addr)
+		}
+		return
+	}
+
 	switch t := msg.Type.(type) {
 	case *protobuf.GameMessage_Join:
 		s.handleJoinMessage(*msg.MsgSeq, t.Join, addr)
-	case *protobuf.GameMessage_Ack:
 	case *protobuf.GameMessage_Ping:
-		s.handlePing(addr)
+		s.handlePing(msg.GetMsgSeq(), addr)
 	case *protobuf.GameMessage_Steer:
-		s.handleSteer(*msg.GetSteer().Direction, addr)
+		s.handleSteer(msg.GetMsgSeq(), *msg.GetSteer().Direction, addr)
 	case *protobuf.GameMessage_RoleChange:
 		s.handleRoleChange(msg, addr)
 	case *protobuf.GameMessage_Error:
@@ -246,48 +339,109 @@ func (s *Server) handleIncomingMessage(msg *protobuf.GameMessage, addr *net.UDPA
 	}
 }
 
+// handleJoinMessage registers the player and places its snake in one
+// critical section, the game loop never sees a player without its snake.
 func (s *Server) handleJoinMessage(msgSeq int64, join *protobuf.GameMessage_JoinMsg, addr *net.UDPAddr) {
 
 	log.Printf("[server] join message received from %s:%d", addr.IP.String(), addr.Port)
 
-	if len(s.players) > maxPlayersCount {
+	s.lockServer.Lock()
+	if playerId := s.getIdByAddr(addr); playerId != -1 {
+		s.lockServer.Unlock()
+		s.handleRejoin(msgSeq, playerId, join, addr)
+		return
+	}
+
+	if len(s.players) >= maxPlayersCount {
+		s.lockServer.Unlock()
 		log.Printf("[server] max players reached")
 		s.sendError("max players count reached", addr)
 		return
 	}
 
-	playerId := s.addNewPlayer(join.GetPlayerName(), addr.IP.String(), addr.Port, join.GetRequestedRole().Enum())
+	viewer := join.GetRequestedRole() == protobuf.NodeRole_VIEWER
+	playerId := s.addPlayer(join.GetPlayerName(), addr.IP.String(), addr.Port, join.GetRequestedRole().Enum(), join.GetPlayerType())
+	if !viewer {
+		err := s.game.AddSnake(playerId)
+		if err != nil {
+			s.removePlayer(playerId)
+			s.lockServer.Unlock()
+			log.Printf("[server] failed to add snake: %v", err)
+			s.sendError("no space for snake", addr)
+			return
+		}
+	}
+	s.lockServer.Unlock()
 
-	if join.GetRequestedRole() == protobuf.NodeRole_VIEWER {
-		s.sendAcknowledgeMessage(int32(playerId), msgSeq, addr)
+	if s.delta != nil && supportsDelta(join) {
+		s.delta.enable(playerId)
+	}
+
+	s.sendAcknowledgeMessage(int32(playerId), msgSeq, addr)
+
+	if viewer {
 		log.Printf("[server] viewer joined the game")
+	} else {
+		log.Printf("[server] player %s joined the game", join.GetPlayerName())
+	}
+}
+
+// handleRejoin lets a viewer that is already in the game become a player by
+// sending another join, if there is room for its snake. The master whose
+// snake died joins again the same way but stays the master.
+func (s *Server) handleRejoin(msgSeq int64, playerId int, join *protobuf.GameMessage_JoinMsg, addr *net.UDPAddr) {
+	s.lockServer.Lock()
+	var player *protobuf.GamePlayer
+	for _, p := range s.players {
+		if int(p.GetId()) == playerId {
+			player = p
+		}
+	}
+
+	deadMaster := playerId == s.masterId && s.game.Field().SnakeById(playerId) == nil
+	if (player.GetRole() != protobuf.NodeRole_VIEWER && !deadMaster) || join.GetRequestedRole() == protobuf.NodeRole_VIEWER {
+		s.lockServer.Unlock()
+		s.sendAcknowledgeMessage(int32(playerId), msgSeq, addr)
 		return
 	}
 
 	err := s.game.AddSnake(playerId)
 	if err != nil {
-		s.removePlayer(playerId)
-		log.Printf("[server] failed to add snake: %v", err)
+		s.lockServer.Unlock()
+		log.Printf("[server] viewer %d cannot become a player: %v", playerId, err)
 		s.sendError("no space for snake", addr)
 		return
 	}
 
+	if !deadMaster {
+		s.changePlayerRole(playerId, protobuf.NodeRole_NORMAL)
+	}
+	s.lockServer.Unlock()
+
 	s.sendAcknowledgeMessage(int32(playerId), msgSeq, addr)
+	log.Printf("[server] player %d got a new snake", playerId)
+}
 
-	s.lastPing[playerId] = time.Now()
+func (s *Server) handleDiscover(addr *net.UDPAddr) {
+	log.Printf("[server] discover received from %s", addr.String())
 
-	log.Printf("[server] player %s joined the game", join.GetPlayerName())
+	announcementMsg := s.createAnnouncementMessage()
+	err := s.sendGameMessage(announcementMsg, addr.IP.String(), addr.Port)
+	if err != nil {
+		log.Printf("[server] failed to answer discover: %v", err)
+	}
 }
 
-func (s *Server) handlePing(addr *net.UDPAddr) {
+func (s *Server) handlePing(msgSeq int64, addr *net.UDPAddr) {
 	playerId := s.getIdByAddr(addr)
+	if playerId == -1 {
+		return
+	}
 
-	s.lockServer.Lock()
-	s.lastPing[playerId] = time.Now()
-	s.lockServer.Unlock()
+	s.sendAcknowledgeMessage(int32(playerId), msgSeq, addr)
 }
 
-func (s *Server) handleSteer(direction protobuf.Direction, addr *net.UDPAddr) {
+func (s *Server) handleSteer(msgSeq int64, direction protobuf.Direction, addr *net.UDPAddr) {
 	playerId := s.getIdByAddr(addr)
 
 	if playerId == -1 {
@@ -297,7 +451,7 @@ func (s *Server) handleSteer(direction protobuf.Direction, addr *net.UDPAddr) {
 
 	s.game.UpdateSnakeDirection(playerId, direction)
 
-	s.lastPing[playerId] = time.Now()
+	s.sendAcknowledgeMessage(int32(playerId), msgSeq, addr)
 	log.Printf("[server] received steer from %s:%d", addr.IP.String(), addr.Port)
 }
 
@@ -309,6 +463,7 @@ func (s *Server) handleRoleChange(msg *protobuf.GameMessage, addr *net.UDPAddr)
 
 	if senderRole == protobuf.NodeRole_VIEWER {
 		s.makePlayerViewer(int(msg.GetSenderId()))
+		s.game.MakeZombie(int(msg.GetSenderId()))
 	}
 
 	s.sendAcknowledgeMessage(msg.GetSenderId(), msg.GetMsgSeq(), addr)
@@ -339,7 +494,11 @@ func (s *Server) sendPings() error {
 	}
 
 	for _, player := range s.players {
-		s.sendGameMessage(pingMsg, player.GetIpAddress(), int(player.GetPort()))
+		if isRobot(player) {
+			continue
+		}
+		addr := &net.UDPAddr{IP: net.ParseIP(player.GetIpAddress()), Port: int(player.GetPort())}
+		s.sendTrackedMessage(pingMsg, addr)
 	}
 
 	return nil
@@ -371,8 +530,11 @@ func (s *Server) sendRoleChange(receiverRole protobuf.NodeRole, receiverId int)
 		},
 	}
 	receiver := s.getAddrById(receiverId)
+	if receiver == nil {
+		return fmt.Errorf("no player with id %d", receiverId)
+	}
 	log.Printf("[server] role change receiver: id: %d, addr: %s:%d", receiverId, receiver.IP.String(), receiver.Port)
-	err := s.sendGameMessage(roleChangeMsg, receiver.IP.String(), receiver.Port)
+	err := s.sendTrackedMessage(roleChangeMsg, receiver)
 	return err
 }
 
@@ -402,41 +564,97 @@ func (s *Server) createAnnouncementMessage() *protobuf.GameMessage {
 
 func (s *Server) sendStateForAll() error {
 	gameState := s.createGameState()
+	if s.recorder != nil {
+		s.recorder.State(gameState.GetState().GetState())
+	}
 
-	for _, player := range s.players {
-		err := s.sendGameMessage(gameState, *player.IpAddress, int(*player.Port))
+	state := gameState.GetState().GetState()
+
+	// the same bytes go to every player, marshal them once
+	data, err := proto.Marshal(gameState)
+	if err != nil {
+		return fmt.Errorf("failed to marshal game state: %v", err)
+	}
+	if len(data) > MaxDatagramSize {
+		return fmt.Errorf("state %d takes %d bytes, a datagram holds %d", state.GetStateOrder(), len(data), MaxDatagramSize)
+	}
+
+	// deltas by base state order, players that acked the same state share one
+	deltas := make(map[int32][]byte)
+	if s.delta != nil {
+		s.delta.remember(gameState.GetMsgSeq(), state)
+	}
+
+	// the ping checker removes players meanwhile, it replaces the slice
+	s.lockServer.Lock()
+	players := s.players
+	s.lockServer.Unlock()
+
+	for _, player := range players {
+		if isRobot(player) {
+			continue
+		}
+
+		playerData := data
+		if s.delta != nil {
+			if base := s.delta.base(int(player.GetId())); base != nil {
+				playerData = s.deltaData(deltas, gameState.GetMsgSeq(), base, state, data)
+			}
+		}
+
+		addr := &net.UDPAddr{IP: net.ParseIP(player.GetIpAddress()), Port: int(player.GetPort())}
+		err := s.sendData(playerData, addr)
 		if err != nil {
 			log.Printf("[server] failed to send game message to player %s:%d: %s", *player.IpAddress, int(*player.Port), err.Error())
 			continue
 		}
-		log.Printf("[server] send state for player %d", *player.Id)
+		log.Printf("[server] send state for player %d (%d bytes)", *player.Id, len(playerData))
 	}
 
 	return nil
 }
 
-func (s *Server) createGameState() *protobuf.GameMessage {
-	stateId := s.incrementStateId()
-	field := s.game.Field()
-
-	state := &protobuf.GameState{
-		StateOrder: proto.Int32(int32(stateId)),
+// deltaData encodes the state against base, full is used when the delta
+// does not come out smaller.
+func (s *Server) deltaData(deltas map[int32][]byte, msgSeq int64, base *protobuf.GameState, state *protobuf.GameState, full []byte) []byte {
+	if data, ok := deltas[base.GetStateOrder()]; ok {
+		return data
 	}
 
-	var snakes []*protobuf.GameState_Snake
-	for _, snake := range field.Snakes() {
-		snakes = append(snakes, game.GenerateSnakeProto(snake, field.Width(), field.Height()))
+	deltaMsg := &protobuf.GameMessage{
+		MsgSeq: proto.Int64(msgSeq),
+		Type: &protobuf.GameMessage_State{
+			State: &protobuf.GameMessage_StateMsg{
+				State: makeDelta(base, state),
+			},
+		},
 	}
+	data, err := proto.Marshal(deltaMsg)
+	if err != nil || len(data) >= len(full) {
+		data = full
+	}
+	deltas[base.GetStateOrder()] = data
+	return data
+}
 
-	state.Snakes = snakes
-
-	state.Foods = append(state.Foods, s.game.Field().Foods()...)
+func (s *Server) createGameState() *protobuf.GameMessage {
+	stateId := s.incrementStateId()
 
 	players := &protobuf.GamePlayers{
 		Players: s.getPlayerList(),
 	}
 
-	state.Players = players
+	state := s.game.State(int32(stateId), players)
+	s.lockServer.Lock()
+	setNextPlayerId(state, s.uniqueId)
+	levels := make(map[int]game.Difficulty)
+	for _, player := range s.players {
+		if difficulty, ok := s.game.RobotDifficulty(int(player.GetId())); ok && isRobot(player) {
+			levels[int(player.GetId())] = difficulty
+		}
+	}
+	game.SetRobotLevels(state, levels)
+	s.lockServer.Unlock()
 
 	stateMsg := &protobuf.GameMessage{
 		MsgSeq: proto.Int64(s.incrementMsgSeq()),
@@ -455,13 +673,16 @@ func (s *Server) sendGameMessage(message *protobuf.GameMessage, address string,
 	if err != nil {
 		return fmt.Errorf("failed to marshal game message: %v", err)
 	}
+	if len(data) > MaxDatagramSize {
+		return fmt.Errorf("game message takes %d bytes, a datagram holds %d", len(data), MaxDatagramSize)
+	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", address, port))
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(address, strconv.Itoa(port)))
 	if err != nil {
 		return fmt.Errorf("failed to resolve UDP address: %v", err)
 	}
 
-	_, err = s.serverConn.WriteToUDP(data, udpAddr)
+	_, err = s.serverConn.WriteTo(data, udpAddr)
 	if err != nil {
 		return fmt.Errorf("failed to send game message: %v", err)
 	}
@@ -469,10 +690,33 @@ func (s *Server) sendGameMessage(message *protobuf.GameMessage, address string,
 	return nil
 }
 
+// sendTrackedMessage sends a message that has to be acknowledged, the
+// reliable layer resends it until the ack arrives.
+func (s *Server) sendTrackedMessage(message *protobuf.GameMessage, addr *net.UDPAddr) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal game message: %v", err)
+	}
+
+	s.reliable.track(addr, message.GetMsgSeq(), data)
+	return s.sendData(data, addr)
+}
+
+func (s *Server) sendData(data []byte, addr *net.UDPAddr) error {
+	_, err := s.serverConn.WriteTo(data, addr)
+	if err != nil {
+		return fmt.Errorf("failed to send game message: %v", err)
+	}
+	return nil
+}
+
 func (s *Server) updateDeputyId() {
+	s.lockServer.Lock()
+	defer s.lockServer.Unlock()
+
 	deputyId := 666
 	for _, player := range s.players {
-		if deputyId > int(player.GetId()) && player.GetRole() != protobuf.NodeRole_VIEWER && player.GetRole() != protobuf.NodeRole_MASTER {
+		if deputyId > int(player.GetId()) && player.GetRole() != protobuf.NodeRole_VIEWER && player.GetRole() != protobuf.NodeRole_MASTER && !isRobot(player) {
 			deputyId = int(player.GetId())
 		}
 	}
@@ -486,10 +730,14 @@ func (s *Server) updateDeputyId() {
 
 }
 
-func (s *Server) addNewPlayer(playerName string, address string, port int, role *protobuf.NodeRole) int {
+func (s *Server) addNewPlayer(playerName string, address string, port int, role *protobuf.NodeRole, playerType protobuf.PlayerType) int {
 	s.lockServer.Lock()
 	defer s.lockServer.Unlock()
+	return s.addPlayer(playerName, address, port, role, playerType)
+}
 
+// addPlayer is addNewPlayer for callers that hold lockServer.
+func (s *Server) addPlayer(playerName string, address string, port int, role *protobuf.NodeRole, playerType protobuf.PlayerType) int {
 	playerId := s.uniqueId
 	s.uniqueId++
 
@@ -499,7 +747,7 @@ func (s *Server) addNewPlayer(playerName string, address string, port int, role
 		IpAddress: proto.String(address),
 		Port:      proto.Int32(int32(port)),
 		Role:      role,
-		Type:      protobuf.Default_GamePlayer_Type.Enum(),
+		Type:      playerType.Enum(),
 		Score:     proto.Int32(0),
 	}
 
@@ -522,6 +770,45 @@ func (s *Server) removePlayer(playerId int) {
 	s.game.RemoveSnake(playerId)
 }
 
+func (s *Server) removeDeadRobots() {
+	s.lockServer.Lock()
+	defer s.lockServer.Unlock()
+
+	for _, player := range s.players {
+		if isRobot(player) && s.game.Field().SnakeById(int(player.GetId())) == nil {
+			log.Printf("[server] robot %d died", player.GetId())
+			s.removeViewer(int(player.GetId()))
+		}
+	}
+}
+
+// demoteDeadPlayers makes viewers of the players whose snake died and tells
+// them with a RoleChange. The master keeps its role, it still runs the game.
+func (s *Server) demoteDeadPlayers() {
+	s.lockServer.Lock()
+	defer s.lockServer.Unlock()
+
+	for _, player := range s.players {
+		playerId := int(player.GetId())
+		if isRobot(player) || player.GetRole() == protobuf.NodeRole_VIEWER || playerId == s.masterId {
+			continue
+		}
+		if s.game.Field().SnakeById(playerId) != nil {
+			continue
+		}
+
+		log.Printf("[server] snake of player %d died, now a viewer", playerId)
+		player.Role = protobuf.NodeRole_VIEWER.Enum()
+		if s.deputyId == playerId {
+			s.deputyId = -1
+		}
+		err := s.sendRoleChange(protobuf.NodeRole_VIEWER, playerId)
+		if err != nil {
+			log.Printf("[server] failed to send role change to player %d: %v", playerId, err)
+		}
+	}
+}
+
 func (s *Server) removePlayerWithoutSnake(playerId int) {
 	newPlayers := make([]*protobuf.GamePlayer, 0, len(s.players))
 
@@ -536,6 +823,10 @@ func (s *Server) removePlayerWithoutSnake(playerId int) {
 	}
 
 	s.players = newPlayers
+	s.game.MakeZombie(playerId)
+	if s.delta != nil {
+		s.delta.forget(playerId)
+	}
 }
 
 func (s *Server) removeViewer(playerId int) {
@@ -553,7 +844,7 @@ func (s *Server) removeViewer(playerId int) {
 func (s *Server) makePlayerViewer(playerId int) {
 
 	for _, player := range s.players {
-		if player.GetId() != int32(playerId) {
+		if player.GetId() == int32(playerId) {
 			player.Role = protobuf.NodeRole_VIEWER.Enum()
 		}
 	}
@@ -580,14 +871,26 @@ func (s *Server) changePlayerRole(playerId int, role protobuf.NodeRole) {
 
 func (s *Server) Stop() error {
 	log.Println("[server] stopping")
-	log.Printf("[server] master id: %d, deputy id: %d", s.masterId, s.deputyId)
-	if len(s.players) != 1 {
-		err := s.sendRoleChange(protobuf.NodeRole_MASTER, s.deputyId)
+	s.lockServer.Lock()
+	deputyId := s.deputyId
+	deputyAddr := s.getAddrById(deputyId)
+	s.lockServer.Unlock()
+	log.Printf("[server] master id: %d, deputy id: %d", s.masterId, deputyId)
+	if deputyId != -1 && deputyAddr != nil {
+		err := s.sendRoleChange(protobuf.NodeRole_MASTER, deputyId)
 		if err != nil {
 			log.Printf("[server] failed to send role change to master: %v", err)
+		} else {
+			s.reliable.flush(s.waitDelay * time.Millisecond)
 		}
 	}
 	s.cancel()
+	if s.recorder != nil {
+		err := s.recorder.Close()
+		if err != nil {
+			log.Printf("[server] failed to close replay: %v", err)
+		}
+	}
 	return s.serverConn.Close()
 }
 
@@ -596,7 +899,7 @@ func (s *Server) GameName() string {
 }
 
 func (s *Server) ServerAddr() *net.UDPAddr {
-	return s.serverAddr
+	return reachableAddr(s.serverAddr)
 }
 
 func (s *Server) GameConfig() *protobuf.GameConfig {
@@ -611,10 +914,19 @@ func (s *Server) getPlayerList() []*protobuf.GamePlayer {
 	return s.players
 }
 
+// isRobot reports whether the player is a robot run by the master itself,
+// remote clients may also announce themselves as ROBOT but have an address.
+func isRobot(player *protobuf.GamePlayer) bool {
+	return player.GetType() == protobuf.PlayerType_ROBOT && player.GetIpAddress() == ""
+}
+
 func (s *Server) getIdByAddr(addr *net.UDPAddr) int {
 	var playerId int
 	for _, player := range s.players {
-		if *player.IpAddress == addr.IP.String() && *player.Port == int32(addr.Port) {
+		if isRobot(player) {
+			continue
+		}
+		if player.GetIpAddress() == addr.IP.String() && player.GetPort() == int32(addr.Port) {
 			playerId = int(*player.Id)
 			return playerId
 		}
@@ -624,16 +936,18 @@ func (s *Server) getIdByAddr(addr *net.UDPAddr) int {
 
 func (s *Server) getAddrById(playerId int) *net.UDPAddr {
 	for _, player := range s.players {
-		if int(player.GetId()) == playerId {
+		if int(player.GetId()) == playerId && !isRobot(player) {
 			return &net.UDPAddr{IP: net.ParseIP(player.GetIpAddress()), Port: int(player.GetPort())}
 		}
 	}
 	return nil
 }
 
+// incrementMsgSeq hands out the next sequence number, the game loop, the
+// announcements and the pings take them concurrently and a client drops a
+// message whose number it has already seen.
 func (s *Server) incrementMsgSeq() int64 {
-	s.msgSeq++
-	return s.msgSeq
+	return atomic.AddInt64(&s.msgSeq, 1)
 }
 
 func (s *Server) incrementStateId() int {
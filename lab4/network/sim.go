@@ -0,0 +1,343 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	simFirstPort = 40000
+	// simQueueSize is how many datagrams wait in a simulated socket, the
+	// rest is dropped like by a full kernel buffer.
+	simQueueSize = 1024
+)
+
+// SimNetwork connects nodes of one process through memory instead of UDP.
+// Every node gets a host address from Host, datagrams between different
+// hosts get the latency, loss, duplication and reordering set on the
+// network and do not pass between partitioned or isolated hosts. Datagrams
+// inside one host, a master and its own client, are delivered at once.
+type SimNetwork struct {
+	lock       *sync.Mutex
+	rng        *rand.Rand
+	sockets    map[string]*simConn
+	nextPort   int
+	latency    time.Duration
+	jitter     time.Duration
+	loss       float64
+	duplicate  float64
+	reorder    float64
+	partitions map[[2]string]bool
+	isolated   map[string]bool
+	stats      SimStats
+}
+
+// SimStats counts what happened to the datagrams sent between hosts.
+type SimStats struct {
+	Sent       int
+	Delivered  int
+	Lost       int
+	Blocked    int
+	Duplicated int
+	Reordered  int
+}
+
+type simPacket struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+// NewSimNetwork creates a network without faults, the seed makes the
+// faults repeatable as far as the timing of the nodes allows.
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		lock:       new(sync.Mutex),
+		rng:        rand.New(rand.NewSource(seed)),
+		sockets:    make(map[string]*simConn),
+		nextPort:   simFirstPort,
+		partitions: make(map[[2]string]bool),
+		isolated:   make(map[string]bool),
+	}
+}
+
+// SetLatency delays every datagram by latency plus a random part of jitter.
+func (n *SimNetwork) SetLatency(latency time.Duration, jitter time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.latency = latency
+	n.jitter = jitter
+}
+
+// SetLoss drops the given fraction of datagrams.
+func (n *SimNetwork) SetLoss(fraction float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.loss = fraction
+}
+
+// SetDuplicate delivers the given fraction of datagrams twice.
+func (n *SimNetwork) SetDuplicate(fraction float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.duplicate = fraction
+}
+
+// SetReorder holds the given fraction of datagrams back long enough for
+// the next ones to overtake them.
+func (n *SimNetwork) SetReorder(fraction float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.reorder = fraction
+}
+
+// Partition stops datagrams between two hosts in both directions.
+func (n *SimNetwork) Partition(a string, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.partitions[hostPair(a, b)] = true
+}
+
+// Heal undoes Partition.
+func (n *SimNetwork) Heal(a string, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.partitions, hostPair(a, b))
+}
+
+// Isolate cuts the host off from all others, for the rest of the network
+// it looks like the node crashed.
+func (n *SimNetwork) Isolate(host string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.isolated[host] = true
+}
+
+// Reconnect undoes Isolate.
+func (n *SimNetwork) Reconnect(host string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.isolated, host)
+}
+
+func (n *SimNetwork) Stats() SimStats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.stats
+}
+
+// Host returns the transport of a node with the given IP address.
+func (n *SimNetwork) Host(ip string) Transport {
+	return &simHost{network: n, ip: net.ParseIP(ip)}
+}
+
+func hostPair(a string, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+func (n *SimNetwork) bind(ip net.IP, port int) (*simConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if port == 0 {
+		for n.sockets[simKey(ip, n.nextPort)] != nil {
+			n.nextPort++
+		}
+		port = n.nextPort
+		n.nextPort++
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	key := addr.String()
+	if n.sockets[key] != nil {
+		return nil, fmt.Errorf("listen %s: address already in use", key)
+	}
+
+	conn := &simConn{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan simPacket, simQueueSize),
+		lock:    new(sync.Mutex),
+		closed:  make(chan struct{}),
+	}
+	n.sockets[key] = conn
+	return conn, nil
+}
+
+func (n *SimNetwork) unbind(conn *simConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.sockets[conn.addr.String()] == conn {
+		delete(n.sockets, conn.addr.String())
+	}
+}
+
+func (n *SimNetwork) send(from *net.UDPAddr, to *net.UDPAddr, data []byte) {
+	packet := simPacket{from: from, data: append([]byte(nil), data...)}
+
+	if from.IP.Equal(to.IP) {
+		n.deliver(to, packet)
+		return
+	}
+
+	n.lock.Lock()
+	n.stats.Sent++
+	fromHost, toHost := from.IP.String(), to.IP.String()
+	if n.isolated[fromHost] || n.isolated[toHost] || n.partitions[hostPair(fromHost, toHost)] {
+		n.stats.Blocked++
+		n.lock.Unlock()
+		return
+	}
+	if n.rng.Float64() < n.loss {
+		n.stats.Lost++
+		n.lock.Unlock()
+		return
+	}
+
+	copies := 1
+	if n.rng.Float64() < n.duplicate {
+		n.stats.Duplicated++
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = n.latency
+		if n.jitter > 0 {
+			delays[i] += time.Duration(n.rng.Int63n(int64(n.jitter)))
+		}
+		if n.rng.Float64() < n.reorder {
+			n.stats.Reordered++
+			delays[i] += n.latency + n.jitter + time.Millisecond
+		}
+	}
+	n.lock.Unlock()
+
+	for _, delay := range delays {
+		if delay == 0 {
+			n.deliver(to, packet)
+			continue
+		}
+		time.AfterFunc(delay, func() {
+			n.deliver(to, packet)
+		})
+	}
+}
+
+func (n *SimNetwork) deliver(to *net.UDPAddr, packet simPacket) {
+	n.lock.Lock()
+	conn := n.sockets[to.String()]
+	if conn != nil && !packet.from.IP.Equal(to.IP) {
+		n.stats.Delivered++
+	}
+	n.lock.Unlock()
+
+	if conn == nil {
+		return
+	}
+	select {
+	case conn.inbox <- packet:
+	default:
+	}
+}
+
+func simKey(ip net.IP, port int) string {
+	return (&net.UDPAddr{IP: ip, Port: port}).String()
+}
+
+type simHost struct {
+	network *SimNetwork
+	ip      net.IP
+}
+
+func (h *simHost) Listen(addr *net.UDPAddr) (Conn, error) {
+	port := 0
+	if addr != nil {
+		if err := h.checkIP(addr.IP); err != nil {
+			return nil, err
+		}
+		port = addr.Port
+	}
+	return h.network.bind(h.ip, port)
+}
+
+// checkIP accepts the address of the host and the unspecified one.
+func (h *simHost) checkIP(ip net.IP) error {
+	if ip == nil || ip.IsUnspecified() || ip.Equal(h.ip) {
+		return nil
+	}
+	return fmt.Errorf("host %s has no address %s", h.ip, ip)
+}
+
+type simConn struct {
+	network   *SimNetwork
+	addr      *net.UDPAddr
+	inbox     chan simPacket
+	lock      *sync.Mutex
+	deadline  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *simConn) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	c.lock.Lock()
+	deadline := c.deadline
+	c.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-c.inbox:
+		return copy(b, packet.data), packet.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *simConn) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(b) > MaxDatagramSize {
+		return 0, fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+	c.network.send(c.addr, addr, b)
+	return len(b), nil
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *simConn) SetReadBuffer(bytes int) error {
+	return nil
+}
+
+func (c *simConn) LocalAddr() *net.UDPAddr {
+	return c.addr
+}
+
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.unbind(c)
+	})
+	return nil
+}
@@ -0,0 +1,571 @@
+package network
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"snake_game/game"
+	"snake_game/protobuf"
+	"testing"
+	"time"
+)
+
+const (
+	simGameName = "sim"
+	simWidth    = 60
+	simHeight   = 40
+	simDelayMS  = 200
+
+	simMasterHost = "10.0.0.1"
+)
+
+// faults of the simulated network a scenario runs with.
+type faults struct {
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	duplicate float64
+	reorder   float64
+}
+
+var lossy = faults{latency: 20 * time.Millisecond, jitter: 10 * time.Millisecond, loss: 0.2, duplicate: 0.1, reorder: 0.1}
+
+// scenario starts a master and the listed nodes on a fresh network and
+// checks what happens.
+type scenario struct {
+	name   string
+	faults faults
+	// roles of the nodes joining after the master, on hosts 10.0.0.2 and on
+	nodes []protobuf.NodeRole
+	run   func(c *cluster) error
+}
+
+var scenarios = []scenario{
+	{
+		name:  "players and a viewer join and get states",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL, protobuf.NodeRole_VIEWER},
+		run:   checkJoined,
+	},
+	{
+		name:  "steer reaches the master",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL},
+		run:   checkSteer,
+	},
+	{
+		name:  "viewer becomes a player",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_VIEWER},
+		run:   checkPlay,
+	},
+	{
+		name:  "leaving player keeps its snake as a zombie",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL},
+		run:   checkLeave,
+	},
+	{
+		name:   "join and steer on a lossy network",
+		faults: lossy,
+		nodes:  []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL, protobuf.NodeRole_VIEWER},
+		run: func(c *cluster) error {
+			if err := checkJoined(c); err != nil {
+				return err
+			}
+			return checkSteer(c)
+		},
+	},
+	{
+		name:  "deputy takes over when the master crashes",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL},
+		run: func(c *cluster) error {
+			return checkFailover(c, func(master *node) { c.sim.Isolate(master.host) })
+		},
+	},
+	{
+		name:  "deputy takes over when the master leaves",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL},
+		run: func(c *cluster) error {
+			return checkFailover(c, func(master *node) { master.client.Stop() })
+		},
+	},
+	{
+		name:   "deputy takes over on a lossy network",
+		faults: lossy,
+		nodes:  []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL},
+		run: func(c *cluster) error {
+			return checkFailover(c, func(master *node) { c.sim.Isolate(master.host) })
+		},
+	},
+	{
+		name:  "short partition does not drop a player",
+		nodes: []protobuf.NodeRole{protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL},
+		run:   checkShortPartition,
+	},
+}
+
+var simSeed = flag.Int64("sim.seed", 1, "seed of the network faults and of the game")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// TestScenarios runs every scenario on a fresh network. The nodes share
+// state between their goroutines, run it with -race as well.
+func TestScenarios(t *testing.T) {
+	for _, s := range scenarios {
+		t.Run(s.name, func(t *testing.T) {
+			sim := NewSimNetwork(*simSeed)
+			sim.SetLatency(s.faults.latency, s.faults.jitter)
+			sim.SetLoss(s.faults.loss)
+			sim.SetDuplicate(s.faults.duplicate)
+			sim.SetReorder(s.faults.reorder)
+
+			c := &cluster{sim: sim}
+			t.Cleanup(c.stop)
+
+			if err := c.startMaster(*simSeed); err != nil {
+				t.Fatal(err)
+			}
+			for i, role := range s.nodes {
+				if _, err := c.join(fmt.Sprintf("10.0.0.%d", i+2), role); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.run(c); err != nil {
+				stats := sim.Stats()
+				t.Fatalf("%v (%d datagrams, %d lost, %d blocked, %d duplicated, %d reordered)",
+					err, stats.Sent, stats.Lost, stats.Blocked, stats.Duplicated, stats.Reordered)
+			}
+		})
+	}
+}
+
+// TestSimNetworkConcurrent opens, uses and closes sockets of several hosts
+// while the faults change, like the nodes of a scenario do, for -race.
+func TestSimNetworkConcurrent(t *testing.T) {
+	sim := NewSimNetwork(*simSeed)
+	sim.SetLatency(time.Millisecond, time.Millisecond)
+	sim.SetDuplicate(0.1)
+	sim.SetReorder(0.1)
+
+	const hosts, rounds = 4, 50
+	stop := make(chan struct{})
+	faultsDone := make(chan struct{})
+	go func() {
+		defer close(faultsDone)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			a, b := fmt.Sprintf("10.0.0.%d", i%hosts+1), fmt.Sprintf("10.0.0.%d", (i+1)%hosts+1)
+			sim.Partition(a, b)
+			sim.SetLoss(0.1)
+			sim.Heal(a, b)
+			sim.Isolate(a)
+			sim.Reconnect(a)
+			sim.Stats()
+		}
+	}()
+
+	errs := make(chan error, hosts)
+	for h := 0; h < hosts; h++ {
+		go func(h int) {
+			host := sim.Host(fmt.Sprintf("10.0.0.%d", h+1))
+			peer := &net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("10.0.0.%d", (h+1)%hosts+1)), Port: simFirstPort}
+			buffer := make([]byte, MaxDatagramSize)
+			for i := 0; i < rounds; i++ {
+				conn, err := host.Listen(nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// a reader blocked on the socket while it is closed, like the
+				// listen goroutine of a client that takes over
+				done := make(chan error, 1)
+				go func() {
+					for {
+						if _, _, err := conn.ReadFrom(buffer); err != nil {
+							done <- err
+							return
+						}
+					}
+				}()
+				conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+				if _, err := conn.WriteTo([]byte("ping"), peer); err != nil {
+					errs <- err
+					return
+				}
+				conn.Close()
+				if err := <-done; !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+					errs <- fmt.Errorf("read on a closed socket returned %v", err)
+					return
+				}
+				if _, err := conn.WriteTo([]byte("ping"), peer); !errors.Is(err, net.ErrClosed) {
+					errs <- fmt.Errorf("write on a closed socket returned %v", err)
+					return
+				}
+			}
+			errs <- nil
+		}(h)
+	}
+
+	for h := 0; h < hosts; h++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	<-faultsDone
+}
+
+// node is one process of the game: a client, and a server on the master.
+type node struct {
+	host   string
+	name   string
+	client *Client
+	server *Server
+}
+
+// cluster is the running game, nodes are the ones still in it with the
+// master first.
+type cluster struct {
+	sim    *SimNetwork
+	config *protobuf.GameConfig
+	// master is the address new nodes join at
+	master *net.UDPAddr
+	nodes  []*node
+	gone   []*node
+}
+
+func (c *cluster) startMaster(seed int64) error {
+	transport := c.sim.Host(simMasterHost)
+
+	server := NewServer(simGameName, simWidth, simHeight, 1, simDelayMS)
+	server.SetTransport(transport)
+	server.SetSeed(seed)
+	if err := server.Start(); err != nil {
+		return err
+	}
+
+	client, err := NewClientWithTransport(transport, server.ServerAddr(), "master", protobuf.NodeRole_MASTER)
+	if err != nil {
+		return err
+	}
+	if err := client.Start(simGameName, server.Game()); err != nil {
+		return err
+	}
+	client.SetServer(server)
+
+	c.config = server.GameConfig()
+	c.master = server.ServerAddr()
+	c.nodes = append(c.nodes, &node{host: simMasterHost, name: "master", client: client, server: server})
+	return nil
+}
+
+func (c *cluster) join(host string, role protobuf.NodeRole) (*node, error) {
+	name := fmt.Sprintf("node %s", host)
+
+	client, err := NewClientWithTransport(c.sim.Host(host), c.master, name, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Start(simGameName, game.NewGame(c.config)); err != nil {
+		return nil, fmt.Errorf("%s failed to join: %w", name, err)
+	}
+
+	n := &node{host: host, name: name, client: client}
+	c.nodes = append(c.nodes, n)
+	return n, nil
+}
+
+// leave takes the node out of the checks, it is stopped with the rest.
+func (c *cluster) leave(n *node) {
+	for i, other := range c.nodes {
+		if other == n {
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+		}
+	}
+	c.gone = append(c.gone, n)
+}
+
+func (c *cluster) stop() {
+	for _, n := range append(c.nodes, c.gone...) {
+		n.client.Stop()
+	}
+}
+
+// waitFor polls cond until it holds or timeout ticks of the game pass.
+func waitFor(ticks int, cond func() error) error {
+	deadline := time.Now().Add(time.Duration(ticks*simDelayMS) * time.Millisecond)
+	for {
+		err := cond()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func playerOf(state *protobuf.GameState, playerId int) *protobuf.GamePlayer {
+	for _, player := range state.GetPlayers().GetPlayers() {
+		if int(player.GetId()) == playerId {
+			return player
+		}
+	}
+	return nil
+}
+
+func snakeOf(state *protobuf.GameState, playerId int) *protobuf.GameState_Snake {
+	for _, snake := range state.GetSnakes() {
+		if int(snake.GetPlayerId()) == playerId {
+			return snake
+		}
+	}
+	return nil
+}
+
+// roleIn checks the role of the node in the newest state every node got.
+func (c *cluster) roleIn(n *node, role protobuf.NodeRole) error {
+	for _, other := range c.nodes {
+		state, _ := other.client.LastState()
+		if state == nil {
+			return fmt.Errorf("%s got no state", other.name)
+		}
+		player := playerOf(state, n.client.PlayerId())
+		if player == nil {
+			return fmt.Errorf("%s does not see %s in state %d", other.name, n.name, state.GetStateOrder())
+		}
+		if player.GetRole() != role {
+			return fmt.Errorf("%s sees %s as %s in state %d, want %s", other.name, n.name, player.GetRole(), state.GetStateOrder(), role)
+		}
+	}
+	return nil
+}
+
+// statesFlow checks that every node keeps getting new states.
+func (c *cluster) statesFlow() error {
+	orders := make([]int32, len(c.nodes))
+	for i, n := range c.nodes {
+		state, _ := n.client.LastState()
+		orders[i] = state.GetStateOrder()
+	}
+	return waitFor(5, func() error {
+		for i, n := range c.nodes {
+			state, _ := n.client.LastState()
+			if state.GetStateOrder() <= orders[i] {
+				return fmt.Errorf("%s is stuck at state %d", n.name, orders[i])
+			}
+		}
+		return nil
+	})
+}
+
+func checkJoined(c *cluster) error {
+	wantRoles := []protobuf.NodeRole{protobuf.NodeRole_MASTER, protobuf.NodeRole_DEPUTY, protobuf.NodeRole_NORMAL, protobuf.NodeRole_VIEWER}
+	err := waitFor(10, func() error {
+		for i, n := range c.nodes {
+			if err := c.roleIn(n, wantRoles[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.statesFlow()
+}
+
+func checkSteer(c *cluster) error {
+	player := c.nodes[1]
+	if err := waitFor(10, func() error { return c.roleIn(player, protobuf.NodeRole_DEPUTY) }); err != nil {
+		return err
+	}
+
+	state, _ := player.client.LastState()
+	snake := snakeOf(state, player.client.PlayerId())
+	if snake == nil {
+		return errors.New("player has no snake")
+	}
+	direction := protobuf.Direction_UP
+	if snake.GetHeadDirection() == protobuf.Direction_UP || snake.GetHeadDirection() == protobuf.Direction_DOWN {
+		direction = protobuf.Direction_LEFT
+	}
+	player.client.SendSteer(direction)
+
+	return waitFor(5, func() error {
+		state, _ := player.client.LastState()
+		if got := snakeOf(state, player.client.PlayerId()).GetHeadDirection(); got != direction {
+			return fmt.Errorf("snake goes %s after steer %s", got, direction)
+		}
+		return nil
+	})
+}
+
+func checkPlay(c *cluster) error {
+	viewer := c.nodes[2]
+	if err := waitFor(10, func() error { return c.roleIn(viewer, protobuf.NodeRole_VIEWER) }); err != nil {
+		return err
+	}
+
+	viewer.client.RequestPlay()
+	return waitFor(10, func() error {
+		if err := c.roleIn(viewer, protobuf.NodeRole_NORMAL); err != nil {
+			return err
+		}
+		state, _ := viewer.client.LastState()
+		if snakeOf(state, viewer.client.PlayerId()) == nil {
+			return errors.New("former viewer has no snake")
+		}
+		return nil
+	})
+}
+
+func checkLeave(c *cluster) error {
+	leaving := c.nodes[2]
+	if err := waitFor(10, func() error { return c.roleIn(leaving, protobuf.NodeRole_NORMAL) }); err != nil {
+		return err
+	}
+
+	playerId := leaving.client.PlayerId()
+	leaving.client.Stop()
+	c.leave(leaving)
+
+	return waitFor(10, func() error {
+		state, _ := c.nodes[0].client.LastState()
+		if playerOf(state, playerId) != nil {
+			return errors.New("player that left is still listed")
+		}
+		if snake := snakeOf(state, playerId); snake == nil || snake.GetState() != protobuf.GameState_Snake_ZOMBIE {
+			return errors.New("snake of the player that left is not a zombie")
+		}
+		return nil
+	})
+}
+
+func checkShortPartition(c *cluster) error {
+	player := c.nodes[2]
+	if err := waitFor(10, func() error { return c.roleIn(player, protobuf.NodeRole_NORMAL) }); err != nil {
+		return err
+	}
+
+	// shorter than the 0.8 state delay after which a silent node is dropped
+	c.sim.Partition(simMasterHost, player.host)
+	time.Sleep(simDelayMS * 4 / 10 * time.Millisecond)
+	c.sim.Heal(simMasterHost, player.host)
+
+	if err := c.statesFlow(); err != nil {
+		return err
+	}
+	return c.roleIn(player, protobuf.NodeRole_NORMAL)
+}
+
+// checkFailover stops the master with fail and checks that the deputy
+// carries on with the game: everybody follows it, a new deputy is elected,
+// the state order and the scores go on and player ids are not reused.
+func checkFailover(c *cluster, fail func(master *node)) error {
+	wantRoles := []protobuf.NodeRole{protobuf.NodeRole_MASTER, protobuf.NodeRole_DEPUTY, protobuf.NodeRole_NORMAL, protobuf.NodeRole_NORMAL}
+	err := waitFor(10, func() error {
+		for i, n := range c.nodes {
+			if err := c.roleIn(n, wantRoles[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// a viewer that left takes the highest id with it
+	viewer, err := c.join("10.0.0.99", protobuf.NodeRole_VIEWER)
+	if err != nil {
+		return err
+	}
+	lastId := viewer.client.PlayerId()
+	err = waitFor(10, func() error {
+		state, _ := c.nodes[1].client.LastState()
+		if playerOf(state, lastId) == nil {
+			return errors.New("deputy does not know the viewer")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	viewer.client.Stop()
+	c.leave(viewer)
+	err = waitFor(10, func() error {
+		state, _ := c.nodes[0].client.LastState()
+		if playerOf(state, lastId) != nil {
+			return errors.New("viewer that left is still listed")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	master, deputy := c.nodes[0], c.nodes[1]
+	before, _ := deputy.client.LastState()
+	deputyPlayer := playerOf(before, deputy.client.PlayerId())
+	c.master = &net.UDPAddr{IP: net.ParseIP(deputyPlayer.GetIpAddress()), Port: int(deputyPlayer.GetPort())}
+
+	fail(master)
+	c.leave(master)
+
+	err = waitFor(15, func() error {
+		if err := c.roleIn(deputy, protobuf.NodeRole_MASTER); err != nil {
+			return err
+		}
+		deputies := 0
+		for _, n := range c.nodes {
+			state, _ := n.client.LastState()
+			if playerOf(state, master.client.PlayerId()) != nil {
+				return fmt.Errorf("%s still lists the old master", n.name)
+			}
+			if player := playerOf(state, n.client.PlayerId()); player.GetRole() == protobuf.NodeRole_DEPUTY {
+				deputies++
+			}
+		}
+		if deputies != 1 {
+			return fmt.Errorf("%d deputies after failover", deputies)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.statesFlow(); err != nil {
+		return err
+	}
+
+	for _, n := range c.nodes {
+		state, _ := n.client.LastState()
+		if state.GetStateOrder() <= before.GetStateOrder() {
+			return fmt.Errorf("%s went back to state %d from %d", n.name, state.GetStateOrder(), before.GetStateOrder())
+		}
+		for _, old := range before.GetPlayers().GetPlayers() {
+			if player := playerOf(state, int(old.GetId())); player != nil && player.GetScore() < old.GetScore() {
+				return fmt.Errorf("score of player %d fell from %d to %d", old.GetId(), old.GetScore(), player.GetScore())
+			}
+		}
+	}
+
+	joined, err := c.join("10.0.0.100", protobuf.NodeRole_NORMAL)
+	if err != nil {
+		return err
+	}
+	if joined.client.PlayerId() <= lastId {
+		return fmt.Errorf("new player got id %d, %d was already taken", joined.client.PlayerId(), lastId)
+	}
+	return c.statesFlow()
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"golang.org/x/net/ipv4"
+	"net"
+	"time"
+)
+
+// Transport opens the sockets of a node. UDP is the real network, the
+// simulated network in sim.go runs many nodes in one process.
+type Transport interface {
+	// Listen opens a socket bound to addr, nil or port 0 picks a free port.
+	Listen(addr *net.UDPAddr) (Conn, error)
+}
+
+// Conn is an unconnected datagram socket.
+type Conn interface {
+	ReadFrom(b []byte) (int, *net.UDPAddr, error)
+	WriteTo(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadDeadline(t time.Time) error
+	SetReadBuffer(bytes int) error
+	LocalAddr() *net.UDPAddr
+	Close() error
+}
+
+// UDP is the transport over real UDP sockets.
+var UDP Transport = udpTransport{}
+
+type udpTransport struct{}
+
+func (udpTransport) Listen(addr *net.UDPAddr) (Conn, error) {
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	conn, err := net.ListenUDP(udpNetwork(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{conn}, nil
+}
+
+type udpConn struct {
+	conn *net.UDPConn
+}
+
+func (c *udpConn) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	return c.conn.ReadFromUDP(b)
+}
+
+func (c *udpConn) WriteTo(b []byte, addr *net.UDPAddr) (int, error) {
+	return c.conn.WriteToUDP(b, addr)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadBuffer(bytes int) error {
+	return c.conn.SetReadBuffer(bytes)
+}
+
+func (c *udpConn) LocalAddr() *net.UDPAddr {
+	return c.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (c *udpConn) Close() error {
+	return c.conn.Close()
+}
+
+// announcePacketConn returns the socket to multicast announcements from,
+// nil if the transport or the address family has no multicast.
+func announcePacketConn(conn Conn) *ipv4.PacketConn {
+	c, ok := conn.(*udpConn)
+	if !ok || udpNetwork(c.LocalAddr()) != "udp4" {
+		return nil
+	}
+	return ipv4.NewPacketConn(c.conn)
+}
@@ -0,0 +1,160 @@
+package replay
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	MinSpeed = 0.125
+	MaxSpeed = 16
+)
+
+// Player walks through a replay at the recorded state delay scaled by the
+// speed. Step, Seek, pause and speed changes may come from any goroutine,
+// Run shows the new frame right away.
+type Player struct {
+	replay   *Replay
+	lock     *sync.Mutex
+	position int
+	paused   bool
+	speed    float64
+	changed  chan struct{}
+}
+
+func NewPlayer(replay *Replay) *Player {
+	return &Player{
+		replay:  replay,
+		lock:    new(sync.Mutex),
+		speed:   1,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (p *Player) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Player) Replay() *Replay {
+	return p.replay
+}
+
+func (p *Player) Len() int {
+	return len(p.replay.Frames)
+}
+
+func (p *Player) Position() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.position
+}
+
+func (p *Player) Frame() *Frame {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.replay.Frames[p.position]
+}
+
+func (p *Player) Seek(position int) {
+	p.lock.Lock()
+	if position < 0 {
+		position = 0
+	}
+	if position >= len(p.replay.Frames) {
+		position = len(p.replay.Frames) - 1
+	}
+	p.position = position
+	p.lock.Unlock()
+	p.notify()
+}
+
+func (p *Player) Step(delta int) {
+	p.Seek(p.Position() + delta)
+}
+
+func (p *Player) Paused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
+func (p *Player) SetPaused(paused bool) {
+	p.lock.Lock()
+	p.paused = paused
+	p.lock.Unlock()
+	p.notify()
+}
+
+func (p *Player) TogglePause() {
+	p.SetPaused(!p.Paused())
+}
+
+func (p *Player) Speed() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.speed
+}
+
+func (p *Player) SetSpeed(speed float64) {
+	if speed < MinSpeed {
+		speed = MinSpeed
+	}
+	if speed > MaxSpeed {
+		speed = MaxSpeed
+	}
+	p.lock.Lock()
+	p.speed = speed
+	p.lock.Unlock()
+	p.notify()
+}
+
+func (p *Player) delay() time.Duration {
+	delay := time.Duration(p.replay.DelayMS()) * time.Millisecond
+	return time.Duration(float64(delay) / p.Speed())
+}
+
+// Run calls show for every frame until ctx is done. Playback pauses itself
+// on the last frame.
+func (p *Player) Run(ctx context.Context, show func(position int, frame *Frame)) {
+	for {
+		p.lock.Lock()
+		position := p.position
+		frame := p.replay.Frames[position]
+		paused := p.paused
+		p.lock.Unlock()
+
+		show(position, frame)
+
+		if paused {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.changed:
+			}
+			continue
+		}
+
+		timer := time.NewTimer(p.delay())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-p.changed:
+			timer.Stop()
+		case <-timer.C:
+			p.lock.Lock()
+			if p.position == position {
+				if p.position < len(p.replay.Frames)-1 {
+					p.position++
+				} else {
+					p.paused = true
+				}
+			}
+			p.lock.Unlock()
+		}
+	}
+}
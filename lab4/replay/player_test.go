@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"context"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"snake_game/protobuf"
+	"testing"
+	"time"
+)
+
+func testReplay(frames int, delayMS int32) *Replay {
+	config := proto.Clone(testConfig).(*protobuf.GameConfig)
+	config.StateDelayMs = proto.Int32(delayMS)
+	rep := &Replay{GameName: "test game", Config: config}
+	for i := 0; i < frames; i++ {
+		rep.Frames = append(rep.Frames, &Frame{State: testState(int32(i+1), "alice")})
+	}
+	return rep
+}
+
+func TestPlayerSeekStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		move     func(p *Player)
+		position int
+	}{
+		{"starts at the first frame", func(p *Player) {}, 0},
+		{"seek", func(p *Player) { p.Seek(3) }, 3},
+		{"seek before the start", func(p *Player) { p.Seek(-2) }, 0},
+		{"seek past the end", func(p *Player) { p.Seek(10) }, 4},
+		{"step forward", func(p *Player) { p.Seek(1); p.Step(2) }, 3},
+		{"step back", func(p *Player) { p.Seek(3); p.Step(-1) }, 2},
+		{"step past the end", func(p *Player) { p.Seek(3); p.Step(5) }, 4},
+		{"step before the start", func(p *Player) { p.Seek(1); p.Step(-5) }, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewPlayer(testReplay(5, 100))
+			test.move(p)
+			if p.Position() != test.position {
+				t.Fatalf("position %d, want %d", p.Position(), test.position)
+			}
+			if order := p.Frame().State.GetStateOrder(); order != int32(test.position+1) {
+				t.Errorf("frame with state %d at position %d", order, test.position)
+			}
+		})
+	}
+}
+
+func TestPlayerSpeed(t *testing.T) {
+	tests := []struct {
+		speed float64
+		want  float64
+		delay time.Duration
+	}{
+		{1, 1, 160 * time.Millisecond},
+		{2, 2, 80 * time.Millisecond},
+		{0.5, 0.5, 320 * time.Millisecond},
+		{MaxSpeed, MaxSpeed, 10 * time.Millisecond},
+		{100, MaxSpeed, 10 * time.Millisecond},
+		{0.01, MinSpeed, 1280 * time.Millisecond},
+		{-1, MinSpeed, 1280 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		p := NewPlayer(testReplay(2, 160))
+		p.SetSpeed(test.speed)
+		if p.Speed() != test.want {
+			t.Errorf("SetSpeed(%v) gives speed %v, want %v", test.speed, p.Speed(), test.want)
+		}
+		if delay := p.delay(); delay != test.delay {
+			t.Errorf("speed %v plays a frame every %v, want %v", test.speed, delay, test.delay)
+		}
+	}
+}
+
+func TestPlayerRunPausesAtTheEnd(t *testing.T) {
+	p := NewPlayer(testReplay(4, 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var shown []int
+	p.Run(ctx, func(position int, frame *Frame) {
+		shown = append(shown, position)
+		if frame != p.Replay().Frames[position] {
+			t.Errorf("frame at position %d is not the frame of the replay", position)
+		}
+		if p.Paused() {
+			cancel()
+		}
+	})
+
+	if want := []int{0, 1, 2, 3, 3}; !reflect.DeepEqual(shown, want) {
+		t.Errorf("shown positions %v, want %v", shown, want)
+	}
+	if !p.Paused() || p.Position() != 3 {
+		t.Errorf("player at %d, paused %t after the last frame", p.Position(), p.Paused())
+	}
+}
+
+func TestPlayerPausedShowsSeek(t *testing.T) {
+	p := NewPlayer(testReplay(5, 10))
+	p.SetPaused(true)
+	<-p.changed // Run would show the first frame twice otherwise
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var shown []int
+	p.Run(ctx, func(position int, frame *Frame) {
+		shown = append(shown, position)
+		switch len(shown) {
+		case 1:
+			p.Seek(3)
+		case 2:
+			p.Step(-2)
+		default:
+			cancel()
+		}
+	})
+
+	if want := []int{0, 3, 1}; !reflect.DeepEqual(shown, want) {
+		t.Errorf("shown positions %v, want %v", shown, want)
+	}
+}
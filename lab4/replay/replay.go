@@ -0,0 +1,291 @@
+package replay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log"
+	"os"
+	"snake_game/protobuf"
+	"sort"
+	"sync"
+)
+
+// A replay file is a sequence of length-delimited GameMessage records. The
+// first one is an AnnouncementMsg with the game name and config, then every
+// game state follows as a StateMsg. Players that appeared since the previous
+// state are recorded as JoinMsg with SenderId set to their id, players that
+// are gone as RoleChangeMsg with SenderRole VIEWER, the way a leaving client
+// says goodbye. Both event kinds precede the state they were noticed in.
+//
+// A recording made by the master also keeps the seed of the game in an extra
+// field of the header, with it game.Step can check the states of the robots.
+
+const (
+	maxRecordSize = 1 << 20
+
+	seedField protowire.Number = 100 // header GameMessage, varint
+)
+
+type Frame struct {
+	State  *protobuf.GameState
+	Events []*protobuf.GameMessage
+}
+
+type Replay struct {
+	GameName string
+	Config   *protobuf.GameConfig
+	Frames   []*Frame
+
+	// Seed is the seed of the game, valid if HasSeed is set
+	Seed    int64
+	HasSeed bool
+}
+
+type Recorder struct {
+	file      *os.File
+	writer    *bufio.Writer
+	lock      *sync.Mutex
+	players   map[int32]bool
+	lastOrder int32
+	err       error
+}
+
+// NewRecorder records a game whose seed is not known, as on a node that
+// joined it.
+func NewRecorder(path string, gameName string, config *protobuf.GameConfig) (*Recorder, error) {
+	return newRecorder(path, gameName, config, nil)
+}
+
+// NewSeededRecorder records a game together with its seed.
+func NewSeededRecorder(path string, gameName string, config *protobuf.GameConfig, seed int64) (*Recorder, error) {
+	return newRecorder(path, gameName, config, &seed)
+}
+
+func newRecorder(path string, gameName string, config *protobuf.GameConfig, seed *int64) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replay file: %w", err)
+	}
+
+	r := &Recorder{
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		lock:      new(sync.Mutex),
+		players:   make(map[int32]bool),
+		lastOrder: -1,
+	}
+
+	header := &protobuf.GameMessage{
+		MsgSeq: proto.Int64(0),
+		Type: &protobuf.GameMessage_Announcement{
+			Announcement: &protobuf.GameMessage_AnnouncementMsg{
+				Games: []*protobuf.GameAnnouncement{
+					{
+						Players:  &protobuf.GamePlayers{},
+						Config:   config,
+						GameName: proto.String(gameName),
+					},
+				},
+			},
+		},
+	}
+	if seed != nil {
+		var b []byte
+		b = protowire.AppendTag(b, seedField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*seed))
+		header.ProtoReflect().SetUnknown(b)
+	}
+
+	r.write(header)
+	if r.err == nil {
+		r.err = r.writer.Flush()
+	}
+	if r.err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write replay header: %w", r.err)
+	}
+
+	return r, nil
+}
+
+func (r *Recorder) write(msg *protobuf.GameMessage) {
+	if r.err != nil {
+		return
+	}
+	_, r.err = protodelim.MarshalTo(r.writer, msg)
+	if r.err != nil {
+		log.Printf("[replay] failed to write record, recording stopped: %v", r.err)
+	}
+}
+
+// State records a game state. States that are not newer than the last one,
+// e.g. retransmits seen by a client, are skipped.
+func (r *Recorder) State(state *protobuf.GameState) {
+	if state == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if state.GetStateOrder() <= r.lastOrder {
+		return
+	}
+	r.lastOrder = state.GetStateOrder()
+
+	current := make(map[int32]bool, len(state.GetPlayers().GetPlayers()))
+	for _, player := range state.GetPlayers().GetPlayers() {
+		current[player.GetId()] = true
+		if r.players[player.GetId()] {
+			continue
+		}
+		r.write(&protobuf.GameMessage{
+			MsgSeq:   proto.Int64(int64(state.GetStateOrder())),
+			SenderId: proto.Int32(player.GetId()),
+			Type: &protobuf.GameMessage_Join{
+				Join: &protobuf.GameMessage_JoinMsg{
+					PlayerType:    player.GetType().Enum(),
+					PlayerName:    proto.String(player.GetName()),
+					GameName:      proto.String(""),
+					RequestedRole: player.GetRole().Enum(),
+				},
+			},
+		})
+	}
+
+	var left []int32
+	for playerId := range r.players {
+		if !current[playerId] {
+			left = append(left, playerId)
+		}
+	}
+	// sorted, so recordings of the same seeded match are identical
+	sort.Slice(left, func(i, j int) bool { return left[i] < left[j] })
+
+	for _, playerId := range left {
+		r.write(&protobuf.GameMessage{
+			MsgSeq:   proto.Int64(int64(state.GetStateOrder())),
+			SenderId: proto.Int32(playerId),
+			Type: &protobuf.GameMessage_RoleChange{
+				RoleChange: &protobuf.GameMessage_RoleChangeMsg{
+					SenderRole: protobuf.NodeRole_VIEWER.Enum(),
+				},
+			},
+		})
+	}
+	r.players = current
+
+	r.write(&protobuf.GameMessage{
+		MsgSeq: proto.Int64(int64(state.GetStateOrder())),
+		Type: &protobuf.GameMessage_State{
+			State: &protobuf.GameMessage_StateMsg{State: state},
+		},
+	})
+
+	if r.err == nil {
+		r.err = r.writer.Flush()
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Load reads a whole replay file. A record cut off at the end, left by a
+// recorder that was killed, ends the replay instead of failing it.
+func Load(path string) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	options := protodelim.UnmarshalOptions{MaxSize: maxRecordSize}
+
+	header := &protobuf.GameMessage{}
+	err = options.UnmarshalFrom(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay header: %w", err)
+	}
+
+	games := header.GetAnnouncement().GetGames()
+	if len(games) == 0 {
+		return nil, errors.New("not a replay file: no game in header")
+	}
+
+	replay := &Replay{
+		GameName: games[0].GetGameName(),
+		Config:   games[0].GetConfig(),
+	}
+	b := header.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			break
+		}
+		if num == seedField && typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(b[n:])
+			replay.Seed, replay.HasSeed = int64(v), true
+		}
+		b = b[n+m:]
+	}
+
+	var events []*protobuf.GameMessage
+	for {
+		msg := &protobuf.GameMessage{}
+		err := options.UnmarshalFrom(reader, msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[replay] %s is truncated after %d states: %v", path, len(replay.Frames), err)
+			break
+		}
+
+		switch msg.Type.(type) {
+		case *protobuf.GameMessage_State:
+			replay.Frames = append(replay.Frames, &Frame{State: msg.GetState().GetState(), Events: events})
+			events = nil
+		case *protobuf.GameMessage_Join, *protobuf.GameMessage_RoleChange:
+			events = append(events, msg)
+		}
+	}
+
+	if len(replay.Frames) == 0 {
+		return nil, errors.New("replay has no game states")
+	}
+
+	return replay, nil
+}
+
+func (r *Replay) DelayMS() int {
+	return int(r.Config.GetStateDelayMs())
+}
+
+func Describe(event *protobuf.GameMessage) string {
+	switch event.Type.(type) {
+	case *protobuf.GameMessage_Join:
+		join := event.GetJoin()
+		return fmt.Sprintf("player %d %q joined as %s %s", event.GetSenderId(), join.GetPlayerName(), join.GetPlayerType(), join.GetRequestedRole())
+	case *protobuf.GameMessage_RoleChange:
+		return fmt.Sprintf("player %d left", event.GetSenderId())
+	}
+	return fmt.Sprintf("unknown event %T", event.Type)
+}
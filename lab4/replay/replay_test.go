@@ -0,0 +1,196 @@
+package replay
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"snake_game/protobuf"
+	"testing"
+)
+
+var testConfig = &protobuf.GameConfig{
+	Width:        proto.Int32(10),
+	Height:       proto.Int32(8),
+	FoodStatic:   proto.Int32(2),
+	StateDelayMs: proto.Int32(150),
+}
+
+// testState is a state with the given players, robots where the name says
+// so.
+func testState(order int32, names ...string) *protobuf.GameState {
+	players := &protobuf.GamePlayers{}
+	for _, name := range names {
+		playerType := protobuf.PlayerType_HUMAN
+		if name == "robot" {
+			playerType = protobuf.PlayerType_ROBOT
+		}
+		players.Players = append(players.Players, &protobuf.GamePlayer{
+			Name:  proto.String(name),
+			Id:    proto.Int32(playerIds[name]),
+			Role:  protobuf.NodeRole_NORMAL.Enum(),
+			Type:  playerType.Enum(),
+			Score: proto.Int32(0),
+		})
+	}
+	return &protobuf.GameState{
+		StateOrder: proto.Int32(order),
+		Players:    players,
+		Foods:      []*protobuf.GameState_Coord{{X: proto.Int32(order % 10), Y: proto.Int32(1)}},
+	}
+}
+
+var playerIds = map[string]int32{"alice": 1, "bob": 2, "robot": 3, "carol": 4}
+
+func record(t *testing.T, recorder *Recorder, states ...*protobuf.GameState) {
+	t.Helper()
+	for _, state := range states {
+		recorder.State(state)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.replay")
+	recorder, err := NewSeededRecorder(path, "test game", testConfig, -42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder,
+		testState(1, "alice", "bob"),
+		testState(1, "alice", "bob", "robot"), // a retransmit, skipped
+		testState(2, "carol", "alice", "robot"),
+		testState(3, "carol", "alice", "robot"),
+		testState(2, "alice"), // older than the last one, skipped
+		testState(5, "bob"),
+	)
+
+	rep, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.GameName != "test game" || !proto.Equal(rep.Config, testConfig) {
+		t.Errorf("header %q %v, want %q %v", rep.GameName, rep.Config, "test game", testConfig)
+	}
+	if !rep.HasSeed || rep.Seed != -42 {
+		t.Errorf("seed %d (%t), want -42", rep.Seed, rep.HasSeed)
+	}
+
+	wantOrders := []int32{1, 2, 3, 5}
+	wantEvents := [][]string{
+		{`player 1 "alice" joined as HUMAN NORMAL`, `player 2 "bob" joined as HUMAN NORMAL`},
+		{`player 4 "carol" joined as HUMAN NORMAL`, `player 3 "robot" joined as ROBOT NORMAL`, "player 2 left"},
+		nil,
+		{`player 2 "bob" joined as HUMAN NORMAL`, "player 1 left", "player 3 left", "player 4 left"},
+	}
+	if len(rep.Frames) != len(wantOrders) {
+		t.Fatalf("%d frames, want %d", len(rep.Frames), len(wantOrders))
+	}
+	for i, frame := range rep.Frames {
+		if order := frame.State.GetStateOrder(); order != wantOrders[i] {
+			t.Errorf("frame %d has state %d, want %d", i, order, wantOrders[i])
+		}
+		var events []string
+		for _, event := range frame.Events {
+			events = append(events, Describe(event))
+		}
+		if !reflect.DeepEqual(events, wantEvents[i]) {
+			t.Errorf("frame %d events %q, want %q", i, events, wantEvents[i])
+		}
+	}
+	if !proto.Equal(rep.Frames[2].State, testState(3, "carol", "alice", "robot")) {
+		t.Errorf("frame 2 state %v", rep.Frames[2].State)
+	}
+}
+
+func TestRecordWithoutSeed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.replay")
+	recorder, err := NewRecorder(path, "joined", testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder, testState(7, "alice"))
+
+	rep, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.HasSeed {
+		t.Errorf("seed %d recorded, want none", rep.Seed)
+	}
+}
+
+func TestLoadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.replay")
+	recorder, err := NewRecorder(path, "cut", testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := testState(3, "alice", "bob")
+	record(t, recorder, testState(1, "alice"), testState(2, "alice", "bob"), last)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSize := proto.Size(&protobuf.GameMessage{
+		MsgSeq: proto.Int64(3),
+		Type:   &protobuf.GameMessage_State{State: &protobuf.GameMessage_StateMsg{State: last}},
+	})
+	lastSize += protowire.SizeVarint(uint64(lastSize))
+
+	tests := []struct {
+		name   string
+		size   int
+		frames int // -1 if the file does not load
+	}{
+		{"whole file", len(data), 3},
+		{"last byte missing", len(data) - 1, 2},
+		{"only the length of the last record left", len(data) - lastSize + 1, 2},
+		{"last record missing", len(data) - lastSize, 2},
+		{"header cut off", 5, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			truncated := filepath.Join(t.TempDir(), "cut.replay")
+			if err := os.WriteFile(truncated, data[:test.size], 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rep, err := Load(truncated)
+			if test.frames < 0 {
+				if err == nil {
+					t.Errorf("loaded %d frames, want an error", len(rep.Frames))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rep.Frames) != test.frames {
+				t.Fatalf("%d frames, want %d", len(rep.Frames), test.frames)
+			}
+			for i, frame := range rep.Frames {
+				if frame.State.GetStateOrder() != int32(i+1) {
+					t.Errorf("frame %d has state %d", i, frame.State.GetStateOrder())
+				}
+			}
+		})
+	}
+}
+
+func TestLoadHeaderOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.replay")
+	recorder, err := NewRecorder(path, "empty", testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, recorder)
+
+	if _, err := Load(path); err == nil {
+		t.Error("a replay without states loaded")
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
-	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
 	"image/color"
 	"snake_game/game"
 	"snake_game/network"
 	"snake_game/protobuf"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,38 +18,121 @@ const (
 	screenHeight = 910
 	gameWidth    = 1200
 	gameHeight   = 900
+
+	followViewWidth  = 40
+	followViewHeight = 30
 )
 
+// view is the part of the torus shown on screen, it starts at x, y and
+// wraps around the field edges.
+type view struct {
+	x      int
+	y      int
+	width  int
+	height int
+}
+
+func wholeFieldView(field *game.Field) view {
+	return view{width: field.Width(), height: field.Height()}
+}
+
+// followView centers a window of followViewWidth x followViewHeight cells
+// on the head of the snake.
+func followView(field *game.Field, snake *game.Snake) view {
+	v := wholeFieldView(field)
+	if v.width > followViewWidth {
+		v.width = followViewWidth
+	}
+	if v.height > followViewHeight {
+		v.height = followViewHeight
+	}
+
+	head := snake.Head()
+	v.x = (int(head.GetX()) - v.width/2 + field.Width()) % field.Width()
+	v.y = (int(head.GetY()) - v.height/2 + field.Height()) % field.Height()
+	return v
+}
+
 func startGame(gameName string, client *network.Client, playerName string) {
 	gameWindow := fyne.CurrentApp().NewWindow(gameName)
 
-	canvasContainer := container.NewWithoutLayout()
-	gameWindow.SetContent(canvasContainer)
+	screen := newGameScreen()
+	gameWindow.SetContent(screen.content)
 	gameWindow.Resize(fyne.NewSize(screenWidth, screenHeight))
 	gameWindow.Show()
 
-	go func() {
-		sleepTime := client.Game().Field().DelayMS()
+	// snake a spectator follows, -1 shows the whole field
+	var followId atomic.Int32
+	followId.Store(-1)
 
+	// created once, a button made anew every frame would lose clicks
+	playAgainButton := widget.NewButton("Играть снова", func() {
+		client.RequestPlay()
+	})
+
+	moves := newMotion(client.Game().Field().GameConfig(), client.PlayerId())
+
+	go func() {
 		for {
-			time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+			time.Sleep(frameDelay)
 			score := client.PlayerScore()
-			updateGameCanvas(canvasContainer, client.Game(), score, playerName)
+
+			field := client.Game().Field()
+			v := wholeFieldView(field)
+			spectating := client.Role() == protobuf.NodeRole_VIEWER
+			if spectating {
+				if snake := field.SnakeById(int(followId.Load())); snake != nil {
+					v = followView(field, snake)
+				}
+			}
+
+			moves.update(client.LastState())
+			updateGameCanvasView(screen, client.Game(), v, moves.snakes(time.Now()), score, playerName)
+			if spectating {
+				drawSpectatorInfo(screen, client, int(followId.Load()))
+			}
+			if client.GameOver() {
+				drawGameOver(screen, client, playAgainButton)
+			}
 		}
 	}()
 
 	gameWindow.Canvas().SetOnTypedKey(func(key *fyne.KeyEvent) {
+		if client.GameOver() && (key.Name == fyne.KeyReturn || key.Name == fyne.KeyEnter) {
+			client.RequestPlay()
+			return
+		}
+
+		if client.Role() == protobuf.NodeRole_VIEWER {
+			switch key.Name {
+			case fyne.KeyTab, fyne.KeyN:
+				followId.Store(int32(nextSnakeId(client.Game().Field(), int(followId.Load()))))
+				return
+			case fyne.KeyW:
+				followId.Store(-1)
+				return
+			case fyne.KeyP:
+				client.RequestPlay()
+				return
+			}
+		}
+
+		steer := func(direction protobuf.Direction) {
+			client.SendSteer(direction)
+			moves.steer(direction)
+		}
+
 		switch key.Name {
 		case fyne.KeyEscape:
 			gameWindow.Close()
 		case fyne.KeyUp:
-			client.SendSteer(protobuf.Direction_UP)
+			steer(protobuf.Direction_UP)
 		case fyne.KeyDown:
-			client.SendSteer(protobuf.Direction_DOWN)
+			steer(protobuf.Direction_DOWN)
 		case fyne.KeyLeft:
-			client.SendSteer(protobuf.Direction_LEFT)
+			steer(protobuf.Direction_LEFT)
 		case fyne.KeyRight:
-			client.SendSteer(protobuf.Direction_RIGHT)
+			steer(protobuf.Direction_RIGHT)
 		}
 	})
 
@@ -57,73 +141,109 @@ func startGame(gameName string, client *network.Client, playerName string) {
 	})
 }
 
-func updateGameCanvas(canvasContainer *fyne.Container, gameInstance *game.Game, score int, playerName string) {
-	canvasContainer.Objects = nil
+// nextSnakeId returns the id of the snake after currentId, in field order.
+func nextSnakeId(field *game.Field, currentId int) int {
+	snakes := field.Snakes()
+	if len(snakes) == 0 {
+		return -1
+	}
+	for i, snake := range snakes {
+		if snake.PlayerID() == currentId {
+			return snakes[(i+1)%len(snakes)].PlayerID()
+		}
+	}
+	return snakes[0].PlayerID()
+}
 
-	field := gameInstance.Field()
+func drawSpectatorInfo(screen *gameScreen, client *network.Client, followId int) {
+	lines := []string{"Зритель", "Tab/N - следить за змеей", "W - все поле", "P - играть"}
+	if followId != -1 {
+		lines[0] = fmt.Sprintf("Зритель, следим за %d", followId)
+	}
+	if errorMessage := client.LastError(); errorMessage != "" {
+		lines = append(lines, fmt.Sprintf("Ошибка: %s", errorMessage))
+	}
 
-	fieldWidth := field.Width()
-	fieldHeight := field.Height()
+	for i, line := range lines {
+		text := canvas.NewText(line, color.White)
+		text.Move(fyne.NewPos(screen.fieldSize().Width+10, float32(80+20*i)))
+		screen.overlay.Add(text)
+	}
+	screen.overlay.Refresh()
+}
 
-	cellWidth := gameWidth / fieldWidth
-	cellHeight := gameHeight / fieldHeight
+// drawGameOver covers the field after the snake of the player died and
+// offers to play again.
+func drawGameOver(screen *gameScreen, client *network.Client, playAgainButton *widget.Button) {
+	area := screen.fieldSize()
+	shade := canvas.NewRectangle(color.RGBA{A: 160})
+	shade.Resize(area)
+	screen.overlay.Add(shade)
 
-	for x := 0; x < fieldWidth; x++ {
-		for y := 0; y < fieldHeight; y++ {
-			rect := &canvas.Rectangle{
-				FillColor:   color.RGBA{R: 200, G: 200, B: 200, A: 255},
-				StrokeColor: color.Black,
-				StrokeWidth: 1,
-			}
-			rect.Move(fyne.NewPos(float32(x*cellWidth), float32(y*cellHeight)))
-			rect.Resize(fyne.NewSize(float32(cellWidth), float32(cellHeight)))
-			canvasContainer.Add(rect)
-		}
+	lines := []string{"Игра окончена", fmt.Sprintf("Счет: %d", client.FinalScore())}
+	if errorMessage := client.LastError(); errorMessage != "" {
+		lines = append(lines, fmt.Sprintf("Ошибка: %s", errorMessage))
+	}
+	for i, line := range lines {
+		text := canvas.NewText(line, color.White)
+		text.Alignment = fyne.TextAlignCenter
+		text.TextStyle = fyne.TextStyle{Bold: true}
+		text.TextSize = 24
+		text.Resize(fyne.NewSize(area.Width, 40))
+		text.Move(fyne.NewPos(0, area.Height/2-120+float32(40*i)))
+		screen.overlay.Add(text)
 	}
 
-	snakes := field.Snakes()
+	playAgainButton.Resize(fyne.NewSize(200, 40))
+	playAgainButton.Move(fyne.NewPos(area.Width/2-100, area.Height/2-100+float32(40*len(lines))))
+	screen.overlay.Add(playAgainButton)
+	screen.overlay.Refresh()
+}
 
-	for _, snake := range snakes {
-		body := snake.Body()
-		for i, segment := range body {
-			rect := &canvas.Rectangle{
-				FillColor:   getColorById(i, snake.PlayerID()),
-				StrokeColor: color.Black,
-				StrokeWidth: 1,
-			}
-			rect.Move(fyne.NewPos(float32(segment.GetX()*int32(cellWidth)), float32(segment.GetY()*int32(cellHeight))))
-			rect.Resize(fyne.NewSize(float32(cellWidth), float32(cellHeight)))
-			canvasContainer.Add(rect)
-		}
+func updateGameCanvas(screen *gameScreen, gameInstance *game.Game, score int, playerName string) {
+	field := gameInstance.Field()
+	updateGameCanvasView(screen, gameInstance, wholeFieldView(field), fieldSnakes(field), score, playerName)
+}
+
+// fieldSnakes shows snakes right in their cells.
+func fieldSnakes(field *game.Field) []drawnSnake {
+	var snakes []drawnSnake
+	for _, snake := range field.Snakes() {
+		snakes = append(snakes, drawnSnake{id: snake.PlayerID(), zombie: snake.IsZombie(), cells: toPoints(snake.Body())})
 	}
+	return snakes
+}
+
+// updateGameCanvasView hands the field to the raster and puts the texts
+// on top of it, the texts are laid out for the current window size.
+func updateGameCanvasView(screen *gameScreen, gameInstance *game.Game, v view, snakes []drawnSnake, score int, playerName string) {
+	field := gameInstance.Field()
+	screen.field.show(frame{
+		view:        v,
+		fieldWidth:  field.Width(),
+		fieldHeight: field.Height(),
+		snakes:      snakes,
+		foods:       field.Foods(),
+	})
 
-	foods := field.Foods()
+	screen.overlay.Objects = nil
+	right := screen.size().Width
 
-	for _, food := range foods {
-		rect := &canvas.Rectangle{
-			FillColor:   color.RGBA{R: 255, A: 255},
-			StrokeColor: color.Black,
-			StrokeWidth: 1,
-		}
-		rect.Move(fyne.NewPos(float32(food.GetX()*int32(cellWidth)), float32(food.GetY()*int32(cellHeight))))
-		rect.Resize(fyne.NewSize(float32(cellWidth), float32(cellHeight)))
-		canvasContainer.Add(rect)
-	}
 	playerNameText := canvas.NewText(fmt.Sprintf("Игрок: %s", playerName), color.White)
 	playerNameText.Alignment = fyne.TextAlignCenter
 	playerNameText.TextStyle = fyne.TextStyle{Bold: true}
 	playerNameText.Resize(fyne.NewSize(100, 30))
-	playerNameText.Move(fyne.NewPos(screenWidth-150, 10))
-	canvasContainer.Add(playerNameText)
+	playerNameText.Move(fyne.NewPos(right-150, 10))
+	screen.overlay.Add(playerNameText)
 
 	scoreText := canvas.NewText(fmt.Sprintf("Счет: %d", score), color.White)
 	scoreText.Alignment = fyne.TextAlignCenter
 	scoreText.TextStyle = fyne.TextStyle{Bold: true}
 	scoreText.Resize(fyne.NewSize(100, 30))
-	scoreText.Move(fyne.NewPos(screenWidth-150, 40))
-	canvasContainer.Add(scoreText)
+	scoreText.Move(fyne.NewPos(right-150, 40))
+	screen.overlay.Add(scoreText)
 
-	canvasContainer.Refresh()
+	screen.overlay.Refresh()
 }
 
 func getColorById(segmentIndex int, id int) color.RGBA {
@@ -132,3 +252,12 @@ func getColorById(segmentIndex int, id int) color.RGBA {
 	}
 	return color.RGBA{R: uint8((90 * id) % 255), G: uint8((135 * id) % 255), B: uint8((55 * id) % 255), A: 255}
 }
+
+// zombieColor paints snakes whose players left the game, they all look the
+// same since nobody controls them.
+func zombieColor(segmentIndex int) color.RGBA {
+	if segmentIndex == 0 {
+		return color.RGBA{R: 60, G: 80, B: 60, A: 255}
+	}
+	return color.RGBA{R: 110, G: 130, B: 110, A: 160}
+}
@@ -8,9 +8,11 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	"log"
+	"net"
 	"snake_game/game"
 	"snake_game/network"
 	"snake_game/protobuf"
+	"snake_game/replay"
 	"strconv"
 	"sync"
 	"time"
@@ -25,6 +27,9 @@ func ShowMainMenu(app fyne.App) {
 	joinGameButton := widget.NewButton("Подключиться к игре", func() {
 		ShowJoinGameWindow(w)
 	})
+	replayButton := widget.NewButton("Смотреть запись", func() {
+		ShowOpenReplayWindow(w)
+	})
 	exitButton := widget.NewButton("Выйти из игры", func() {
 		app.Quit()
 	})
@@ -32,6 +37,7 @@ func ShowMainMenu(app fyne.App) {
 	menu := container.NewVBox(
 		startNewGameButton,
 		joinGameButton,
+		replayButton,
 		exitButton,
 	)
 	w.SetContent(menu)
@@ -66,6 +72,25 @@ func ShowNewGameWindow(parent fyne.Window) {
 	delayMSEntry.SetPlaceHolder("Задержка")
 	delayMSEntry.SetText("500")
 
+	bindEntry := widget.NewEntry()
+	bindEntry.SetPlaceHolder("IP или интерфейс (пусто - все)")
+
+	portEntry := widget.NewEntry()
+	portEntry.SetPlaceHolder("Порт (0 - любой)")
+	portEntry.SetText("0")
+
+	robotsEntry := widget.NewEntry()
+	robotsEntry.SetPlaceHolder("Сколько ботов")
+	robotsEntry.SetText("0")
+
+	robotLevelSelect := widget.NewSelect([]string{"easy", "normal", "hard"}, func(string) {})
+	robotLevelSelect.SetSelected("normal")
+
+	recordEntry := widget.NewEntry()
+	recordEntry.SetPlaceHolder("Файл записи (пусто - не записывать)")
+
+	deltaCheck := widget.NewCheck("Передавать только изменения", func(bool) {})
+
 	createButton := widget.NewButton("Создать", func() {
 		playerName := playerNameEntry.Text
 		gameName := gameNameEntry.Text
@@ -73,10 +98,22 @@ func ShowNewGameWindow(parent fyne.Window) {
 		height, _ := strconv.Atoi(heightEntry.Text)
 		foodStatic, _ := strconv.Atoi(foodStaticEntry.Text)
 		delayMS, _ := strconv.Atoi(delayMSEntry.Text)
+		port, _ := strconv.Atoi(portEntry.Text)
+		robots, _ := strconv.Atoi(robotsEntry.Text)
+		difficulty, _ := game.ParseDifficulty(robotLevelSelect.Selected)
+
+		bindAddr, err := network.ParseBindAddress(bindEntry.Text, port)
+		if err != nil {
+			dialog.ShowError(err, newGameWindow)
+			return
+		}
 
 		server := network.NewServer(gameName, width, height, foodStatic, delayMS)
-		err := server.Start()
+		server.SetBindAddr(bindAddr)
+		server.SetDeltaStates(deltaCheck.Checked)
+		err = server.Start()
 		if err != nil {
+			dialog.ShowError(err, newGameWindow)
 			return
 		}
 		log.Printf("Создание игры: %s (Размер карты: %d x %d) (Сколько еды: %d) (Задержка: %d)",
@@ -91,6 +128,23 @@ func ShowNewGameWindow(parent fyne.Window) {
 
 		client.SetServer(server)
 
+		// robots come after the host, the first player to join gets the
+		// master id
+		for i := 0; i < robots; i++ {
+			if _, err := server.AddRobot(difficulty); err != nil {
+				break
+			}
+		}
+
+		if recordEntry.Text != "" {
+			recorder, err := replay.NewSeededRecorder(recordEntry.Text, gameName, server.GameConfig(), server.Seed())
+			if err != nil {
+				log.Printf("[client] cannot record the game: %s", err.Error())
+			} else {
+				client.SetRecorder(recorder)
+			}
+		}
+
 		startGame(gameName, client, playerName)
 
 		newGameWindow.Close()
@@ -106,6 +160,12 @@ func ShowNewGameWindow(parent fyne.Window) {
 			widget.NewFormItem("Высота карты", heightEntry),
 			widget.NewFormItem("Сколько еды", foodStaticEntry),
 			widget.NewFormItem("Задержка", delayMSEntry),
+			widget.NewFormItem("Адрес", bindEntry),
+			widget.NewFormItem("Порт", portEntry),
+			widget.NewFormItem("Боты", robotsEntry),
+			widget.NewFormItem("Сложность ботов", robotLevelSelect),
+			widget.NewFormItem("Запись", recordEntry),
+			widget.NewFormItem("Дельта", deltaCheck),
 		),
 		createButton,
 	)
@@ -151,32 +211,84 @@ func ShowJoinGameWindow(parent fyne.Window) {
 		}
 	}
 
+	var manualAddrs []*net.UDPAddr
+
+	addressEntry := widget.NewEntry()
+	addressEntry.SetPlaceHolder("host:port")
+
+	// the probe runs in the background like the periodic one below, the
+	// button stays disabled until it is done
+	var probeButton *widget.Button
+	probeButton = widget.NewButton("Найти", func() {
+		text := addressEntry.Text
+		probeButton.Disable()
+		go func() {
+			defer probeButton.Enable()
+
+			addr, err := net.ResolveUDPAddr("udp", text)
+			if err != nil {
+				dialog.ShowError(err, joinGameWindow)
+				return
+			}
+
+			ann, err := network.Discover(addr, network.DiscoverTimeout*time.Millisecond)
+			if err != nil {
+				dialog.ShowInformation("Игра не найдена", err.Error(), joinGameWindow)
+				return
+			}
+
+			network.AddAnnouncement(&announcements, lock, ann)
+
+			lock.Lock()
+			isKnown := false
+			for _, known := range manualAddrs {
+				if known.String() == addr.String() {
+					isKnown = true
+				}
+			}
+			if !isKnown {
+				manualAddrs = append(manualAddrs, addr)
+			}
+			selected := -1
+			for i, a := range announcements {
+				serverAddr := a.ServerAddr()
+				if serverAddr.String() == addr.String() && a.Announce().GetGameName() == ann.Announce().GetGameName() {
+					selected = i
+				}
+			}
+			lock.Unlock()
+
+			gamesList.Refresh()
+			if selected != -1 {
+				gamesList.Select(selected)
+			}
+		}()
+	})
+
 	nameEntry := widget.NewEntry()
 	nameEntry.SetPlaceHolder("Имя")
 	nameEntry.SetText("player")
 
+	joinRecordEntry := widget.NewEntry()
+	joinRecordEntry.SetPlaceHolder("Файл записи (пусто - не записывать)")
+
 	roleSelection := widget.NewRadioGroup([]string{"Игрок", "Зритель"}, func(selected string) {})
 	roleSelection.SetSelected("Игрок")
 
-	connectButton := widget.NewButton("Подключиться", func() {
+	join := func(role protobuf.NodeRole) {
 		if selectedAnnouncement == nil {
 			dialog.ShowInformation("Ошибка!", "Выберите игру", joinGameWindow)
 			return
 		}
 		serverAddress := selectedAnnouncement.ServerAddr()
 
-		var role protobuf.NodeRole
-		if roleSelection.Selected == "Зритель" {
-			role = protobuf.NodeRole_VIEWER
-		} else {
-			role = protobuf.NodeRole_NORMAL
-		}
-
 		name := nameEntry.Text
 
 		client, err := network.NewClient(&serverAddress, name, role)
 		if err != nil {
 			log.Printf("[client] cannot connect to server: %s", err.Error())
+			dialog.ShowInformation("Не удалось подключиться к игре", err.Error(), joinGameWindow)
+			return
 		}
 
 		g := game.NewGame(selectedAnnouncement.Announce().Config)
@@ -187,6 +299,15 @@ func ShowJoinGameWindow(parent fyne.Window) {
 			return
 		}
 
+		if joinRecordEntry.Text != "" {
+			recorder, err := replay.NewRecorder(joinRecordEntry.Text, selectedAnnouncement.Announce().GetGameName(), selectedAnnouncement.Announce().GetConfig())
+			if err != nil {
+				log.Printf("[client] cannot record the game: %s", err.Error())
+			} else {
+				client.SetRecorder(recorder)
+			}
+		}
+
 		log.Printf("[client]: connected to %s:%d with game %s",
 			serverAddress.IP.String(), serverAddress.Port, selectedAnnouncement.Announce().GetGameName())
 
@@ -194,15 +315,29 @@ func ShowJoinGameWindow(parent fyne.Window) {
 
 		joinGameWindow.Close()
 		parent.Close()
+	}
+
+	connectButton := widget.NewButton("Подключиться", func() {
+		if roleSelection.Selected == "Зритель" {
+			join(protobuf.NodeRole_VIEWER)
+		} else {
+			join(protobuf.NodeRole_NORMAL)
+		}
+	})
+
+	watchButton := widget.NewButton("Смотреть", func() {
+		join(protobuf.NodeRole_VIEWER)
 	})
 
 	form := container.NewVBox(
 		widget.NewLabel("Список доступных игр"),
 		gamesList,
+		widget.NewForm(widget.NewFormItem("Адрес сервера", container.NewBorder(nil, nil, nil, probeButton, addressEntry))),
 		widget.NewForm(widget.NewFormItem("Имя", nameEntry)),
+		widget.NewForm(widget.NewFormItem("Запись", joinRecordEntry)),
 		widget.NewLabel("Выберите роль:"),
 		roleSelection,
-		connectButton,
+		container.NewGridWithColumns(2, connectButton, watchButton),
 	)
 
 	joinGameWindow.SetContent(form)
@@ -217,10 +352,22 @@ func ShowJoinGameWindow(parent fyne.Window) {
 		for {
 			select {
 			case <-ctx.Done():
-				break
-			default:
-				time.Sleep(5 * time.Second)
-				//TODO: refresh game list
+				return
+			case <-time.After(network.AnnouncementDelay * time.Millisecond):
+				lock.Lock()
+				addrs := append([]*net.UDPAddr(nil), manualAddrs...)
+				lock.Unlock()
+
+				for _, addr := range addrs {
+					ann, err := network.Discover(addr, network.DiscoverTimeout*time.Millisecond)
+					if err != nil {
+						log.Printf("[client] %s", err.Error())
+						continue
+					}
+					network.AddAnnouncement(&announcements, lock, ann)
+				}
+
+				gamesList.Refresh()
 			}
 		}
 	}()
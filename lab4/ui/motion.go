@@ -0,0 +1,231 @@
+package ui
+
+import (
+	"google.golang.org/protobuf/proto"
+	"math"
+	"snake_game/game"
+	"snake_game/protobuf"
+	"sync"
+	"time"
+)
+
+// frameDelay is how often the game window is redrawn, states from the master
+// come once per state_delay_ms and snakes are moved in between.
+const frameDelay = 33 * time.Millisecond
+
+// point is a field position in cells, fractional while a snake moves from
+// one cell to the next.
+type point struct {
+	x float64
+	y float64
+}
+
+// drawnSnake is a snake as it is shown in one frame, head first.
+type drawnSnake struct {
+	id     int
+	zombie bool
+	cells  []point
+}
+
+// motion keeps the last two states from the master and the direction the
+// player steered to but the master has not confirmed yet.
+//
+// Other snakes are shown moving from their cells in the previous state to
+// the cells in the newest one. The own snake is shown moving from the newest
+// state to where the master is going to put it, so a turn is seen right
+// after the key press. When the next state arrives its cells replace the
+// guess, a lost or late steer just snaps back.
+type motion struct {
+	lock     *sync.Mutex
+	width    int
+	height   int
+	delay    time.Duration
+	playerId int
+
+	order    int32
+	arrived  time.Time
+	previous map[int]*game.Snake
+	current  []*game.Snake
+
+	predicted      protobuf.Direction
+	predictedOrder int32
+}
+
+func newMotion(config *protobuf.GameConfig, playerId int) *motion {
+	return &motion{
+		lock:     new(sync.Mutex),
+		width:    int(config.GetWidth()),
+		height:   int(config.GetHeight()),
+		delay:    time.Duration(config.GetStateDelayMs()) * time.Millisecond,
+		playerId: playerId,
+		previous: make(map[int]*game.Snake),
+	}
+}
+
+// update takes the newest state, the same state seen again is ignored.
+func (m *motion) update(state *protobuf.GameState, arrived time.Time) {
+	if state == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if state.GetStateOrder() == m.order && !m.arrived.IsZero() {
+		return
+	}
+
+	m.previous = make(map[int]*game.Snake, len(m.current))
+	for _, snake := range m.current {
+		m.previous[snake.PlayerID()] = snake
+	}
+	m.current = m.current[:0:0]
+	for _, snake := range state.GetSnakes() {
+		m.current = append(m.current, game.ParseSnake(snake, m.width, m.height))
+	}
+	m.order = state.GetStateOrder()
+	m.arrived = arrived
+
+	// the steer is applied by the master on its next tick, a state that
+	// already shows it or a second one that still does not ends the guess
+	if own := m.ownSnake(); own == nil || own.HeadDirection() == m.predicted || m.order > m.predictedOrder+1 {
+		m.predicted = 0
+	}
+}
+
+// steer remembers the direction the player asked for, a reverse is dropped
+// like the master drops it.
+func (m *motion) steer(direction protobuf.Direction) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	own := m.ownSnake()
+	if own == nil || isOpposite(own.HeadDirection(), direction) {
+		return
+	}
+	m.predicted = direction
+	m.predictedOrder = m.order
+}
+
+// snakes returns all snakes as they should look at the given moment.
+func (m *motion) snakes(now time.Time) []drawnSnake {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	progress := 1.0
+	if m.delay > 0 {
+		progress = math.Min(float64(now.Sub(m.arrived))/float64(m.delay), 1)
+	}
+
+	drawn := make([]drawnSnake, 0, len(m.current))
+	for _, snake := range m.current {
+		d := drawnSnake{id: snake.PlayerID(), zombie: snake.IsZombie()}
+		if snake.PlayerID() == m.playerId && !snake.IsZombie() {
+			d.cells = m.ahead(snake, progress)
+		} else {
+			d.cells = m.between(m.previous[snake.PlayerID()], snake, progress)
+		}
+		drawn = append(drawn, d)
+	}
+	return drawn
+}
+
+// between moves a snake from its previous cells to the current ones: the head
+// slides into its new cell and the old tail slides after the body.
+func (m *motion) between(previous *game.Snake, current *game.Snake, progress float64) []point {
+	body := current.Body()
+	cells := toPoints(body)
+	if previous == nil || len(body) == 0 {
+		return cells
+	}
+
+	oldBody := previous.Body()
+	cells[0] = m.slide(oldBody[0], body[0], progress)
+	if len(oldBody) == len(body) {
+		cells = append(cells, m.slide(oldBody[len(oldBody)-1], body[len(body)-1], progress))
+	}
+	return cells
+}
+
+// ahead moves the own snake one cell further in the direction it is going
+// to take on the next tick.
+func (m *motion) ahead(snake *game.Snake, progress float64) []point {
+	body := snake.Body()
+	cells := toPoints(body)
+	if len(body) < 2 {
+		return cells
+	}
+
+	direction := snake.HeadDirection()
+	if m.predicted != 0 {
+		direction = m.predicted
+	}
+	dx, dy := offset(direction)
+	next := &protobuf.GameState_Coord{
+		X: proto.Int32(int32((int(body[0].GetX()) + dx + m.width) % m.width)),
+		Y: proto.Int32(int32((int(body[0].GetY()) + dy + m.height) % m.height)),
+	}
+
+	cells = append([]point{m.slide(body[0], next, progress)}, cells[:len(cells)-1]...)
+	return append(cells, m.slide(body[len(body)-1], body[len(body)-2], progress))
+}
+
+// slide is the point between two neighbouring cells, across the field edge
+// if they are on its opposite sides.
+func (m *motion) slide(from *protobuf.GameState_Coord, to *protobuf.GameState_Coord, progress float64) point {
+	dx := wrapStep(int(to.GetX())-int(from.GetX()), m.width)
+	dy := wrapStep(int(to.GetY())-int(from.GetY()), m.height)
+	return point{
+		x: math.Mod(float64(from.GetX())+float64(dx)*progress+float64(m.width), float64(m.width)),
+		y: math.Mod(float64(from.GetY())+float64(dy)*progress+float64(m.height), float64(m.height)),
+	}
+}
+
+func (m *motion) ownSnake() *game.Snake {
+	for _, snake := range m.current {
+		if snake.PlayerID() == m.playerId {
+			return snake
+		}
+	}
+	return nil
+}
+
+// wrapStep turns the difference of two coordinates into the shortest step
+// on the torus.
+func wrapStep(delta int, size int) int {
+	if delta > size/2 {
+		return delta - size
+	}
+	if delta < -size/2 {
+		return delta + size
+	}
+	return delta
+}
+
+func toPoints(cells []*protobuf.GameState_Coord) []point {
+	points := make([]point, len(cells))
+	for i, cell := range cells {
+		points[i] = point{x: float64(cell.GetX()), y: float64(cell.GetY())}
+	}
+	return points
+}
+
+func offset(direction protobuf.Direction) (int, int) {
+	switch direction {
+	case protobuf.Direction_UP:
+		return 0, -1
+	case protobuf.Direction_DOWN:
+		return 0, 1
+	case protobuf.Direction_LEFT:
+		return -1, 0
+	case protobuf.Direction_RIGHT:
+		return 1, 0
+	}
+	return 0, 0
+}
+
+func isOpposite(a protobuf.Direction, b protobuf.Direction) bool {
+	ax, ay := offset(a)
+	bx, by := offset(b)
+	return ax == -bx && ay == -by
+}
@@ -0,0 +1,242 @@
+package ui
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"snake_game/protobuf"
+	"sync"
+)
+
+var (
+	cellColor  = color.RGBA{R: 200, G: 200, B: 200, A: 255}
+	foodColor  = color.RGBA{R: 255, A: 255}
+	gridColor  = color.RGBA{A: 255}
+	panelColor = color.RGBA{}
+)
+
+// fieldArea is the part of a window of the given size taken by the field,
+// the rest on the right is for the texts. Both scale with the window.
+func fieldArea(width float32, height float32) (float32, float32) {
+	return width * gameWidth / screenWidth, height * gameHeight / screenHeight
+}
+
+// frame is everything the field raster shows.
+type frame struct {
+	view        view
+	fieldWidth  int
+	fieldHeight int
+	snakes      []drawnSnake
+	foods       []*protobuf.GameState_Coord
+}
+
+// sprite is one filled cell of the picture, a snake segment or a food.
+type sprite struct {
+	rect  image.Rectangle
+	color color.RGBA
+}
+
+// fieldRenderer draws the field into one image instead of a canvas object
+// per cell. Only the cells that changed since the previous picture are
+// redrawn, the whole image is redrawn when the window size or the view
+// changes.
+type fieldRenderer struct {
+	lock      *sync.Mutex
+	raster    *canvas.Raster
+	img       *image.RGBA
+	next      frame
+	drawnView view
+	drawn     map[sprite]bool
+}
+
+func newFieldRenderer() *fieldRenderer {
+	r := &fieldRenderer{
+		lock:  new(sync.Mutex),
+		drawn: make(map[sprite]bool),
+	}
+	r.raster = canvas.NewRaster(r.generate)
+	return r
+}
+
+// show asks for the frame to be drawn, fyne calls generate on its own
+// thread.
+func (r *fieldRenderer) show(f frame) {
+	r.lock.Lock()
+	r.next = f
+	r.lock.Unlock()
+	r.raster.Refresh()
+}
+
+func (r *fieldRenderer) generate(width int, height int) image.Image {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := r.next
+	if f.view.width == 0 || f.view.height == 0 {
+		return image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+
+	areaWidth, areaHeight := fieldArea(float32(width), float32(height))
+	cellWidth := float64(areaWidth) / float64(f.view.width)
+	cellHeight := float64(areaHeight) / float64(f.view.height)
+
+	full := r.img == nil || r.img.Bounds().Dx() != width || r.img.Bounds().Dy() != height || r.drawnView != f.view
+	if full {
+		r.img = image.NewRGBA(image.Rect(0, 0, width, height))
+		r.drawn = make(map[sprite]bool)
+		r.drawnView = f.view
+		draw.Draw(r.img, r.img.Bounds(), image.NewUniform(panelColor), image.Point{}, draw.Src)
+		r.drawBackground(image.Rect(0, 0, int(areaWidth), int(areaHeight)), cellWidth, cellHeight)
+	}
+
+	sprites := r.sprites(f, cellWidth, cellHeight)
+	wanted := make(map[sprite]bool, len(sprites))
+	for _, s := range sprites {
+		wanted[s] = true
+	}
+
+	// cells that are gone get the background back
+	var touched []image.Rectangle
+	for s := range r.drawn {
+		if !wanted[s] {
+			r.drawBackground(s.rect, cellWidth, cellHeight)
+			touched = append(touched, s.rect)
+		}
+	}
+
+	// new cells and the old ones something was painted over are drawn in
+	// the order of the frame, so later cells stay on top like before
+	for _, s := range sprites {
+		if r.drawn[s] && !overlapsAny(s.rect, touched) {
+			continue
+		}
+		r.drawSprite(s)
+		touched = append(touched, s.rect)
+	}
+	r.drawn = wanted
+
+	return r.img
+}
+
+// sprites lays the snakes and the food of the frame out in pixels, cells
+// outside the view are left out.
+func (r *fieldRenderer) sprites(f frame, cellWidth float64, cellHeight float64) []sprite {
+	v := f.view
+	area := image.Rect(0, 0, int(math.Round(cellWidth*float64(v.width))), int(math.Round(cellHeight*float64(v.height))))
+	toRect := func(p point) (image.Rectangle, bool) {
+		x := math.Mod(p.x-float64(v.x)+float64(f.fieldWidth), float64(f.fieldWidth))
+		y := math.Mod(p.y-float64(v.y)+float64(f.fieldHeight), float64(f.fieldHeight))
+		if x >= float64(v.width) || y >= float64(v.height) {
+			return image.Rectangle{}, false
+		}
+		// a cell sliding over the edge of the view is cut there
+		rect := image.Rect(int(x*cellWidth), int(y*cellHeight), int((x+1)*cellWidth), int((y+1)*cellHeight)).Intersect(area)
+		return rect, !rect.Empty()
+	}
+
+	var sprites []sprite
+	for _, snake := range f.snakes {
+		for i, segment := range snake.cells {
+			fillColor := getColorById(i, snake.id)
+			if snake.zombie {
+				fillColor = onCell(zombieColor(i))
+			}
+			if rect, visible := toRect(segment); visible {
+				sprites = append(sprites, sprite{rect: rect, color: fillColor})
+			}
+		}
+	}
+	for _, food := range f.foods {
+		if rect, visible := toRect(point{x: float64(food.GetX()), y: float64(food.GetY())}); visible {
+			sprites = append(sprites, sprite{rect: rect, color: foodColor})
+		}
+	}
+	return sprites
+}
+
+// drawBackground paints the empty cells with their grid lines inside rect.
+func (r *fieldRenderer) drawBackground(rect image.Rectangle, cellWidth float64, cellHeight float64) {
+	areaWidth := int(math.Round(cellWidth * float64(r.drawnView.width)))
+	areaHeight := int(math.Round(cellHeight * float64(r.drawnView.height)))
+	rect = rect.Intersect(image.Rect(0, 0, areaWidth, areaHeight))
+	if rect.Empty() {
+		return
+	}
+
+	draw.Draw(r.img, rect, image.NewUniform(cellColor), image.Point{}, draw.Src)
+	for column := int(float64(rect.Min.X) / cellWidth); column <= int(float64(rect.Max.X)/cellWidth); column++ {
+		x := int(float64(column) * cellWidth)
+		line := image.Rect(x, rect.Min.Y, x+1, rect.Max.Y).Intersect(rect)
+		draw.Draw(r.img, line, image.NewUniform(gridColor), image.Point{}, draw.Src)
+	}
+	for row := int(float64(rect.Min.Y) / cellHeight); row <= int(float64(rect.Max.Y)/cellHeight); row++ {
+		y := int(float64(row) * cellHeight)
+		line := image.Rect(rect.Min.X, y, rect.Max.X, y+1).Intersect(rect)
+		draw.Draw(r.img, line, image.NewUniform(gridColor), image.Point{}, draw.Src)
+	}
+}
+
+// drawSprite fills the cell and outlines it like the grid.
+func (r *fieldRenderer) drawSprite(s sprite) {
+	draw.Draw(r.img, s.rect, image.NewUniform(s.color), image.Point{}, draw.Src)
+	border := []image.Rectangle{
+		image.Rect(s.rect.Min.X, s.rect.Min.Y, s.rect.Max.X, s.rect.Min.Y+1),
+		image.Rect(s.rect.Min.X, s.rect.Max.Y-1, s.rect.Max.X, s.rect.Max.Y),
+		image.Rect(s.rect.Min.X, s.rect.Min.Y, s.rect.Min.X+1, s.rect.Max.Y),
+		image.Rect(s.rect.Max.X-1, s.rect.Min.Y, s.rect.Max.X, s.rect.Max.Y),
+	}
+	for _, line := range border {
+		draw.Draw(r.img, line.Intersect(s.rect), image.NewUniform(gridColor), image.Point{}, draw.Src)
+	}
+}
+
+// onCell mixes a translucent color with the empty cell under it, sprites
+// are opaque so that drawing one twice looks the same.
+func onCell(c color.RGBA) color.RGBA {
+	mix := func(top uint8, bottom uint8) uint8 {
+		return uint8((int(top)*int(c.A) + int(bottom)*(255-int(c.A))) / 255)
+	}
+	return color.RGBA{R: mix(c.R, cellColor.R), G: mix(c.G, cellColor.G), B: mix(c.B, cellColor.B), A: 255}
+}
+
+func overlapsAny(rect image.Rectangle, others []image.Rectangle) bool {
+	for _, other := range others {
+		if rect.Overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// gameScreen is the field raster with the texts and buttons on top of it.
+// The texts are few and are rebuilt every frame.
+type gameScreen struct {
+	content *fyne.Container
+	field   *fieldRenderer
+	overlay *fyne.Container
+}
+
+func newGameScreen() *gameScreen {
+	field := newFieldRenderer()
+	overlay := container.NewWithoutLayout()
+	return &gameScreen{
+		content: container.NewStack(field.raster, overlay),
+		field:   field,
+		overlay: overlay,
+	}
+}
+
+// size is the current size of the window content.
+func (s *gameScreen) size() fyne.Size {
+	return s.content.Size()
+}
+
+// fieldSize is the size of the field part of the window.
+func (s *gameScreen) fieldSize() fyne.Size {
+	width, height := fieldArea(s.size().Width, s.size().Height)
+	return fyne.NewSize(width, height)
+}
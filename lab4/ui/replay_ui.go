@@ -0,0 +1,101 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/dialog"
+	"image/color"
+	"snake_game/game"
+	"snake_game/replay"
+)
+
+func ShowOpenReplayWindow(parent fyne.Window) {
+	dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, parent)
+			return
+		}
+		if reader == nil {
+			return
+		}
+		path := reader.URI().Path()
+		reader.Close()
+
+		rep, err := replay.Load(path)
+		if err != nil {
+			dialog.ShowError(err, parent)
+			return
+		}
+
+		showReplay(rep)
+	}, parent)
+}
+
+// showReplay plays a recorded match: space pauses, left and right step,
+// up and down change the speed, home and end jump to the ends.
+func showReplay(rep *replay.Replay) {
+	replayWindow := fyne.CurrentApp().NewWindow(fmt.Sprintf("Запись: %s", rep.GameName))
+
+	screen := newGameScreen()
+	replayWindow.SetContent(screen.content)
+	replayWindow.Resize(fyne.NewSize(screenWidth, screenHeight))
+	replayWindow.Show()
+
+	player := replay.NewPlayer(rep)
+	g := game.NewGame(rep.Config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go player.Run(ctx, func(position int, frame *replay.Frame) {
+		g.Field().EditFieldFromState(frame.State)
+		updateGameCanvas(screen, g, 0, rep.GameName)
+
+		status := "▶"
+		if player.Paused() {
+			status = "⏸"
+		}
+		statusText := canvas.NewText(fmt.Sprintf("%s %d/%d x%.3g", status, position, player.Len()-1, player.Speed()), color.White)
+		statusText.TextStyle = fyne.TextStyle{Bold: true}
+		statusText.Move(fyne.NewPos(screen.size().Width-180, 70))
+		screen.overlay.Add(statusText)
+
+		for i, p := range frame.State.GetPlayers().GetPlayers() {
+			line := canvas.NewText(fmt.Sprintf("%s: %d", p.GetName(), p.GetScore()), getColorById(0, int(p.GetId())))
+			line.Move(fyne.NewPos(screen.size().Width-180, float32(100+20*i)))
+			screen.overlay.Add(line)
+		}
+		screen.overlay.Refresh()
+	})
+
+	replayWindow.Canvas().SetOnTypedKey(func(key *fyne.KeyEvent) {
+		switch key.Name {
+		case fyne.KeyEscape:
+			replayWindow.Close()
+		case fyne.KeySpace:
+			player.TogglePause()
+		case fyne.KeyRight:
+			player.SetPaused(true)
+			player.Step(1)
+		case fyne.KeyLeft:
+			player.SetPaused(true)
+			player.Step(-1)
+		case fyne.KeyPageDown:
+			player.Step(10)
+		case fyne.KeyPageUp:
+			player.Step(-10)
+		case fyne.KeyUp:
+			player.SetSpeed(player.Speed() * 2)
+		case fyne.KeyDown:
+			player.SetSpeed(player.Speed() / 2)
+		case fyne.KeyHome:
+			player.Seek(0)
+		case fyne.KeyEnd:
+			player.Seek(player.Len() - 1)
+		}
+	})
+
+	replayWindow.SetOnClosed(func() {
+		cancel()
+	})
+}
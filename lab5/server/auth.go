@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+type userEntry struct {
+	password string
+	limits   quotaLimits
+}
+
+// loadUsers reads a users file with one "name:password[:daily[:monthly]]"
+// entry per line. Limits use the K/M/G/T suffixes; an empty or missing
+// limit falls back to the -quota-daily and -quota-monthly defaults.
+func loadUsers(path string, defaults quotaLimits) (map[string]userEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]userEntry)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:password[:daily[:monthly]]", path, lineNum)
+		}
+		if len(fields[0]) > 255 || len(fields[1]) > 255 {
+			return nil, fmt.Errorf("%s:%d: name and password are limited to 255 bytes", path, lineNum)
+		}
+
+		entry := userEntry{password: fields[1], limits: defaults}
+		if len(fields) > 2 && fields[2] != "" {
+			entry.limits.daily, err = parseBytes(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+			}
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			entry.limits.monthly, err = parseBytes(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+			}
+		}
+		users[fields[0]] = entry
+	}
+	return users, scanner.Err()
+}
+
+// authenticate runs the username/password subnegotiation from RFC 1929.
+func authenticate(conn net.Conn, users map[string]userEntry) (string, bool) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		return "", false
+	}
+
+	if buf[0] != 0x01 {
+		log.Printf("Unknown auth subnegotiation version: %x", buf[0])
+		return "", false
+	}
+
+	name := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, name)
+	if err != nil {
+		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		return "", false
+	}
+
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		return "", false
+	}
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
+		return "", false
+	}
+
+	entry, ok := users[string(name)]
+	ok = ok && subtle.ConstantTimeCompare([]byte(entry.password), password) == 1
+
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	_, err = conn.Write([]byte{0x01, status})
+	if err != nil {
+		log.Printf("Error writing to %s: %v", conn.RemoteAddr().String(), err)
+		return "", false
+	}
+
+	if !ok {
+		log.Printf("Authentication failed for user %q from %s", string(name), conn.RemoteAddr().String())
+		return "", false
+	}
+	return string(name), true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// captureFilter selects the sessions recorded to the capture file. Every
+// non-empty field must match; an empty filter matches every session.
+type captureFilter struct {
+	users      []string
+	clientNets []*net.IPNet
+	dstNets    []*net.IPNet
+	dstHosts   []string
+	dstPort    int
+}
+
+// parseCaptureFilter parses a comma separated list of terms:
+//
+//	user=name         authenticated user is name
+//	client=CIDR       client address is inside CIDR
+//	dst=host          requested host name or address equals host
+//	dst=CIDR          resolved destination address is inside CIDR
+//	port=N            destination port equals N
+func parseCaptureFilter(spec string) (*captureFilter, error) {
+	f := &captureFilter{}
+	if strings.TrimSpace(spec) == "" {
+		return f, nil
+	}
+
+	for _, term := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(term), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("bad capture filter term %q", term)
+		}
+		key, value := kv[0], kv[1]
+
+		switch key {
+		case "user":
+			f.users = append(f.users, value)
+		case "client":
+			ipNet, err := parseNet(value)
+			if err != nil {
+				return nil, err
+			}
+			f.clientNets = append(f.clientNets, ipNet)
+		case "dst":
+			if ipNet, err := parseNet(value); err == nil {
+				f.dstNets = append(f.dstNets, ipNet)
+			} else {
+				f.dstHosts = append(f.dstHosts, strings.ToLower(value))
+			}
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("bad capture filter port %q", value)
+			}
+			f.dstPort = port
+		default:
+			return nil, fmt.Errorf("unknown capture filter key %q", key)
+		}
+	}
+	return f, nil
+}
+
+func parseNet(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("bad address %q", value)
+		}
+		if ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	return ipNet, err
+}
+
+func (f *captureFilter) match(user string, client net.Addr, address string, target net.Addr) bool {
+	clientIP := addrIP(client)
+	targetIP := addrIP(target)
+	host, portStr, _ := net.SplitHostPort(address)
+
+	if len(f.users) > 0 {
+		found := false
+		for _, u := range f.users {
+			if u == user {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.clientNets) > 0 && !containsIP(f.clientNets, clientIP) {
+		return false
+	}
+
+	if f.dstPort != 0 && portStr != strconv.Itoa(f.dstPort) {
+		return false
+	}
+
+	if len(f.dstNets) == 0 && len(f.dstHosts) == 0 {
+		return true
+	}
+	if containsIP(f.dstNets, targetIP) {
+		return true
+	}
+	for _, h := range f.dstHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
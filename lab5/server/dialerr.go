@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// dialErrorCode maps an error returned by net.Dial to the SOCKS5 reply code
+// (RFC 1928, section 6) that best describes it to the client.
+func dialErrorCode(err error) byte {
+	if err == nil {
+		return 0x00
+	}
+
+	var remoteErr *remoteDialError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.code
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return 0x06
+		}
+		return 0x04
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 0x05
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return 0x04
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return 0x03
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, os.ErrDeadlineExceeded):
+		return 0x06
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return 0x02
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0x06
+	}
+
+	return 0x01
+}
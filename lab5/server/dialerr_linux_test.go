@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDialErrorCodeFullBacklog gets a real dial timeout on loopback: Linux
+// drops the SYN to a listener whose accept queue is full, like a blackholed
+// address would.
+func TestDialErrorCodeFullBacklog(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	// nobody accepts, the first connections fill the queue
+	var dialErr error
+	for i := 0; i < 4 && dialErr == nil; i++ {
+		var conn net.Conn
+		conn, dialErr = net.DialTimeout("tcp", addr, 200*time.Millisecond)
+		if dialErr == nil {
+			defer conn.Close()
+		}
+	}
+	if dialErr == nil {
+		t.Skipf("%s kept accepting connections with a full backlog", addr)
+	}
+	if code := dialErrorCode(dialErr); code != 0x06 {
+		t.Errorf("dial to full backlog %s: %v gave %#02x, want 0x06", addr, dialErr, code)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func dialOpError(err error) error {
+	return &net.OpError{
+		Op:   "dial",
+		Net:  "tcp",
+		Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80},
+		Err:  err,
+	}
+}
+
+func TestDialErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code byte
+	}{
+		{"success", nil, 0x00},
+		{"refused port", dialOpError(os.NewSyscallError("connect", syscall.ECONNREFUSED)), 0x05},
+		{"blackholed address", dialOpError(os.NewSyscallError("connect", syscall.ETIMEDOUT)), 0x06},
+		{"dial timeout", dialOpError(os.ErrDeadlineExceeded), 0x06},
+		{"context timeout", dialOpError(context.DeadlineExceeded), 0x06},
+		{"unresolvable host", dialOpError(&net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}), 0x04},
+		{"dns timeout", dialOpError(&net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}), 0x06},
+		{"host unreachable", dialOpError(os.NewSyscallError("connect", syscall.EHOSTUNREACH)), 0x04},
+		{"host down", dialOpError(os.NewSyscallError("connect", syscall.EHOSTDOWN)), 0x04},
+		{"network unreachable", dialOpError(os.NewSyscallError("connect", syscall.ENETUNREACH)), 0x03},
+		{"network down", dialOpError(os.NewSyscallError("connect", syscall.ENETDOWN)), 0x03},
+		{"not allowed", dialOpError(os.NewSyscallError("connect", syscall.EACCES)), 0x02},
+		{"not permitted", dialOpError(os.NewSyscallError("connect", syscall.EPERM)), 0x02},
+		{"bare errno", syscall.ECONNREFUSED, 0x05},
+		{"wrapped twice", fmt.Errorf("tunnel: %w", dialOpError(syscall.ENETUNREACH)), 0x03},
+		{"remote dial", fmt.Errorf("open stream: %w", &remoteDialError{code: 0x05}), 0x05},
+		{"unknown", dialOpError(syscall.EINVAL), 0x01},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := dialErrorCode(test.err); code != test.code {
+				t.Errorf("dialErrorCode(%v) = %#02x, want %#02x", test.err, code, test.code)
+			}
+		})
+	}
+}
+
+func TestDialErrorCodeClosedPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		conn.Close()
+		t.Skipf("%s accepted a connection after its listener was closed", addr)
+	}
+	if code := dialErrorCode(err); code != 0x05 {
+		t.Errorf("dial to closed port %s: %v gave %#02x, want 0x05", addr, err, code)
+	}
+}
+
+func TestDialErrorCodeBlackhole(t *testing.T) {
+	// nothing answers on this address, the SYN is dropped until the dial
+	// times out; a sandbox without a route fails at once instead
+	const addr = "10.255.255.1:81"
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, 200*time.Millisecond)
+	if err == nil {
+		conn.Close()
+		t.Skipf("%s accepted a connection, the network intercepts dials", addr)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Skipf("dial to %s failed after %v without waiting: %v", addr, elapsed, err)
+	}
+	if code := dialErrorCode(err); code != 0x06 {
+		t.Errorf("dial to blackholed %s: %v gave %#02x, want 0x06", addr, err, code)
+	}
+}
@@ -0,0 +1,364 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+const (
+	epollReadBuffer = 64 * 1024
+	epollMaxEvents  = 256
+)
+
+var pendingPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, epollReadBuffer)
+	},
+}
+
+// epollEngine relays established sessions on a few event loop threads
+// instead of two io.Copy goroutines per session. Every loop reads into one
+// shared buffer; a session only holds memory of its own while its peer
+// cannot keep up, and that memory comes from pendingPool.
+type epollEngine struct {
+	loops []*epollLoop
+	lock  sync.Mutex
+	next  int
+}
+
+type epollLoop struct {
+	epfd int
+	lock sync.Mutex
+	ends map[int]*relayEnd
+	buf  []byte
+}
+
+type relayEnd struct {
+	fd         int
+	fromClient bool
+	peer       *relayEnd
+	pair       *relayPair
+	pending    []byte
+	sent       int
+	readDone   bool
+	removed    bool
+	events     uint32
+}
+
+type relayPair struct {
+	loop    *epollLoop
+	client  *relayEnd
+	target  *relayEnd
+	capture *tcpCapture
+	quota   *quotaSession
+	closed  bool
+}
+
+func newEpollEngine() (*epollEngine, error) {
+	engine := &epollEngine{}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		loop := &epollLoop{epfd: epfd, ends: make(map[int]*relayEnd), buf: make([]byte, epollReadBuffer)}
+		engine.loops = append(engine.loops, loop)
+		go loop.run()
+	}
+	return engine, nil
+}
+
+// dupFd returns a duplicate of the socket behind conn, so the engine owns a
+// descriptor that outlives the net.Conn the handler closes.
+func dupFd(conn net.Conn) (int, error) {
+	if proxied, ok := conn.(*proxiedConn); ok {
+		conn = proxied.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return -1, fmt.Errorf("%T: %w", conn, errNotTCP)
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	fd := -1
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	syscall.CloseOnExec(fd)
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// relay takes over a session. On success the caller may close both
+// net.Conns; the engine keeps relaying on its own descriptors and ends the
+// quota session when it is done.
+func (e *epollEngine) relay(conn net.Conn, targetConn net.Conn, capture *tcpCapture, quota *quotaSession) error {
+	clientFd, err := dupFd(conn)
+	if err != nil {
+		return err
+	}
+	targetFd, err := dupFd(targetConn)
+	if err != nil {
+		syscall.Close(clientFd)
+		return err
+	}
+
+	e.lock.Lock()
+	loop := e.loops[e.next%len(e.loops)]
+	e.next++
+	e.lock.Unlock()
+
+	pair := &relayPair{
+		loop:    loop,
+		capture: capture,
+		quota:   quota,
+	}
+	pair.client = &relayEnd{fd: clientFd, fromClient: true, pair: pair}
+	pair.target = &relayEnd{fd: targetFd, pair: pair}
+	pair.client.peer = pair.target
+	pair.target.peer = pair.client
+
+	loop.lock.Lock()
+	defer loop.lock.Unlock()
+
+	for _, end := range []*relayEnd{pair.client, pair.target} {
+		end.events = syscall.EPOLLIN
+		loop.ends[end.fd] = end
+		err = syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_ADD, end.fd, &syscall.EpollEvent{Events: end.events, Fd: int32(end.fd)})
+		if err != nil {
+			delete(loop.ends, pair.client.fd)
+			delete(loop.ends, pair.target.fd)
+			syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_DEL, pair.client.fd, nil)
+			syscall.Close(clientFd)
+			syscall.Close(targetFd)
+			return err
+		}
+	}
+
+	// until now the handler's kill still applies, it relays the session
+	// itself if the engine fails to take it
+	if quota != nil {
+		quota.setKill(pair.shutdown)
+	}
+	return nil
+}
+
+func (l *epollLoop) run() {
+	events := make([]syscall.EpollEvent, epollMaxEvents)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Printf("Error waiting for epoll events: %v", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			l.lock.Lock()
+			end := l.ends[int(events[i].Fd)]
+			l.lock.Unlock()
+			if end == nil || end.pair.closed {
+				continue
+			}
+			l.handle(end, events[i].Events)
+		}
+	}
+}
+
+func (l *epollLoop) handle(end *relayEnd, events uint32) {
+	pair := end.pair
+	failed := events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0
+
+	if end.wantsRead() && events&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		l.handleRead(end)
+	}
+	if !pair.closed && end.pending != nil && events&(syscall.EPOLLOUT|syscall.EPOLLERR) != 0 {
+		l.handleWrite(end)
+	}
+	if pair.closed {
+		return
+	}
+
+	if failed && !end.wantsRead() {
+		if end.pending != nil || !end.peer.readDone {
+			l.closePair(pair)
+			return
+		}
+		end.removed = true
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, end.fd, nil)
+	}
+
+	l.update(end)
+	l.update(end.peer)
+	l.finishIfDone(pair)
+}
+
+func (end *relayEnd) wantsRead() bool {
+	return !end.readDone && end.peer.pending == nil
+}
+
+func (l *epollLoop) handleRead(end *relayEnd) {
+	pair := end.pair
+
+	n, err := syscall.Read(end.fd, l.buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if err != nil {
+		l.closePair(pair)
+		return
+	}
+
+	if n == 0 {
+		end.readDone = true
+		if pair.capture != nil {
+			pair.capture.finish(end.fromClient)
+		}
+		if end.peer.pending == nil {
+			syscall.Shutdown(end.peer.fd, syscall.SHUT_WR)
+		}
+		return
+	}
+
+	data := l.buf[:n]
+	if pair.capture != nil {
+		pair.capture.record(end.fromClient, data)
+	}
+	if pair.quota != nil && !pair.quota.store.add(pair.quota.user, int64(n)) && pair.quota.store.cut {
+		l.closePair(pair)
+		return
+	}
+
+	written, err := syscall.Write(end.peer.fd, data)
+	if err != nil && err != syscall.EAGAIN {
+		l.closePair(pair)
+		return
+	}
+	if written < 0 {
+		written = 0
+	}
+	if written < n {
+		end.peer.pending = append(pendingPool.Get().([]byte)[:0], data[written:]...)
+	}
+}
+
+func (l *epollLoop) handleWrite(end *relayEnd) {
+	written, err := syscall.Write(end.fd, end.pending[end.sent:])
+	if err == syscall.EAGAIN {
+		return
+	}
+	if err != nil {
+		l.closePair(end.pair)
+		return
+	}
+
+	end.sent += written
+	if end.sent == len(end.pending) {
+		pendingPool.Put(end.pending[:0])
+		end.pending = nil
+		end.sent = 0
+		if end.peer.readDone {
+			syscall.Shutdown(end.fd, syscall.SHUT_WR)
+		}
+	}
+}
+
+func (l *epollLoop) update(end *relayEnd) {
+	if end.removed || end.pair.closed {
+		return
+	}
+
+	var events uint32
+	if end.wantsRead() {
+		events |= syscall.EPOLLIN
+	}
+	if end.pending != nil {
+		events |= syscall.EPOLLOUT
+	}
+	if events == end.events {
+		return
+	}
+
+	end.events = events
+	err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, end.fd, &syscall.EpollEvent{Events: events, Fd: int32(end.fd)})
+	if err != nil {
+		l.closePair(end.pair)
+	}
+}
+
+func (l *epollLoop) finishIfDone(pair *relayPair) {
+	if pair.closed {
+		return
+	}
+	if pair.client.readDone && pair.target.readDone && pair.client.pending == nil && pair.target.pending == nil {
+		l.closePair(pair)
+	}
+}
+
+// shutdown cuts a session from outside the loop, the loop then closes it.
+// It holds the loop lock, so the descriptors cannot be closed, and their
+// numbers reused by another connection, while it runs.
+func (pair *relayPair) shutdown() {
+	pair.loop.lock.Lock()
+	defer pair.loop.lock.Unlock()
+	if pair.closed {
+		return
+	}
+	syscall.Shutdown(pair.client.fd, syscall.SHUT_RDWR)
+	syscall.Shutdown(pair.target.fd, syscall.SHUT_RDWR)
+}
+
+// closePair runs on the loop thread, the only one that sets pair.closed.
+func (l *epollLoop) closePair(pair *relayPair) {
+	if pair.closed {
+		return
+	}
+
+	l.lock.Lock()
+	pair.closed = true
+	for _, end := range []*relayEnd{pair.client, pair.target} {
+		delete(l.ends, end.fd)
+		if !end.removed {
+			syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, end.fd, nil)
+		}
+		syscall.Close(end.fd)
+		if end.pending != nil {
+			pendingPool.Put(end.pending[:0])
+			end.pending = nil
+		}
+	}
+	l.lock.Unlock()
+
+	if pair.capture != nil {
+		pair.capture.finish(true)
+		pair.capture.finish(false)
+	}
+	if pair.quota != nil {
+		pair.quota.end()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, accepted
+}
+
+func TestEpollQuotaKillAfterClose(t *testing.T) {
+	engine, err := newEpollEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &quotaStore{
+		users:  map[string]userEntry{},
+		usage:  make(map[string]*userUsage),
+		active: make(map[string]map[*quotaSession]bool),
+	}
+
+	client, handlerSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	quota := store.startSession("alice", func() {})
+	if err := engine.relay(handlerSide, targetSide, nil, quota); err != nil {
+		t.Fatal(err)
+	}
+	handlerSide.Close()
+	targetSide.Close()
+
+	client.Close()
+	target.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		store.lock.Lock()
+		active := len(store.active["alice"])
+		store.lock.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("relayed session did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// new sockets get the lowest free descriptor numbers, among them the
+	// ones the engine just closed, a late kill must not touch them
+	var conns [][2]net.Conn
+	for i := 0; i < 10; i++ {
+		a, b := tcpPair(t)
+		defer a.Close()
+		defer b.Close()
+		conns = append(conns, [2]net.Conn{a, b})
+	}
+	quota.kill()
+
+	for _, pair := range conns {
+		if _, err := pair[0].Write([]byte("still here")); err != nil {
+			t.Fatalf("late kill cut an unrelated connection: %v", err)
+		}
+		pair[1].SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len("still here"))
+		if _, err := io.ReadFull(pair[1], buf); err != nil {
+			t.Fatalf("late kill cut an unrelated connection: %v", err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+type epollEngine struct{}
+
+func newEpollEngine() (*epollEngine, error) {
+	return nil, fmt.Errorf("the epoll engine is only available on Linux")
+}
+
+func (e *epollEngine) relay(conn net.Conn, targetConn net.Conn, capture *tcpCapture, quota *quotaSession) error {
+	return fmt.Errorf("the epoll engine is only available on Linux")
+}
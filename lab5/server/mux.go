@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	frameOpen   = 0x01
+	frameResult = 0x02
+	frameData   = 0x03
+	frameFin    = 0x04
+	frameClose  = 0x05
+	frameWindow = 0x06
+
+	frameHeaderSize  = 5
+	frameMaxPayload  = tunnelMaxRecord - frameHeaderSize
+	streamOpenTTL    = dialTimeout + 5*time.Second
+	muxAcceptBacklog = 64
+	streamWindow     = 256 * 1024
+)
+
+var errStreamClosed = errors.New("stream closed")
+
+// remoteDialError is returned when the far end of the tunnel failed to reach
+// the target; code is the SOCKS5 reply it derived from its own dial error.
+type remoteDialError struct {
+	code byte
+}
+
+func (e *remoteDialError) Error() string {
+	return fmt.Sprintf("remote dial failed with reply %x", e.code)
+}
+
+// muxSession multiplexes many streams over a single secureConn. The client
+// side opens streams, the server side accepts them.
+type muxSession struct {
+	sc      *secureConn
+	lock    sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	accept  chan *muxStream
+	done    chan struct{}
+	err     error
+}
+
+func newMuxSession(sc *secureConn) *muxSession {
+	s := &muxSession{
+		sc:      sc,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+		accept:  make(chan *muxStream, muxAcceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *muxSession) writeFrame(kind byte, id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[frameHeaderSize:], payload)
+	return s.sc.writeRecord(frame)
+}
+
+func (s *muxSession) readLoop() {
+	var err error
+	for {
+		var record []byte
+		record, err = s.sc.readRecord()
+		if err != nil {
+			break
+		}
+		if len(record) < frameHeaderSize {
+			err = fmt.Errorf("short tunnel frame")
+			break
+		}
+
+		kind := record[0]
+		id := binary.BigEndian.Uint32(record[1:])
+		payload := record[frameHeaderSize:]
+
+		if kind == frameOpen {
+			address, client := parseOpenPayload(payload, s.sc.conn.RemoteAddr())
+			stream := s.addStream(id, address, client)
+			select {
+			case s.accept <- stream:
+			default:
+				log.Printf("Tunnel accept backlog full, dropping stream to %s", address)
+				s.removeStream(id)
+				s.writeFrame(frameResult, id, []byte{0x01})
+			}
+			continue
+		}
+
+		s.lock.Lock()
+		stream := s.streams[id]
+		s.lock.Unlock()
+		if stream == nil {
+			continue
+		}
+
+		switch kind {
+		case frameResult:
+			// only the first result counts, a duplicate or one that comes
+			// after open gave up must not block the session
+			if len(payload) == 1 {
+				select {
+				case stream.result <- payload[0]:
+				default:
+				}
+			}
+		case frameData:
+			if !stream.push(payload) {
+				log.Printf("Tunnel stream %d overran its window, resetting", id)
+				stream.reset()
+				s.removeStream(id)
+				s.writeFrame(frameClose, id, nil)
+			}
+		case frameWindow:
+			if len(payload) == 4 {
+				stream.addWindow(binary.BigEndian.Uint32(payload))
+			}
+		case frameFin:
+			stream.pushEOF()
+		case frameClose:
+			stream.reset()
+			s.removeStream(id)
+		}
+	}
+
+	s.shutdown(err)
+}
+
+func (s *muxSession) shutdown(err error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.lock.Unlock()
+
+	close(s.done)
+	s.sc.Close()
+	for _, stream := range streams {
+		stream.reset()
+	}
+}
+
+// parseOpenPayload splits a frameOpen payload into the target address and
+// the address of the SOCKS client that requested it, if the peer sent one.
+func parseOpenPayload(payload []byte, fallback net.Addr) (string, net.Addr) {
+	parts := strings.SplitN(string(payload), "\x00", 2)
+	if len(parts) == 2 {
+		if client, err := net.ResolveTCPAddr("tcp", parts[1]); err == nil && client.IP != nil {
+			return parts[0], client
+		}
+	}
+	return parts[0], fallback
+}
+
+func (s *muxSession) addStream(id uint32, address string, client net.Addr) *muxStream {
+	stream := newMuxStream(s, id, address, client)
+	s.lock.Lock()
+	s.streams[id] = stream
+	s.lock.Unlock()
+	return stream
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	s.lock.Unlock()
+}
+
+func (s *muxSession) streamCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// open asks the far end to dial address on behalf of client and waits for
+// its reply code.
+func (s *muxSession) open(address string, client net.Addr) (net.Conn, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		err := s.err
+		s.lock.Unlock()
+		return nil, err
+	}
+	id := s.nextID
+	s.nextID++
+	s.lock.Unlock()
+
+	payload := address
+	if client != nil {
+		payload += "\x00" + client.String()
+	}
+
+	stream := s.addStream(id, address, client)
+	err := s.writeFrame(frameOpen, id, []byte(payload))
+	if err != nil {
+		s.removeStream(id)
+		s.shutdown(err)
+		return nil, err
+	}
+
+	select {
+	case code := <-stream.result:
+		if code != 0x00 {
+			s.removeStream(id)
+			return nil, &remoteDialError{code: code}
+		}
+		return stream, nil
+	case <-s.done:
+		return nil, s.err
+	case <-time.After(streamOpenTTL):
+		stream.Close()
+		return nil, &remoteDialError{code: 0x06}
+	}
+}
+
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+func (s *muxSession) Close() error {
+	s.shutdown(io.EOF)
+	return nil
+}
+
+// muxStream is one proxied connection inside a muxSession. It implements
+// net.Conn plus CloseWrite, so transferData can relay it like a TCP socket.
+//
+// Each direction is flow controlled: a writer may have at most sendWindow
+// unacknowledged bytes in flight, and the reader grants more with a
+// frameWindow once it has consumed half of streamWindow. A slow client
+// therefore stalls only its own stream instead of the whole session.
+//
+// Deadlines work like on a socket: a Read or Write that would wait past
+// its deadline returns os.ErrDeadlineExceeded, the stream stays usable.
+type muxStream struct {
+	session    *muxSession
+	id         uint32
+	address    string
+	client     net.Addr
+	result     chan byte
+	lock       sync.Mutex
+	cond       *sync.Cond
+	buf        []byte
+	eof        bool
+	closed     bool
+	writeDone  bool
+	sendWindow uint32
+	consumed   uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newMuxStream(session *muxSession, id uint32, address string, client net.Addr) *muxStream {
+	stream := &muxStream{
+		session:    session,
+		id:         id,
+		address:    address,
+		client:     client,
+		result:     make(chan byte, 1),
+		sendWindow: streamWindow,
+	}
+	stream.cond = sync.NewCond(&stream.lock)
+	return stream
+}
+
+func (st *muxStream) push(data []byte) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.closed {
+		return true
+	}
+	if len(st.buf)+len(data) > streamWindow {
+		return false
+	}
+	st.buf = append(st.buf, data...)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *muxStream) addWindow(increment uint32) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.sendWindow += increment
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) pushEOF() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.eof = true
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) reset() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.closed = true
+	st.writeDone = true
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	for len(st.buf) == 0 && !st.eof && !st.closed {
+		if deadlinePassed(st.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+
+	if len(st.buf) > 0 {
+		n := copy(p, st.buf)
+		st.buf = st.buf[n:]
+
+		st.consumed += uint32(n)
+		if st.consumed >= streamWindow/2 && !st.closed {
+			increment := make([]byte, 4)
+			binary.BigEndian.PutUint32(increment, st.consumed)
+			st.consumed = 0
+			st.lock.Unlock()
+			st.session.writeFrame(frameWindow, st.id, increment)
+			st.lock.Lock()
+		}
+		return n, nil
+	}
+	if st.eof {
+		return 0, io.EOF
+	}
+	return 0, errStreamClosed
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.lock.Lock()
+		for st.sendWindow == 0 && !st.writeDone {
+			if deadlinePassed(st.writeDeadline) {
+				st.lock.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			st.cond.Wait()
+		}
+		if st.writeDone {
+			st.lock.Unlock()
+			return written, errStreamClosed
+		}
+
+		n := len(p)
+		if n > frameMaxPayload {
+			n = frameMaxPayload
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.lock.Unlock()
+
+		err := st.session.writeFrame(frameData, st.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (st *muxStream) CloseWrite() error {
+	st.lock.Lock()
+	if st.writeDone {
+		st.lock.Unlock()
+		return nil
+	}
+	st.writeDone = true
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	return st.session.writeFrame(frameFin, st.id, nil)
+}
+
+func (st *muxStream) Close() error {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.writeDone = true
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	st.session.removeStream(st.id)
+	return st.session.writeFrame(frameClose, st.id, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.session.sc.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	host, port, err := net.SplitHostPort(st.address)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			portNum, _ := strconv.Atoi(port)
+			return &net.TCPAddr{IP: ip, Port: portNum}
+		}
+	}
+	return st.session.sc.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.readDeadline = t
+	st.readTimer = st.wakeAt(st.readTimer, t)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.writeDeadline = t
+	st.writeTimer = st.wakeAt(st.writeTimer, t)
+	return nil
+}
+
+// wakeAt replaces timer with one that wakes the waiting Read and Write
+// calls at t so they can see the deadline has passed.
+func (st *muxStream) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	st.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		st.lock.Lock()
+		st.cond.Broadcast()
+		st.lock.Unlock()
+	})
+}
+
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// muxPair connects two sessions through a loopback tunnel.
+func muxPair(t *testing.T) (*muxSession, *muxSession) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	psk := tunnelKey("test")
+	accepted := make(chan *secureConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		sc, err := tunnelHandshake(conn, psk, false)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- sc
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, err := tunnelHandshake(conn, psk, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-accepted
+	if serverConn == nil {
+		t.Fatal("server side of the tunnel failed the handshake")
+	}
+
+	client, server := newMuxSession(clientConn), newMuxSession(serverConn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// openStream opens a stream from client and accepts it on server, the
+// server answers with every result code in results.
+func openStream(t *testing.T, client *muxSession, server *muxSession, results ...byte) (net.Conn, *muxStream) {
+	accepted := make(chan *muxStream, 1)
+	go func() {
+		stream, err := server.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		for _, code := range results {
+			server.writeFrame(frameResult, stream.id, []byte{code})
+		}
+		accepted <- stream
+	}()
+
+	local, err := client.open("example.com:80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatal("server did not accept the stream")
+	}
+	return local, remote
+}
+
+func TestMuxDuplicateResult(t *testing.T) {
+	client, server := muxPair(t)
+
+	// the extra results would block the read loop of the client session
+	// if it waited for open to take them
+	first, _ := openStream(t, client, server, 0x00, 0x00, 0x00)
+	defer first.Close()
+
+	second, remote := openStream(t, client, server, 0x00)
+	defer second.Close()
+
+	go remote.Write([]byte("hello"))
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(second, buf); err != nil {
+		t.Fatalf("session stalled after duplicate results: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("read %q, want %q", buf, "hello")
+	}
+}
+
+func TestMuxStreamReadDeadline(t *testing.T) {
+	client, server := muxPair(t)
+	local, remote := openStream(t, client, server, 0x00)
+	defer local.Close()
+
+	local.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := local.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read with a passed deadline returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("read returned after %s, the deadline was 50ms", waited)
+	}
+
+	// the stream stays usable once the deadline is cleared
+	local.SetReadDeadline(time.Time{})
+	remote.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := local.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("read after clearing the deadline: %q, %v", buf, err)
+	}
+}
+
+func TestMuxStreamWriteDeadline(t *testing.T) {
+	client, server := muxPair(t)
+	local, _ := openStream(t, client, server, 0x00)
+	defer local.Close()
+
+	// nobody reads on the far end, the window runs out
+	local.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := local.Write(make([]byte, 2*streamWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write past the window returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if n != streamWindow {
+		t.Fatalf("wrote %d bytes before the deadline, want the window of %d", n, streamWindow)
+	}
+}
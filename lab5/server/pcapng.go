@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngSectionHeader = 0x0A0D0D0A
+	pcapngInterfaceDesc = 0x00000001
+	pcapngEnhancedPkt   = 0x00000006
+	pcapngByteOrder     = 0x1A2B3C4D
+	linkTypeRaw         = 101
+	captureSnapLen      = 65535
+	captureSegmentSize  = 16384
+)
+
+type pcapngWriter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func openPcapng(path string) (*pcapngWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &pcapngWriter{file: file}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], captureSnapLen)
+
+	err = w.writeBlock(pcapngSectionHeader, shb)
+	if err == nil {
+		err = w.writeBlock(pcapngInterfaceDesc, idb)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	padded := (len(body) + 3) &^ 3
+	total := 12 + padded
+
+	block := make([]byte, total)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], uint32(total))
+	copy(block[8:], body)
+	binary.LittleEndian.PutUint32(block[total-4:], uint32(total))
+
+	_, err := w.file.Write(block)
+	return err
+}
+
+func (w *pcapngWriter) writePacket(ts time.Time, packet []byte) error {
+	body := make([]byte, 20+len(packet))
+	usec := uint64(ts.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(body[0:], 0)
+	binary.LittleEndian.PutUint32(body[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	copy(body[20:], packet)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writeBlock(pcapngEnhancedPkt, body)
+}
+
+func (w *pcapngWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
+
+const (
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+)
+
+type tcpEndpoint struct {
+	ip   net.IP
+	port uint16
+	seq  uint32
+}
+
+// tcpCapture synthesizes a TCP connection between the client and the target
+// out of the plaintext payloads relayed by transferData, so the capture can
+// be followed as a regular stream in Wireshark.
+type tcpCapture struct {
+	lock   sync.Mutex
+	writer *pcapngWriter
+	client tcpEndpoint
+	target tcpEndpoint
+	closed [2]bool
+	// ipv6 is set when either side is IPv6, the IPv4 side is then written
+	// as a v4-mapped address
+	ipv6 bool
+}
+
+func newTcpCapture(writer *pcapngWriter, client net.Addr, target net.Addr) *tcpCapture {
+	c := &tcpCapture{
+		writer: writer,
+		client: endpointFromAddr(client, 1000),
+		target: endpointFromAddr(target, 5000),
+	}
+
+	c.ipv6 = c.client.ip.To4() == nil || c.target.ip.To4() == nil
+	if c.ipv6 {
+		c.client.ip = c.client.ip.To16()
+		c.target.ip = c.target.ip.To16()
+	} else {
+		c.client.ip = c.client.ip.To4()
+		c.target.ip = c.target.ip.To4()
+	}
+
+	c.emit(&c.client, &c.target, tcpFlagSyn, nil)
+	c.client.seq++
+	c.emit(&c.target, &c.client, tcpFlagSyn|tcpFlagAck, nil)
+	c.target.seq++
+	c.emit(&c.client, &c.target, tcpFlagAck, nil)
+	return c
+}
+
+func endpointFromAddr(addr net.Addr, seq uint32) tcpEndpoint {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpEndpoint{ip: tcpAddr.IP, port: uint16(tcpAddr.Port), seq: seq}
+	}
+	return tcpEndpoint{ip: net.IPv4zero, seq: seq}
+}
+
+func (c *tcpCapture) record(fromClient bool, payload []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	src, dst := &c.target, &c.client
+	if fromClient {
+		src, dst = &c.client, &c.target
+	}
+
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > captureSegmentSize {
+			n = captureSegmentSize
+		}
+		c.emit(src, dst, tcpFlagPsh|tcpFlagAck, payload[:n])
+		src.seq += uint32(n)
+		payload = payload[n:]
+	}
+}
+
+func (c *tcpCapture) finish(fromClient bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	idx := 0
+	src, dst := &c.target, &c.client
+	if fromClient {
+		idx = 1
+		src, dst = &c.client, &c.target
+	}
+
+	if c.closed[idx] {
+		return
+	}
+	c.closed[idx] = true
+
+	c.emit(src, dst, tcpFlagFin|tcpFlagAck, nil)
+	src.seq++
+	c.emit(dst, src, tcpFlagAck, nil)
+}
+
+func (c *tcpCapture) emit(src *tcpEndpoint, dst *tcpEndpoint, flags byte, payload []byte) {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpFlagAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var packet []byte
+	var pseudo []byte
+	if !c.ipv6 {
+		packet = make([]byte, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:16], src.ip.To4())
+		copy(packet[16:20], dst.ip.To4())
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20]))
+
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:4], src.ip.To4())
+		copy(pseudo[4:8], dst.ip.To4())
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		packet = make([]byte, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:24], src.ip.To16())
+		copy(packet[24:40], dst.ip.To16())
+
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:16], src.ip.To16())
+		copy(pseudo[16:32], dst.ip.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+	copy(packet[len(packet)-len(tcp):], tcp)
+
+	err := c.writer.writePacket(time.Now(), packet)
+	if err != nil {
+		log.Printf("Error writing capture: %v", err)
+	}
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// captureWriter records everything successfully written to w as payload of
+// one direction of the synthesized connection.
+type captureWriter struct {
+	w          io.Writer
+	capture    *tcpCapture
+	fromClient bool
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.capture.record(cw.fromClient, p[:n])
+	}
+	return n, err
+}
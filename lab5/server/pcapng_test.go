@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readPcapngPackets returns the packets of the enhanced packet blocks.
+func readPcapngPackets(t *testing.T, path string) [][]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+	for len(data) >= 12 {
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		total := int(binary.LittleEndian.Uint32(data[4:]))
+		if total < 12 || total > len(data) {
+			t.Fatalf("bad block length %d", total)
+		}
+		if blockType == pcapngEnhancedPkt {
+			length := int(binary.LittleEndian.Uint32(data[20:]))
+			packets = append(packets, data[28:28+length])
+		}
+		data = data[total:]
+	}
+	return packets
+}
+
+func TestTcpCaptureAddressFamily(t *testing.T) {
+	v4Client := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}
+	v4Target := &net.TCPAddr{IP: net.ParseIP("198.51.100.20"), Port: 80}
+	v6Client := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 40000}
+	v6Target := &net.TCPAddr{IP: net.ParseIP("2001:db8::20"), Port: 443}
+
+	tests := []struct {
+		name   string
+		client *net.TCPAddr
+		target *net.TCPAddr
+		ipv6   bool
+	}{
+		{"both IPv4", v4Client, v4Target, false},
+		{"both IPv6", v6Client, v6Target, true},
+		{"IPv4 client, IPv6 target", v4Client, v6Target, true},
+		{"IPv6 client, IPv4 target", v6Client, v4Target, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "capture.pcapng")
+			writer, err := openPcapng(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := newTcpCapture(writer, test.client, test.target)
+			c.record(true, []byte("ping"))
+			c.record(false, []byte("pong"))
+			c.finish(true)
+			c.finish(false)
+			writer.Close()
+
+			packets := readPcapngPackets(t, path)
+			if len(packets) != 9 {
+				t.Fatalf("got %d packets, want 9", len(packets))
+			}
+			for i, packet := range packets {
+				var src, dst net.IP
+				if test.ipv6 {
+					if packet[0]>>4 != 6 {
+						t.Fatalf("packet %d is IPv%d, want IPv6", i, packet[0]>>4)
+					}
+					src, dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+				} else {
+					if packet[0]>>4 != 4 {
+						t.Fatalf("packet %d is IPv%d, want IPv4", i, packet[0]>>4)
+					}
+					src, dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+				}
+				// handshake, ping, pong, then each side closes and the other acks
+				fromClient := i != 1 && i != 4 && i != 6 && i != 7
+				want := [2]net.IP{test.client.IP, test.target.IP}
+				if !fromClient {
+					want = [2]net.IP{test.target.IP, test.client.IP}
+				}
+				if !src.Equal(want[0]) || !dst.Equal(want[1]) {
+					t.Errorf("packet %d goes %s -> %s, want %s -> %s", i, src, dst, want[0], want[1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyHeaderTTL = 5 * time.Second
+	proxyV1MaxLen  = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxiedConn reports the client address taken from a PROXY protocol header
+// instead of the address of the load balancer that accepted the connection.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from conn. The
+// header is read without buffering, so whatever follows it is left on the
+// socket for the SOCKS handshake. LOCAL and UNKNOWN headers keep the
+// address of the peer itself.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTTL))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix := make([]byte, len(proxyV2Signature))
+	_, err := io.ReadFull(conn, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		remote, err = readProxyV2(conn)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		remote, err = readProxyV1(conn, prefix)
+	default:
+		return nil, fmt.Errorf("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+func readProxyV1(conn net.Conn, prefix []byte) (net.Addr, error) {
+	line := append([]byte{}, prefix...)
+	one := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		_, err := io.ReadFull(conn, one)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, one[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad PROXY v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0]>>4 != 0x2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %x", header[0]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0]&0x0F == 0x0 {
+		return nil, nil
+	}
+
+	switch header[1] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 TCP4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 TCP6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// writeProxyHeader sends a PROXY protocol header describing a connection
+// from src to dst. Without a usable source address it sends the UNKNOWN (v1)
+// or LOCAL (v2) form.
+func writeProxyHeader(w io.Writer, version int, src net.Addr, dst net.Addr) error {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && (srcAddr.IP.To4() == nil) == (dstAddr.IP.To4() == nil)
+
+	if version == 1 {
+		line := "PROXY UNKNOWN\r\n"
+		if known {
+			family := "TCP6"
+			if srcAddr.IP.To4() != nil {
+				family = "TCP4"
+			}
+			line = fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcAddr.IP.String(), dstAddr.IP.String(), srcAddr.Port, dstAddr.Port)
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if !known {
+		header = append(header, 0x20, 0x00, 0x00, 0x00)
+		_, err := w.Write(header)
+		return err
+	}
+
+	var body []byte
+	if srcAddr.IP.To4() != nil {
+		header = append(header, 0x21, 0x11)
+		body = append(body, srcAddr.IP.To4()...)
+		body = append(body, dstAddr.IP.To4()...)
+	} else {
+		header = append(header, 0x21, 0x21)
+		body = append(body, srcAddr.IP.To16()...)
+		body = append(body, dstAddr.IP.To16()...)
+	}
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:], uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+	body = append(body, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(body)))
+	header = append(header, length...)
+	header = append(header, body...)
+
+	_, err := w.Write(header)
+	return err
+}
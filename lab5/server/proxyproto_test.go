@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 header, the length field is taken from body.
+func proxyV2Header(command byte, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func proxyV2Body(src net.IP, dst net.IP, srcPort uint16, dstPort uint16) []byte {
+	body := append(append([]byte{}, src...), dst...)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	return binary.BigEndian.AppendUint16(body, dstPort)
+}
+
+// readProxyFrom runs readProxyHeader on one end of a pipe while data is
+// written to the other end, which is closed once everything was read.
+func readProxyFrom(t *testing.T, data []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return readProxyHeader(server)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		remote string // empty if the header is rejected
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 40000 1080\r\n"), "192.0.2.1:40000"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 1080\r\n"), "[2001:db8::1]:40000"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "pipe"},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ff::1 ff::2 1 2\r\n"), "pipe"},
+		{"v1 too long", []byte("PROXY TCP6 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n"), ""},
+		{"v1 bad family", []byte("PROXY UDP4 192.0.2.1 198.51.100.2 40000 1080\r\n"), ""},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 198.51.100.2 40000 1080\r\n"), ""},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.2 70000 1080\r\n"), ""},
+		{"v1 cut off", []byte("PROXY TCP4 192.0.2.1"), ""},
+		{"v2 proxy ipv4", proxyV2Header(0x1, 0x11, proxyV2Body(net.IP{192, 0, 2, 1}, net.IP{198, 51, 100, 2}, 40000, 1080)), "192.0.2.1:40000"},
+		{"v2 proxy ipv6", proxyV2Header(0x1, 0x21, proxyV2Body(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 40000, 1080)), "[2001:db8::1]:40000"},
+		{"v2 local ipv4", proxyV2Header(0x0, 0x11, proxyV2Body(net.IP{192, 0, 2, 1}, net.IP{198, 51, 100, 2}, 40000, 1080)), "pipe"},
+		{"v2 local ipv6", proxyV2Header(0x0, 0x21, proxyV2Body(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 40000, 1080)), "pipe"},
+		{"v2 local empty", proxyV2Header(0x0, 0x00, nil), "pipe"},
+		{"v2 unix socket", proxyV2Header(0x1, 0x31, make([]byte, 216)), "pipe"},
+		{"v2 short ipv4 body", proxyV2Header(0x1, 0x11, make([]byte, 6)), ""},
+		{"v2 short ipv6 body", proxyV2Header(0x1, 0x21, make([]byte, 12)), ""},
+		{"v2 truncated body", proxyV2Header(0x1, 0x11, proxyV2Body(net.IP{192, 0, 2, 1}, net.IP{198, 51, 100, 2}, 40000, 1080))[:20], ""},
+		{"v2 bad version", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), ""},
+		{"no header", []byte("\x05\x01\x00 and some more"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := append(append([]byte{}, test.header...), "SOCKS"...)
+			conn, err := readProxyFrom(t, data)
+			if test.remote == "" {
+				if err == nil {
+					t.Fatalf("header accepted, remote %s", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote := conn.RemoteAddr().String(); remote != test.remote {
+				t.Errorf("remote %s, want %s", remote, test.remote)
+			}
+
+			rest, err := io.ReadAll(conn)
+			if err != nil || string(rest) != "SOCKS" {
+				t.Errorf("after the header read %q, %v, want \"SOCKS\"", rest, err)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderRoundTrip(t *testing.T) {
+	ipv4 := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 40000}
+	ipv4Dst := &net.TCPAddr{IP: net.IP{198, 51, 100, 2}, Port: 1080}
+	ipv6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	ipv6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1080}
+
+	tests := []struct {
+		name    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+		remote  string
+	}{
+		{"v1 ipv4", 1, ipv4, ipv4Dst, "192.0.2.1:40000"},
+		{"v1 ipv6", 1, ipv6, ipv6Dst, "[2001:db8::1]:40000"},
+		{"v1 mixed families", 1, ipv4, ipv6Dst, "pipe"},
+		{"v1 not tcp", 1, &net.UDPAddr{IP: ipv4.IP, Port: 1}, ipv4Dst, "pipe"},
+		{"v2 ipv4", 2, ipv4, ipv4Dst, "192.0.2.1:40000"},
+		{"v2 ipv6", 2, ipv6, ipv6Dst, "[2001:db8::1]:40000"},
+		{"v2 mixed families", 2, ipv6, ipv4Dst, "pipe"},
+		{"v2 not tcp", 2, nil, ipv4Dst, "pipe"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header bytes.Buffer
+			if err := writeProxyHeader(&header, test.version, test.src, test.dst); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := readProxyFrom(t, header.Bytes())
+			if err != nil {
+				t.Fatalf("header %q: %v", header.Bytes(), err)
+			}
+			if remote := conn.RemoteAddr().String(); remote != test.remote {
+				t.Errorf("remote %s, want %s", remote, test.remote)
+			}
+		})
+	}
+}
+
+// TestProxyHeaderOnlyFromTrusted checks that handleClient parses a PROXY
+// header only from a trusted peer, from anybody else it is the start of the
+// SOCKS handshake.
+func TestProxyHeaderOnlyFromTrusted(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.2 40000 1080\r\n"
+	greeting := "\x05\x01\x00"
+
+	tests := []struct {
+		name    string
+		trusted string
+		send    string
+		reply   string
+	}{
+		{"trusted peer with header", "127.0.0.0/8", header + greeting, "\x05\x00"},
+		{"untrusted peer with header", "10.0.0.0/8", header + greeting, ""},
+		{"untrusted peer without header", "10.0.0.0/8", greeting, "\x05\x00"},
+		{"no trusted proxies", "", header + greeting, ""},
+	}
+
+	saved := proxyTrusted
+	defer func() { proxyTrusted = saved }()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxyTrusted = nil
+			if test.trusted != "" {
+				_, ipNet, err := net.ParseCIDR(test.trusted)
+				if err != nil {
+					t.Fatal(err)
+				}
+				proxyTrusted = []*net.IPNet{ipNet}
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				conn, err := listener.Accept()
+				if err == nil {
+					handleClient(conn)
+				}
+			}()
+
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				client.Close()
+				<-done
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(client, test.send); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := make([]byte, 2)
+			n, _ := io.ReadFull(client, reply)
+			if got := string(reply[:n]); got != test.reply {
+				t.Errorf("reply %q, want %q", got, test.reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const quotaFlushInterval = 10 * time.Second
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+type quotaLimits struct {
+	daily   int64
+	monthly int64
+}
+
+type userUsage struct {
+	Day          string `json:"day"`
+	DayBytes     int64  `json:"day_bytes"`
+	Month        string `json:"month"`
+	MonthBytes   int64  `json:"month_bytes"`
+	TotalBytes   int64  `json:"total_bytes"`
+	LastActivity string `json:"last_activity,omitempty"`
+}
+
+// quotaStore counts relayed bytes per authenticated user for the current day
+// and month. Counters live in memory and are flushed to a JSON file, so they
+// survive restarts; a new day or month starts its counter from zero.
+//
+// Every change bumps version, saved is the version last written to the
+// file. flushLock keeps the periodic and the admin flush from writing the
+// temporary file at the same time.
+type quotaStore struct {
+	lock      sync.Mutex
+	flushLock sync.Mutex
+	path      string
+	users     map[string]userEntry
+	usage     map[string]*userUsage
+	cut       bool
+	version   uint64
+	saved     uint64
+	active    map[string]map[*quotaSession]bool
+}
+
+// quotaSession ties one relayed connection to its user so it can be cut
+// when the user runs out of traffic.
+type quotaSession struct {
+	store *quotaStore
+	user  string
+	kill  func()
+	once  sync.Once
+}
+
+func parseBytes(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = m
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad byte count %q", value)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("byte count %q is too large", value)
+	}
+	return n * multiplier, nil
+}
+
+func openQuotaStore(path string, users map[string]userEntry, cut bool) (*quotaStore, error) {
+	store := &quotaStore{
+		path:   path,
+		users:  users,
+		usage:  make(map[string]*userUsage),
+		cut:    cut,
+		active: make(map[string]map[*quotaSession]bool),
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &store.usage)
+		if err != nil {
+			return nil, fmt.Errorf("bad quota database %s: %v", path, err)
+		}
+	}
+
+	go func() {
+		for range time.Tick(quotaFlushInterval) {
+			err := store.flush()
+			if err != nil {
+				log.Printf("Error saving quota database: %v", err)
+			}
+		}
+	}()
+
+	return store, nil
+}
+
+// flush writes the counters to the file if they changed since the last
+// successful flush. A failed flush is retried by the next one.
+func (q *quotaStore) flush() error {
+	q.flushLock.Lock()
+	defer q.flushLock.Unlock()
+
+	q.lock.Lock()
+	if q.version == q.saved || q.path == "" {
+		q.lock.Unlock()
+		return nil
+	}
+	version := q.version
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := q.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, q.path)
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	q.saved = version
+	q.lock.Unlock()
+	return nil
+}
+
+// current returns the usage of user rolled over to the current period.
+// The caller must hold q.lock.
+func (q *quotaStore) current(user string, now time.Time) *userUsage {
+	usage := q.usage[user]
+	if usage == nil {
+		usage = &userUsage{}
+		q.usage[user] = usage
+	}
+
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+	if usage.Day != day {
+		usage.Day = day
+		usage.DayBytes = 0
+	}
+	if usage.Month != month {
+		usage.Month = month
+		usage.MonthBytes = 0
+	}
+	return usage
+}
+
+// exhaustedLocked reports whether user has used up a limit. The caller must
+// hold q.lock.
+func (q *quotaStore) exhaustedLocked(user string, now time.Time) bool {
+	limits := q.users[user].limits
+	usage := q.current(user, now)
+	return (limits.daily > 0 && usage.DayBytes >= limits.daily) ||
+		(limits.monthly > 0 && usage.MonthBytes >= limits.monthly)
+}
+
+func (q *quotaStore) exhausted(user string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.exhaustedLocked(user, time.Now())
+}
+
+func (q *quotaStore) add(user string, n int64) bool {
+	now := time.Now()
+
+	q.lock.Lock()
+	usage := q.current(user, now)
+	usage.DayBytes += n
+	usage.MonthBytes += n
+	usage.TotalBytes += n
+	usage.LastActivity = now.Format(time.RFC3339)
+	q.version++
+
+	exhausted := q.exhaustedLocked(user, now)
+	var victims []*quotaSession
+	var kills []func()
+	if exhausted && q.cut {
+		for session := range q.active[user] {
+			victims = append(victims, session)
+			kills = append(kills, session.kill)
+		}
+	}
+	q.lock.Unlock()
+
+	for i, session := range victims {
+		session.once.Do(kills[i])
+	}
+	if exhausted && len(victims) > 0 {
+		log.Printf("User %s exhausted the traffic quota, cut %d sessions", user, len(victims))
+	}
+	return !exhausted
+}
+
+func (q *quotaStore) startSession(user string, kill func()) *quotaSession {
+	session := &quotaSession{store: q, user: user, kill: kill}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.active[user] == nil {
+		q.active[user] = make(map[*quotaSession]bool)
+	}
+	q.active[user][session] = true
+	return session
+}
+
+// setKill replaces the function that cuts the session, for relay engines
+// that take the connection over from its handler.
+func (s *quotaSession) setKill(kill func()) {
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	s.kill = kill
+}
+
+func (s *quotaSession) end() {
+	s.store.lock.Lock()
+	defer s.store.lock.Unlock()
+	delete(s.store.active[s.user], s)
+}
+
+func (q *quotaStore) reset(user string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.usage[user]; !ok {
+		return false
+	}
+	delete(q.usage, user)
+	q.version++
+	return true
+}
+
+func (q *quotaStore) report(user string) []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var names []string
+	if user != "" {
+		names = append(names, user)
+	} else {
+		seen := make(map[string]bool)
+		for name := range q.users {
+			seen[name] = true
+		}
+		for name := range q.usage {
+			seen[name] = true
+		}
+		for name := range seen {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	now := time.Now()
+	var lines []string
+	for _, name := range names {
+		limits := q.users[name].limits
+		usage := q.current(name, now)
+		lines = append(lines, fmt.Sprintf("%s day=%d/%s month=%d/%s total=%d sessions=%d exhausted=%v",
+			name, usage.DayBytes, formatLimit(limits.daily), usage.MonthBytes, formatLimit(limits.monthly),
+			usage.TotalBytes, len(q.active[name]), q.exhaustedLocked(name, now)))
+	}
+	return lines
+}
+
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// quotaWriter charges every byte written through it to the session's user.
+type quotaWriter struct {
+	w       io.Writer
+	session *quotaSession
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	n, err := qw.w.Write(p)
+	if n > 0 && !qw.session.store.add(qw.session.user, int64(n)) && qw.session.store.cut {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// runAdmin serves a line based admin protocol:
+//
+//	usage [user]   print counters of one or all users
+//	reset user     clear the counters of user
+func runAdmin(addr string, store *quotaStore) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Error opening admin port %s: %v", addr, err)
+		return
+	}
+	log.Printf("Admin interface on %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting admin connection: %v", err)
+			continue
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) >= 1 && fields[0] == "usage":
+				user := ""
+				if len(fields) > 1 {
+					user = fields[1]
+				}
+				for _, l := range store.report(user) {
+					fmt.Fprintln(conn, l)
+				}
+			case len(fields) == 2 && fields[0] == "reset":
+				if store.reset(fields[1]) {
+					log.Printf("Quota of user %s reset by %s", fields[1], conn.RemoteAddr().String())
+					fmt.Fprintf(conn, "reset %s\n", fields[1])
+				} else {
+					fmt.Fprintf(conn, "error: no usage recorded for %s\n", fields[1])
+				}
+				store.flush()
+			default:
+				fmt.Fprintln(conn, "error: expected \"usage [user]\" or \"reset user\"")
+			}
+		}(conn)
+	}
+}
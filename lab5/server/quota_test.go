@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		bytes int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"1500", 1500, true},
+		{" 10k ", 10 << 10, true},
+		{"5M", 5 << 20, true},
+		{"2G", 2 << 30, true},
+		{"3T", 3 << 40, true},
+		{strconv.FormatInt(math.MaxInt64, 10), math.MaxInt64, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"9223372036854775807K", 0, false},
+		{"99999999999G", 0, false},
+		{"9223372036854775808", 0, false},
+		{"-1", 0, false},
+		{"", 0, false},
+		{"1.5G", 0, false},
+		{"G", 0, false},
+	}
+
+	for _, test := range tests {
+		bytes, err := parseBytes(test.value)
+		if test.ok && (err != nil || bytes != test.bytes) {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d", test.value, bytes, err, test.bytes)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("parseBytes(%q) = %d, want an error", test.value, bytes)
+		}
+	}
+}
+
+func TestQuotaFlushRetriesAfterFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	path := filepath.Join(dir, "quota.json")
+	store := &quotaStore{
+		path:   path,
+		users:  map[string]userEntry{},
+		usage:  make(map[string]*userUsage),
+		active: make(map[string]map[*quotaSession]bool),
+	}
+
+	store.add("alice", 100)
+	if err := store.flush(); err == nil {
+		t.Fatal("flush into a missing directory succeeded")
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("counters were not written after the failed flush: %v", err)
+	}
+	var usage map[string]*userUsage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage["alice"] == nil || usage["alice"].TotalBytes != 100 {
+		t.Fatalf("saved usage %s, want alice with 100 bytes", data)
+	}
+}
@@ -2,24 +2,66 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
-func handshake(conn net.Conn) bool {
+const dialTimeout = 10 * time.Second
+
+var (
+	captureFile  *pcapngWriter
+	captureRules *captureFilter
+	dialTarget   = dialDirect
+
+	proxyTrusted     []*net.IPNet
+	sendProxyVersion int
+
+	users  map[string]userEntry
+	quotas *quotaStore
+
+	relayEngine *epollEngine
+	// tunnel streams are not sockets, the engine hands every one of them
+	// back; that is said once instead of per session
+	relayNotTCPOnce sync.Once
+)
+
+var errNotTCP = errors.New("not a TCP connection")
+
+func dialDirect(address string, client net.Addr) (net.Conn, error) {
+	targetConn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil || sendProxyVersion == 0 {
+		return targetConn, err
+	}
+
+	err = writeProxyHeader(targetConn, sendProxyVersion, client, targetConn.RemoteAddr())
+	if err != nil {
+		targetConn.Close()
+		return nil, err
+	}
+	return targetConn, nil
+}
+
+func handshake(conn net.Conn) (string, bool) {
 	buf := make([]byte, 2)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-		return true
+		return "", true
 	}
 
 	if buf[0] != 0x05 {
 		log.Printf("Accepting ONLY SOCKS5 connections, got: %x", buf[0])
-		return true
+		return "", true
 	}
 
 	nMethods := int(buf[1])
@@ -27,38 +69,62 @@ func handshake(conn net.Conn) bool {
 	_, err = io.ReadFull(conn, methods)
 	if err != nil {
 		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-		return true
+		return "", true
+	}
+
+	method := byte(0x00)
+	if users != nil {
+		method = 0xFF
+		for _, m := range methods {
+			if m == 0x02 {
+				method = 0x02
+			}
+		}
 	}
 
-	_, err = conn.Write([]byte{0x05, 0x00})
+	_, err = conn.Write([]byte{0x05, method})
 	if err != nil {
 		log.Printf("Error writing to %s: %v", conn.RemoteAddr().String(), err)
-		return true
+		return "", true
+	}
+
+	if method == 0xFF {
+		log.Printf("Client %s offered no username/password authentication", conn.RemoteAddr().String())
+		return "", true
+	}
+
+	user := ""
+	if method == 0x02 {
+		var ok bool
+		user, ok = authenticate(conn, users)
+		if !ok {
+			return "", true
+		}
 	}
 
 	log.Printf("Handshake successful with client %s", conn.RemoteAddr().String())
-	return false
+	return user, false
 }
 
-func connect(conn net.Conn) net.Conn {
+func connect(conn net.Conn, user string) (net.Conn, string) {
 	buf := make([]byte, 4)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		connected_send(conn, 0x01)
 		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-		return nil
+		return nil, ""
 	}
 
 	if buf[0] != 0x05 {
 		connected_send(conn, 0x07)
 		log.Printf("Accepting ONLY SOCKS5 connections, got: %x", buf[0])
-		return nil
+		return nil, ""
 	}
 
 	if buf[1] != 0x01 {
 		connected_send(conn, 0x07)
 		log.Printf("Unknown command: %x", buf[1])
-		return nil
+		return nil, ""
 	}
 
 	var address string
@@ -69,7 +135,7 @@ func connect(conn net.Conn) net.Conn {
 		if err != nil {
 			connected_send(conn, 0x01)
 			log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-			return nil
+			return nil, ""
 		}
 		address = net.IP(tmpAddr).String()
 	case 0x03:
@@ -78,20 +144,20 @@ func connect(conn net.Conn) net.Conn {
 		if err != nil {
 			connected_send(conn, 0x01)
 			log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-			return nil
+			return nil, ""
 		}
 		domain := make([]byte, lenBuf[0])
 		_, err = io.ReadFull(conn, domain)
 		if err != nil {
 			connected_send(conn, 0x01)
 			log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-			return nil
+			return nil, ""
 		}
 		address = string(domain)
 	default:
 		connected_send(conn, 0x08)
 		log.Printf("Unsupported SOCKS5 address type: %x", buf[3])
-		return nil
+		return nil, ""
 	}
 
 	portBuf := make([]byte, 2)
@@ -99,22 +165,29 @@ func connect(conn net.Conn) net.Conn {
 	if err != nil {
 		connected_send(conn, 0x01)
 		log.Printf("Error reading from %s: %v", conn.RemoteAddr().String(), err)
-		return nil
+		return nil, ""
 	}
 
 	port := binary.BigEndian.Uint16(portBuf)
 	address = fmt.Sprintf("%s:%d", address, port)
 
-	targetConn, err := net.Dial("tcp", address)
+	if quotas != nil && quotas.exhausted(user) {
+		connected_send(conn, 0x02)
+		log.Printf("User %s is over the traffic quota, refusing %s", user, address)
+		return nil, ""
+	}
+
+	targetConn, err := dialTarget(address, conn.RemoteAddr())
 	if err != nil {
-		log.Printf("Error connecting to %s: %v", address, err)
-		connected_send(conn, 0x01)
-		return nil
+		code := dialErrorCode(err)
+		log.Printf("Error connecting to %s: %v (reply %x)", address, err, code)
+		connected_send(conn, code)
+		return nil, ""
 	}
 
 	connected_send(conn, 0x00)
 	log.Printf("Successfully connected to %s", address)
-	return targetConn
+	return targetConn, address
 }
 
 func connected_send(conn net.Conn, err_code byte) {
@@ -125,15 +198,29 @@ func connected_send(conn net.Conn, err_code byte) {
 	}
 }
 
-func transferData(conn net.Conn, target_conn net.Conn) {
+func transferData(conn net.Conn, target_conn net.Conn, capture *tcpCapture, quota *quotaSession) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	var toTarget io.Writer = target_conn
+	var toClient io.Writer = conn
+	if capture != nil {
+		toTarget = &captureWriter{w: toTarget, capture: capture, fromClient: true}
+		toClient = &captureWriter{w: toClient, capture: capture, fromClient: false}
+	}
+	if quota != nil {
+		toTarget = &quotaWriter{w: toTarget, session: quota}
+		toClient = &quotaWriter{w: toClient, session: quota}
+	}
+
 	go func() {
 		defer wg.Done()
-		defer target_conn.(*net.TCPConn).CloseWrite()
+		defer closeWrite(target_conn)
+		if capture != nil {
+			defer capture.finish(true)
+		}
 
-		_, err := io.Copy(target_conn, conn)
+		_, err := io.Copy(toTarget, conn)
 		if err != nil {
 			log.Printf("Error transferring data from %s: %v", conn.RemoteAddr().String(), err)
 		}
@@ -141,9 +228,12 @@ func transferData(conn net.Conn, target_conn net.Conn) {
 
 	go func() {
 		defer wg.Done()
-		defer conn.(*net.TCPConn).CloseWrite()
+		defer closeWrite(conn)
+		if capture != nil {
+			defer capture.finish(false)
+		}
 
-		_, err := io.Copy(conn, target_conn)
+		_, err := io.Copy(toClient, target_conn)
 		if err != nil {
 			log.Printf("Error transferring data to %s: %v", conn.RemoteAddr().String(), err)
 		}
@@ -152,36 +242,216 @@ func transferData(conn net.Conn, target_conn net.Conn) {
 	wg.Wait()
 }
 
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
 func handleClient(conn net.Conn) {
 	defer conn.Close()
 
+	if proxyTrusted != nil && containsIP(proxyTrusted, addrIP(conn.RemoteAddr())) {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			log.Printf("Error reading PROXY header from %s: %v", conn.RemoteAddr().String(), err)
+			return
+		}
+		log.Printf("Connection from %s proxied for %s", conn.RemoteAddr().String(), proxied.RemoteAddr().String())
+		conn = proxied
+	}
+
 	log.Printf("New connection from %s", conn.RemoteAddr().String())
 
-	if handshake(conn) {
+	user, failed := handshake(conn)
+	if failed {
 		log.Println("Handshake failed")
 		return
 	}
 
-	targetConn := connect(conn)
+	targetConn, address := connect(conn, user)
 	if targetConn == nil {
 		log.Println("Target connection failed")
 		return
 	}
 	defer targetConn.Close()
 
-	transferData(conn, targetConn)
+	var capture *tcpCapture
+	if captureFile != nil && captureRules.match(user, conn.RemoteAddr(), address, targetConn.RemoteAddr()) {
+		log.Printf("Capturing session %s -> %s", conn.RemoteAddr().String(), address)
+		capture = newTcpCapture(captureFile, conn.RemoteAddr(), targetConn.RemoteAddr())
+	}
+
+	var quota *quotaSession
+	if quotas != nil && user != "" {
+		quota = quotas.startSession(user, func() {
+			conn.Close()
+			targetConn.Close()
+		})
+	}
+
+	if relayEngine != nil {
+		err := relayEngine.relay(conn, targetConn, capture, quota)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errNotTCP) {
+			relayNotTCPOnce.Do(func() {
+				log.Printf("Relaying sessions that are not TCP on both ends with goroutines: %v", err)
+			})
+		} else {
+			log.Printf("Relaying %s with goroutines: %v", conn.RemoteAddr().String(), err)
+		}
+	}
+
+	transferData(conn, targetConn, capture, quota)
+	if quota != nil {
+		quota.end()
+	}
 }
 
 func main() {
-	port := "12345"
+	port := flag.String("port", "12345", "port to accept SOCKS5 clients on")
+	capturePath := flag.String("capture", "", "write plaintext payloads of matching sessions to this pcapng file")
+	captureSpec := flag.String("capture-filter", "", "sessions to capture: comma separated user=name, client=CIDR, dst=host|CIDR, port=N")
+	mode := flag.String("mode", "direct", "direct: dial targets itself; local: forward CONNECTs through -tunnel; remote: accept tunnels on -tunnel")
+	tunnelAddr := flag.String("tunnel", "", "remote lab5 address (local mode) or tunnel listen address (remote mode)")
+	tunnelSecret := flag.String("tunnel-key", "", "pre-shared secret authenticating both tunnel ends")
+	tunnelConns := flag.Int("tunnel-conns", 2, "number of pooled tunnel connections in local mode")
+	trustedSpec := flag.String("proxy-trusted", "", "comma separated CIDRs whose connections start with a PROXY protocol header")
+	sendProxy := flag.Int("send-proxy", 0, "send a PROXY protocol header of this version (1 or 2) on outgoing connections")
+	usersPath := flag.String("users", "", "require username/password auth against this name:password[:daily[:monthly]] file")
+	quotaDaily := flag.String("quota-daily", "0", "default daily traffic quota per user, e.g. 500M (0 = unlimited)")
+	quotaMonthly := flag.String("quota-monthly", "0", "default monthly traffic quota per user, e.g. 10G (0 = unlimited)")
+	quotaPath := flag.String("quota-db", "usage.json", "file keeping per-user traffic counters across restarts")
+	quotaCut := flag.Bool("quota-cut", false, "close live sessions of a user as soon as the quota is exhausted")
+	adminAddr := flag.String("admin", "127.0.0.1:12399", "address of the quota admin interface (empty to disable)")
+	engine := flag.String("engine", "goroutine", "relay engine for established sessions: goroutine or epoll")
+	flag.Parse()
+
+	switch *engine {
+	case "goroutine":
+	case "epoll":
+		var err error
+		relayEngine, err = newEpollEngine()
+		if err != nil {
+			log.Printf("Error starting epoll engine: %v", err)
+			return
+		}
+	default:
+		log.Printf("Unknown relay engine %s", *engine)
+		return
+	}
+
+	if *sendProxy != 0 && *sendProxy != 1 && *sendProxy != 2 {
+		log.Printf("Unsupported PROXY protocol version %d", *sendProxy)
+		return
+	}
+	sendProxyVersion = *sendProxy
+
+	if *trustedSpec != "" {
+		for _, cidr := range strings.Split(*trustedSpec, ",") {
+			ipNet, err := parseNet(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Printf("Error parsing trusted proxy %s: %v", cidr, err)
+				return
+			}
+			proxyTrusted = append(proxyTrusted, ipNet)
+		}
+	}
+
+	if *mode != "direct" && (*tunnelAddr == "" || *tunnelSecret == "") {
+		log.Printf("Mode %s requires -tunnel and -tunnel-key", *mode)
+		return
+	}
+
+	switch *mode {
+	case "direct":
+	case "local":
+		tunnel := newTunnelClient(*tunnelAddr, tunnelKey(*tunnelSecret), *tunnelConns)
+		go tunnel.warmUp()
+		dialTarget = tunnel.dial
+	case "remote":
+		runTunnelServer(*tunnelAddr, tunnelKey(*tunnelSecret))
+		return
+	default:
+		log.Printf("Unknown mode %s", *mode)
+		return
+	}
+
+	if *usersPath != "" {
+		var defaults quotaLimits
+		var err error
+		defaults.daily, err = parseBytes(*quotaDaily)
+		if err == nil {
+			defaults.monthly, err = parseBytes(*quotaMonthly)
+		}
+		if err != nil {
+			log.Printf("Error parsing quota: %v", err)
+			return
+		}
+
+		users, err = loadUsers(*usersPath, defaults)
+		if err != nil {
+			log.Printf("Error loading users: %v", err)
+			return
+		}
+
+		quotas, err = openQuotaStore(*quotaPath, users, *quotaCut)
+		if err != nil {
+			log.Printf("Error opening quota database: %v", err)
+			return
+		}
+		log.Printf("Loaded %d users", len(users))
+
+		if *adminAddr != "" {
+			go runAdmin(*adminAddr, quotas)
+		}
+	}
+
+	if *capturePath != "" {
+		rules, err := parseCaptureFilter(*captureSpec)
+		if err != nil {
+			log.Printf("Error parsing capture filter: %v", err)
+			return
+		}
+
+		file, err := openPcapng(*capturePath)
+		if err != nil {
+			log.Printf("Error opening capture file %s: %v", *capturePath, err)
+			return
+		}
+		defer file.Close()
+
+		captureFile = file
+		captureRules = rules
+		log.Printf("Capturing sessions to %s", *capturePath)
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		if quotas != nil {
+			err := quotas.flush()
+			if err != nil {
+				log.Printf("Error saving quota database: %v", err)
+			}
+		}
+		if captureFile != nil {
+			captureFile.Close()
+		}
+		os.Exit(0)
+	}()
 
-	listener, err := net.Listen("tcp", ":"+port)
+	listener, err := net.Listen("tcp", ":"+*port)
 	if err != nil {
-		log.Printf("Error opening port %s: %v", port, err)
+		log.Printf("Error opening port %s: %v", *port, err)
 		return
 	}
 	defer listener.Close()
-	log.Printf("Listening on port %s", port)
+	log.Printf("Listening on port %s", *port)
 
 	for {
 		conn, err := listener.Accept()
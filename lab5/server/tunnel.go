@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tunnelMagic        = "LAB5TUN1"
+	tunnelMaxRecord    = 16 * 1024
+	tunnelHandshakeTTL = 10 * time.Second
+)
+
+var errTunnelAuth = errors.New("tunnel authentication failed")
+
+// secureConn carries length-prefixed AES-GCM records over a TCP connection.
+// Each direction has its own key and a counter nonce, so records can be
+// neither replayed nor reordered.
+type secureConn struct {
+	conn      net.Conn
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	sendAEAD  cipher.AEAD
+	recvAEAD  cipher.AEAD
+	sendSeq   uint64
+	recvSeq   uint64
+}
+
+func tunnelKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func deriveKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tunnelHandshake performs an ephemeral X25519 exchange bound to the shared
+// secret: both traffic keys are derived from the pre-shared key, both public
+// keys and the ECDH result, and each side proves knowledge of them with a
+// first encrypted record before any stream traffic flows.
+func tunnelHandshake(conn net.Conn, psk []byte, isClient bool) (*secureConn, error) {
+	conn.SetDeadline(time.Now().Add(tunnelHandshakeTTL))
+	defer conn.SetDeadline(time.Time{})
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := append([]byte(tunnelMagic), private.PublicKey().Bytes()...)
+	_, err = conn.Write(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	peerHello := make([]byte, len(hello))
+	_, err = io.ReadFull(conn, peerHello)
+	if err != nil {
+		return nil, err
+	}
+	if string(peerHello[:len(tunnelMagic)]) != tunnelMagic {
+		return nil, fmt.Errorf("not a lab5 tunnel peer")
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(peerHello[len(tunnelMagic):])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientHello, serverHello := hello, peerHello
+	if !isClient {
+		clientHello, serverHello = peerHello, hello
+	}
+
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(clientHello)
+	mac.Write(serverHello)
+	mac.Write(shared)
+	master := mac.Sum(nil)
+
+	c2s, err := newAEAD(deriveKey(master, "client to server"))
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newAEAD(deriveKey(master, "server to client"))
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &secureConn{conn: conn, sendAEAD: c2s, recvAEAD: s2c}
+	sendLabel, recvLabel := "client finished", "server finished"
+	if !isClient {
+		sc.sendAEAD, sc.recvAEAD = s2c, c2s
+		sendLabel, recvLabel = recvLabel, sendLabel
+	}
+
+	err = sc.writeRecord(deriveKey(master, sendLabel))
+	if err != nil {
+		return nil, err
+	}
+
+	finished, err := sc.readRecord()
+	if err != nil || !hmac.Equal(finished, deriveKey(master, recvLabel)) {
+		return nil, errTunnelAuth
+	}
+
+	return sc, nil
+}
+
+func (sc *secureConn) nonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (sc *secureConn) writeRecord(plain []byte) error {
+	if len(plain) > tunnelMaxRecord {
+		return fmt.Errorf("tunnel record too large: %d", len(plain))
+	}
+
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+
+	header := make([]byte, 2)
+	binary.BigEndian.PutUint16(header, uint16(len(plain)+sc.sendAEAD.Overhead()))
+
+	record := sc.sendAEAD.Seal(header, sc.nonce(sc.sendSeq), plain, header)
+	sc.sendSeq++
+
+	_, err := sc.conn.Write(record)
+	return err
+}
+
+func (sc *secureConn) readRecord() ([]byte, error) {
+	sc.readLock.Lock()
+	defer sc.readLock.Unlock()
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(sc.conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(sc.conn, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := sc.recvAEAD.Open(sealed[:0], sc.nonce(sc.recvSeq), sealed, header)
+	if err != nil {
+		return nil, errTunnelAuth
+	}
+	sc.recvSeq++
+	return plain, nil
+}
+
+func (sc *secureConn) Close() error {
+	return sc.conn.Close()
+}
+
+// tunnelClient keeps a small pool of authenticated sessions to the remote
+// lab5 instance. New streams go to the least loaded live session, so the
+// TCP and key exchange round trips are paid once per pooled connection
+// instead of once per CONNECT. Empty and broken slots are filled by one
+// background dialer, a CONNECT only waits for it when no session is live.
+type tunnelClient struct {
+	addr     string
+	psk      []byte
+	lock     sync.Mutex
+	sessions []*muxSession
+	growing  bool
+	// grown is closed and replaced whenever the dialer adds a session or
+	// gives up, lastErr is why it gave up
+	grown   chan struct{}
+	lastErr error
+}
+
+func newTunnelClient(addr string, psk []byte, poolSize int) *tunnelClient {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	return &tunnelClient{
+		addr:     addr,
+		psk:      psk,
+		sessions: make([]*muxSession, poolSize),
+		grown:    make(chan struct{}),
+	}
+}
+
+func (tc *tunnelClient) connect() (*muxSession, error) {
+	conn, err := net.DialTimeout("tcp", tc.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := tunnelHandshake(conn, tc.psk, true)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tunnel handshake with %s: %v", tc.addr, err)
+	}
+
+	log.Printf("Tunnel established with %s", tc.addr)
+	return newMuxSession(sc), nil
+}
+
+// warmUp fills the pool ahead of the first CONNECT.
+func (tc *tunnelClient) warmUp() {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.startGrowing()
+}
+
+// startGrowing runs grow unless it is already running, tc.lock must be held.
+func (tc *tunnelClient) startGrowing() {
+	if tc.growing {
+		return
+	}
+	tc.growing = true
+	go tc.grow()
+}
+
+// grow dials sessions one by one until every slot holds a live one or a
+// dial fails. The dial runs without tc.lock, streams keep using the live
+// sessions meanwhile.
+func (tc *tunnelClient) grow() {
+	for {
+		tc.lock.Lock()
+		free := tc.freeSlot()
+		if free == -1 {
+			tc.growing = false
+			tc.lock.Unlock()
+			return
+		}
+		tc.lock.Unlock()
+
+		session, err := tc.connect()
+
+		tc.lock.Lock()
+		if err != nil {
+			log.Printf("Error connecting tunnel to %s: %v", tc.addr, err)
+			tc.lastErr = err
+			tc.growing = false
+		} else {
+			tc.sessions[free] = session
+		}
+		close(tc.grown)
+		tc.grown = make(chan struct{})
+		tc.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// freeSlot returns the first slot without a live session, -1 if there is
+// none. tc.lock must be held.
+func (tc *tunnelClient) freeSlot() int {
+	for i, session := range tc.sessions {
+		if session == nil || session.isClosed() {
+			return i
+		}
+	}
+	return -1
+}
+
+// bestSession returns the live session with the fewest streams, nil if
+// there is none. tc.lock must be held.
+func (tc *tunnelClient) bestSession() *muxSession {
+	var best *muxSession
+	for _, session := range tc.sessions {
+		if session == nil || session.isClosed() {
+			continue
+		}
+		if best == nil || session.streamCount() < best.streamCount() {
+			best = session
+		}
+	}
+	return best
+}
+
+func (tc *tunnelClient) getSession() (*muxSession, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if tc.freeSlot() != -1 {
+		tc.startGrowing()
+	}
+	if best := tc.bestSession(); best != nil {
+		return best, nil
+	}
+
+	// nothing is live, wait for the dialer to add a session or give up
+	grown := tc.grown
+	tc.lock.Unlock()
+	<-grown
+	tc.lock.Lock()
+
+	if best := tc.bestSession(); best != nil {
+		return best, nil
+	}
+	if tc.lastErr != nil {
+		return nil, tc.lastErr
+	}
+	return nil, fmt.Errorf("no tunnel session to %s", tc.addr)
+}
+
+func (tc *tunnelClient) dial(address string, client net.Addr) (net.Conn, error) {
+	session, err := tc.getSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.open(address, client)
+}
+
+func runTunnelServer(listenAddr string, psk []byte) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Printf("Error opening tunnel listener %s: %v", listenAddr, err)
+		return
+	}
+	defer listener.Close()
+	log.Printf("Accepting tunnels on %s", listenAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting tunnel: %v", err)
+			continue
+		}
+
+		go handleTunnel(conn, psk)
+	}
+}
+
+func handleTunnel(conn net.Conn, psk []byte) {
+	sc, err := tunnelHandshake(conn, psk, false)
+	if err != nil {
+		log.Printf("Tunnel handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	log.Printf("Tunnel established with %s", conn.RemoteAddr().String())
+
+	session := newMuxSession(sc)
+	defer session.Close()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Printf("Tunnel with %s closed: %v", conn.RemoteAddr().String(), err)
+			return
+		}
+
+		go handleTunnelStream(session, stream)
+	}
+}
+
+func handleTunnelStream(session *muxSession, stream *muxStream) {
+	defer stream.Close()
+
+	targetConn, err := dialDirect(stream.address, stream.client)
+	if err != nil {
+		code := dialErrorCode(err)
+		log.Printf("Error connecting to %s: %v (reply %x)", stream.address, err, code)
+		session.removeStream(stream.id)
+		session.writeFrame(frameResult, stream.id, []byte{code})
+		return
+	}
+	defer targetConn.Close()
+
+	err = session.writeFrame(frameResult, stream.id, []byte{0x00})
+	if err != nil {
+		return
+	}
+	log.Printf("Successfully connected to %s for %s through tunnel", stream.address, stream.client.String())
+
+	transferData(stream, targetConn, nil, nil)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallingTunnelServer answers the first tunnel connection and leaves the
+// later ones hanging in the handshake, like a remote that became slow.
+func stallingTunnelServer(t *testing.T, psk []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			conns = append(conns, conn)
+			lock.Unlock()
+			if first {
+				go handleTunnel(conn, psk)
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTunnelSessionDoesNotWaitForSlowDial(t *testing.T) {
+	psk := tunnelKey("test")
+	tc := newTunnelClient(stallingTunnelServer(t, psk), psk, 2)
+
+	first, err := tc.getSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a busy session makes the pool grow
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	stream, err := first.open(target.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	// the second slot is being dialed now and will not finish, streams
+	// must keep using the live session meanwhile
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		session, err := tc.getSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != first {
+			t.Fatalf("got a session that is not the live one")
+		}
+		if waited := time.Since(start); waited > 500*time.Millisecond {
+			t.Fatalf("getSession waited %s behind the dial of another slot", waited)
+		}
+	}
+}
+
+func TestTunnelSessionUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	tc := newTunnelClient(addr, tunnelKey("test"), 2)
+	session, err := tc.getSession()
+	if err == nil {
+		t.Fatalf("got session %v from a closed port", session)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const benchConnsPerAddr = 20000
+
+type benchResult struct {
+	engine     string
+	idleRSS    int64
+	activeRSS  int64
+	baseRSS    int64
+	cpuPercent float64
+	roundTrips int64
+	failed     int64
+	latency    []time.Duration
+	elapsed    time.Duration
+}
+
+// loopbackAddrs spreads count connections over enough 127.0.0.x addresses
+// that no single address pair runs out of ephemeral ports.
+func loopbackAddrs(count int) []string {
+	n := count/benchConnsPerAddr + 1
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("127.0.0.%d", i+1)
+	}
+	return addrs
+}
+
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "", "path to the lab5 server binary")
+	engines := fs.String("engines", "goroutine,epoll", "comma separated relay engines to compare")
+	idle := fs.Int("idle", 50000, "number of idle sessions kept open")
+	active := fs.Int("active", 5000, "number of sessions exchanging data")
+	duration := fs.Duration("duration", 10*time.Second, "how long active sessions run")
+	size := fs.Int("size", 64, "payload size in bytes")
+	port := fs.Int("port", 12400, "port the benchmarked proxy listens on")
+	fs.Parse(args)
+
+	if *server == "" {
+		fmt.Fprintln(os.Stderr, "usage: socks5c bench -server path/to/server [flags]")
+		os.Exit(2)
+	}
+
+	total := *idle + *active
+	addrs := loopbackAddrs(total)
+
+	var echoTargets []string
+	for _, addr := range addrs {
+		listener, err := startEchoServer(addr + ":0")
+		if err != nil {
+			log.Fatalf("Error starting echo server on %s: %v", addr, err)
+		}
+		defer listener.Close()
+		echoTargets = append(echoTargets, listener.Addr().String())
+	}
+
+	var results []*benchResult
+	for _, engine := range strings.Split(*engines, ",") {
+		engine = strings.TrimSpace(engine)
+		log.Printf("Benchmarking %s engine: %d idle, %d active for %v", engine, *idle, *active, *duration)
+
+		result, err := benchEngine(*server, engine, *port, addrs, echoTargets, *idle, *active, *duration, *size)
+		if err != nil {
+			log.Printf("Benchmark of %s engine failed: %v", engine, err)
+			continue
+		}
+		results = append(results, result)
+	}
+
+	fmt.Printf("%-10s %10s %10s %12s %8s %12s %10s %10s %8s\n",
+		"engine", "base RSS", "idle RSS", "active RSS", "CPU", "round trips", "p50", "p99", "failed")
+	for _, r := range results {
+		sort.Slice(r.latency, func(i, j int) bool { return r.latency[i] < r.latency[j] })
+		fmt.Printf("%-10s %8dMB %8dMB %10dMB %7.1f%% %12d %10v %10v %8d\n",
+			r.engine, r.baseRSS>>20, r.idleRSS>>20, r.activeRSS>>20, r.cpuPercent, r.roundTrips,
+			percentile(r.latency, 50), percentile(r.latency, 99), r.failed)
+	}
+}
+
+func benchEngine(server string, engine string, port int, addrs []string, echoTargets []string,
+	idle int, active int, duration time.Duration, size int) (*benchResult, error) {
+
+	cmd := exec.Command(server, "-engine", engine, "-port", strconv.Itoa(port), "-admin", "")
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	proxyAddr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			return nil, fmt.Errorf("proxy did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	pid := cmd.Process.Pid
+	result := &benchResult{engine: engine}
+	result.baseRSS, _ = processRSS(pid)
+
+	proxyFor := func(i int) proxyConfig {
+		return proxyConfig{addr: fmt.Sprintf("%s:%d", addrs[i%len(addrs)], port)}
+	}
+	targetFor := func(i int) string {
+		return echoTargets[i%len(echoTargets)]
+	}
+
+	var failed int64
+	openSessions := func(first int, count int) []net.Conn {
+		conns := make([]net.Conn, count)
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < 200; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					conn, err := openEchoSession(proxyFor(first+i), targetFor(first+i), size)
+					if err != nil {
+						atomic.AddInt64(&failed, 1)
+						continue
+					}
+					conns[i] = conn
+				}
+			}()
+		}
+		for i := 0; i < count; i++ {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+
+		var opened []net.Conn
+		for _, conn := range conns {
+			if conn != nil {
+				opened = append(opened, conn)
+			}
+		}
+		return opened
+	}
+
+	idleConns := openSessions(0, idle)
+	defer func() {
+		for _, conn := range idleConns {
+			conn.Close()
+		}
+	}()
+
+	time.Sleep(time.Second)
+	result.idleRSS, _ = processRSS(pid)
+	log.Printf("%d idle sessions open (%d failed), proxy RSS %dMB", len(idleConns), failed, result.idleRSS>>20)
+
+	activeConns := openSessions(idle, active)
+
+	cpuStart, err := processCPU(pid)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	deadline := start.Add(duration)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var peakRSS int64
+	stopSampling := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stopSampling:
+				return
+			case <-time.After(500 * time.Millisecond):
+				if rss, err := processRSS(pid); err == nil && rss > atomic.LoadInt64(&peakRSS) {
+					atomic.StoreInt64(&peakRSS, rss)
+				}
+			}
+		}
+	}()
+
+	for _, conn := range activeConns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+
+			payload := bytes.Repeat([]byte{'x'}, size)
+			reply := make([]byte, size)
+			var samples []time.Duration
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				conn.SetDeadline(t.Add(10 * time.Second))
+				_, err := conn.Write(payload)
+				if err == nil {
+					_, err = io.ReadFull(conn, reply)
+				}
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					break
+				}
+				samples = append(samples, time.Since(t))
+			}
+
+			lock.Lock()
+			result.latency = append(result.latency, samples...)
+			result.roundTrips += int64(len(samples))
+			lock.Unlock()
+		}(conn)
+	}
+	wg.Wait()
+	close(stopSampling)
+
+	result.elapsed = time.Since(start)
+	cpuEnd, err := processCPU(pid)
+	if err != nil {
+		return nil, err
+	}
+	result.cpuPercent = 100 * (cpuEnd - cpuStart).Seconds() / result.elapsed.Seconds()
+	result.activeRSS = atomic.LoadInt64(&peakRSS)
+	result.failed = failed
+	return result, nil
+}
+
+func openEchoSession(proxy proxyConfig, target string, size int) (net.Conn, error) {
+	conn, err := dialSocks(proxy, target, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := bytes.Repeat([]byte{'x'}, size)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	_, err = conn.Write(payload)
+	if err == nil {
+		_, err = io.ReadFull(conn, payload)
+	}
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func processRSS(pid int) (int64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "VmRSS:") {
+			fields := strings.Fields(line)
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, fmt.Errorf("no VmRSS for %d", pid)
+}
+
+// processCPU returns user plus system time of pid, assuming the usual
+// 100 Hz clock tick of /proc/<pid>/stat.
+func processCPU(pid int) (time.Duration, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("short /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	return time.Duration(utime+stime) * 10 * time.Millisecond, nil
+}
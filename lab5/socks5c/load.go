@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type loadStats struct {
+	lock      sync.Mutex
+	connect   []time.Duration
+	roundTrip []time.Duration
+	errors    map[string]int
+	sessions  int
+	failed    int
+}
+
+func (s *loadStats) addConnect(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connect = append(s.connect, d)
+}
+
+func (s *loadStats) addRoundTrip(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.roundTrip = append(s.roundTrip, d)
+}
+
+func (s *loadStats) addResult(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions++
+	if err != nil {
+		s.failed++
+		s.errors[err.Error()]++
+	}
+}
+
+func startEchoServer(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener, nil
+}
+
+func runLoad(args []string) {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	proxy := addProxyFlags(fs)
+	echoAddr := fs.String("echo", "", "echo server to target (default: start one on loopback)")
+	sessions := fs.Int("n", 100, "total number of sessions")
+	concurrency := fs.Int("c", 10, "number of concurrent sessions")
+	requests := fs.Int("requests", 10, "round trips per session")
+	size := fs.Int("size", 64, "payload size in bytes")
+	timeout := fs.Duration("timeout", 10*time.Second, "per-operation timeout")
+	fs.Parse(args)
+
+	if *sessions <= 0 || *concurrency <= 0 || *requests <= 0 || *size <= 0 {
+		fmt.Fprintln(os.Stderr, "n, c, requests and size must be positive")
+		os.Exit(2)
+	}
+
+	target := *echoAddr
+	if target == "" {
+		listener, err := startEchoServer("127.0.0.1:0")
+		if err != nil {
+			log.Fatalf("Error starting echo server: %v", err)
+		}
+		defer listener.Close()
+		target = listener.Addr().String()
+		log.Printf("Echo server listening on %s", target)
+	}
+
+	stats := &loadStats{errors: make(map[string]int)}
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				stats.addResult(runSession(*proxy, target, *requests, *size, *timeout, stats))
+			}
+		}()
+	}
+
+	start := time.Now()
+	for i := 0; i < *sessions; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printReport(stats, elapsed)
+}
+
+func runSession(proxy proxyConfig, target string, requests int, size int, timeout time.Duration, stats *loadStats) error {
+	start := time.Now()
+	conn, err := dialSocks(proxy, target, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stats.addConnect(time.Since(start))
+
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte('a' + i%26)
+	}
+	reply := make([]byte, size)
+
+	for i := 0; i < requests; i++ {
+		conn.SetDeadline(time.Now().Add(timeout))
+
+		start = time.Now()
+		_, err = conn.Write(payload)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		stats.addRoundTrip(time.Since(start))
+
+		if !bytes.Equal(payload, reply) {
+			return fmt.Errorf("echo mismatch")
+		}
+	}
+
+	return nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
+
+func printLatency(name string, samples []time.Duration) {
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	if len(samples) == 0 {
+		fmt.Printf("%-10s no samples\n", name)
+		return
+	}
+	fmt.Printf("%-10s n=%d p50=%v p90=%v p99=%v max=%v\n", name, len(samples),
+		percentile(samples, 50), percentile(samples, 90), percentile(samples, 99), samples[len(samples)-1])
+}
+
+func printReport(stats *loadStats, elapsed time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	fmt.Printf("sessions: %d ok, %d failed in %v (%.1f sessions/s)\n",
+		stats.sessions-stats.failed, stats.failed, elapsed.Round(time.Millisecond),
+		float64(stats.sessions)/elapsed.Seconds())
+	printLatency("connect", stats.connect)
+	printLatency("roundtrip", stats.roundTrip)
+
+	if len(stats.errors) > 0 {
+		fmt.Println("errors:")
+		var messages []string
+		for msg := range stats.errors {
+			messages = append(messages, msg)
+		}
+		sort.Strings(messages)
+		for _, msg := range messages {
+			fmt.Printf("  %6d  %s\n", stats.errors[msg], msg)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: socks5c <command> [flags]
+
+commands:
+  nc       open a tunnel to host:port and pipe stdin/stdout through it
+  forward  listen locally and forward every connection to host:port through the proxy
+  load     run concurrent echo sessions through the proxy and report latency
+  admin    query or reset per-user traffic counters of a running proxy
+  bench    compare memory and CPU of the proxy relay engines under many sessions
+
+run "socks5c <command> -h" for command flags
+`)
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(log.Ltime | log.Lmicroseconds)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "nc":
+		runNetcat(os.Args[2:])
+	case "forward":
+		runForward(os.Args[2:])
+	case "load":
+		runLoad(os.Args[2:])
+	case "admin":
+		runAdmin(os.Args[2:])
+	case "bench":
+		runBench(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func runNetcat(args []string) {
+	fs := flag.NewFlagSet("nc", flag.ExitOnError)
+	proxy := addProxyFlags(fs)
+	timeout := fs.Duration("timeout", 10*time.Second, "connect timeout")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: socks5c nc [flags] host:port")
+		os.Exit(2)
+	}
+
+	conn, err := dialSocks(*proxy, fs.Arg(0), *timeout)
+	if err != nil {
+		log.Fatalf("Error connecting to %s via %s: %v", fs.Arg(0), proxy.addr, err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		if err != nil {
+			log.Printf("Error reading from tunnel: %v", err)
+		}
+		close(done)
+	}()
+
+	_, err = io.Copy(conn, os.Stdin)
+	if err != nil {
+		log.Printf("Error writing to tunnel: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	<-done
+}
+
+func runForward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	proxy := addProxyFlags(fs)
+	listen := fs.String("listen", "127.0.0.1:8080", "local address to accept connections on")
+	timeout := fs.Duration("timeout", 10*time.Second, "connect timeout")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: socks5c forward [flags] host:port")
+		os.Exit(2)
+	}
+	target := fs.Arg(0)
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v", *listen, err)
+	}
+	defer listener.Close()
+	log.Printf("Forwarding %s -> %s via %s", listener.Addr().String(), target, proxy.addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			tunnel, err := dialSocks(*proxy, target, *timeout)
+			if err != nil {
+				log.Printf("Error connecting to %s for %s: %v", target, conn.RemoteAddr().String(), err)
+				return
+			}
+			defer tunnel.Close()
+
+			log.Printf("Forwarding %s", conn.RemoteAddr().String())
+			pipe(conn, tunnel)
+		}(conn)
+	}
+}
+
+func runAdmin(args []string) {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:12399", "admin address of the proxy")
+	fs.Parse(args)
+
+	valid := (fs.NArg() == 1 && fs.Arg(0) == "usage") ||
+		(fs.NArg() == 2 && (fs.Arg(0) == "usage" || fs.Arg(0) == "reset"))
+	if !valid {
+		fmt.Fprintln(os.Stderr, "usage: socks5c admin [flags] usage [user] | reset user")
+		os.Exit(2)
+	}
+
+	conn, err := net.DialTimeout("tcp", *addr, 10*time.Second)
+	if err != nil {
+		log.Fatalf("Error connecting to %s: %v", *addr, err)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, strings.Join(fs.Args(), " "))
+	if err != nil {
+		log.Fatalf("Error writing to %s: %v", *addr, err)
+	}
+	io.Copy(os.Stdout, conn)
+}
+
+func pipe(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer b.(*net.TCPConn).CloseWrite()
+		io.Copy(b, a)
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer a.(*net.TCPConn).CloseWrite()
+		io.Copy(a, b)
+	}()
+
+	wg.Wait()
+}
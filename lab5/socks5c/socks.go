@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type socksError struct {
+	code byte
+}
+
+func (e *socksError) Error() string {
+	return fmt.Sprintf("socks5 reply 0x%02x: %s", e.code, replyText(e.code))
+}
+
+func replyText(code byte) string {
+	switch code {
+	case 0x00:
+		return "succeeded"
+	case 0x01:
+		return "general SOCKS server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return "unknown"
+	}
+}
+
+type proxyConfig struct {
+	addr     string
+	user     string
+	password string
+}
+
+func addProxyFlags(fs *flag.FlagSet) *proxyConfig {
+	proxy := &proxyConfig{}
+	fs.StringVar(&proxy.addr, "proxy", "127.0.0.1:12345", "SOCKS5 proxy address")
+	fs.StringVar(&proxy.user, "user", "", "username for proxies requiring authentication")
+	fs.StringVar(&proxy.password, "pass", "", "password for -user")
+	return proxy
+}
+
+func dialSocks(proxy proxyConfig, target string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("bad target %s: %v", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad target port %s", portStr)
+	}
+
+	conn, err := net.DialTimeout("tcp", proxy.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	err = socksHandshake(conn, proxy.user, proxy.password)
+	if err == nil {
+		err = socksConnect(conn, host, uint16(port))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socksHandshake(conn net.Conn, user string, password string) error {
+	greeting := []byte{0x05, 0x01, 0x00}
+	if user != "" {
+		greeting = []byte{0x05, 0x02, 0x00, 0x02}
+	}
+	_, err := conn.Write(greeting)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	if buf[0] != 0x05 {
+		return fmt.Errorf("proxy is not SOCKS5, got version %x", buf[0])
+	}
+	switch buf[1] {
+	case 0x00:
+		return nil
+	case 0x02:
+		if user == "" {
+			return fmt.Errorf("proxy requires username/password")
+		}
+		return socksAuth(conn, user, password)
+	default:
+		return fmt.Errorf("proxy rejected auth methods, got %x", buf[1])
+	}
+}
+
+func socksAuth(conn net.Conn, user string, password string) error {
+	if len(user) > 255 || len(password) > 255 {
+		return fmt.Errorf("username and password are limited to 255 bytes")
+	}
+
+	req := []byte{0x01, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if buf[1] != 0x00 {
+		return fmt.Errorf("proxy rejected username/password")
+	}
+	return nil
+}
+
+func socksConnect(conn net.Conn, host string, port uint16) error {
+	req := []byte{0x05, 0x01, 0x00}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		req = append(req, 0x01)
+		req = append(req, ip.To4()...)
+	case ip != nil:
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, port)
+	req = append(req, portBuf...)
+
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	if buf[0] != 0x05 {
+		return fmt.Errorf("proxy is not SOCKS5, got version %x", buf[0])
+	}
+
+	var addrLen int
+	switch buf[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		lenBuf := make([]byte, 1)
+		_, err = io.ReadFull(conn, lenBuf)
+		if err != nil {
+			return err
+		}
+		addrLen = int(lenBuf[0])
+	default:
+		return fmt.Errorf("unknown bound address type %x", buf[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	if err != nil {
+		return err
+	}
+
+	if buf[1] != 0x00 {
+		return &socksError{code: buf[1]}
+	}
+	return nil
+}